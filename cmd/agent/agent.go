@@ -26,8 +26,19 @@ func main() {
 	updater := updater.New(ctx, terminated, metricsDB, cfg.PollInterval)
 	go updater.Run()
 
-	reporter := reporter.New(ctx, metricsDB, terminated, cfg.ReportInterval, cfg.Address, cfg.HashingKey)
-	go reporter.ReportWithJSON()
+	reporter := reporter.New(ctx, metricsDB, terminated, reporterOptions(cfg))
+	switch cfg.ReportMode {
+	case config.ModeBatch:
+		go reporter.ReportWithBatch()
+	case config.ModeJSON:
+		go reporter.ReportWithJSON()
+	case config.ModeURL:
+		go reporter.ReportWithURLParams()
+	case config.ModeGRPC:
+		go reporter.ReportWithGRPC()
+	default:
+		log.Fatalf("Unknown report mode `%s`.", cfg.ReportMode)
+	}
 
 	log.Printf("Agent started with config %+v\n.", cfg)
 
@@ -49,3 +60,31 @@ func main() {
 
 	log.Println("Agent has been terminated. Bye!")
 }
+
+func reporterOptions(cfg *config.Config) reporter.Options {
+	labels := map[string]string{}
+	if cfg.Hostname != "" {
+		labels["host"] = cfg.Hostname
+	}
+	if cfg.AgentID != "" {
+		labels["agent_id"] = cfg.AgentID
+	}
+	return reporter.Options{
+		Address:        cfg.Address,
+		GRPCAddress:    cfg.GRPCAddress,
+		ReportInterval: cfg.ReportInterval,
+		HashingKey:     cfg.HashingKey,
+		CryptoKey:      cfg.CryptoKey,
+		BatchSize:      cfg.BatchSize,
+		RateLimit:      cfg.RateLimit,
+		Retry: reporter.RetryPolicy{
+			MaxAttempts:     cfg.RetryMaxAttempts,
+			InitialInterval: cfg.RetryInitialInterval,
+			MaxInterval:     cfg.RetryMaxInterval,
+		},
+		OutboxFile:       cfg.OutboxFile,
+		OutboxMaxBatches: cfg.OutboxMaxBatches,
+		OutboxMaxBytes:   cfg.OutboxMaxBytes,
+		Labels:           labels,
+	}
+}
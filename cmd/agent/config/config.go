@@ -4,50 +4,123 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strconv"
 	"time"
 )
 
-type config struct {
+// Ways to report metrics, see `ReportMode`.
+const (
+	ModeBatch = "batch" // JSON batches to `/updates/`
+	ModeJSON  = "json"  // JSON per metric to `/update/`
+	ModeURL   = "url"   // URL params per metric to `/update/{type}/{name}/{value}`
+	ModeGRPC  = "grpc"  // batches streamed to the gRPC server
+)
+
+type Config struct {
 	Address        string
+	GRPCAddress    string
+	ReportMode     string
 	ReportInterval time.Duration
 	PollInterval   time.Duration
 	HashingKey     string
+	CryptoKey      string // path to the server's public key, payloads are encrypted if set
 	LogLevel       string
+	BatchSize      int
+	RateLimit      int // max simultaneous requests to the server
+
+	// Retry policy for failed reports
+	RetryMaxAttempts     int
+	RetryInitialInterval time.Duration
+	RetryMaxInterval     time.Duration
+
+	// Undelivered batches are kept in the file if set
+	OutboxFile       string
+	OutboxMaxBatches int
+	OutboxMaxBytes   int
+
+	// Labels `host` and `agent_id` are attached to every metric if the agent ID is set,
+	// metrics are sent unlabeled otherwise
+	Hostname string
+	AgentID  string
 }
 
-func NewConfig() *config {
-	cfg := config{
+func NewConfig() *Config {
+	cfg := Config{
 		// Defaults
-		Address:        "localhost:8080",
-		ReportInterval: 10 * time.Second,
-		PollInterval:   2 * time.Second,
-		LogLevel:       "warn",
+		Address:              "localhost:8080",
+		GRPCAddress:          "localhost:3200",
+		ReportMode:           ModeBatch,
+		ReportInterval:       10 * time.Second,
+		PollInterval:         2 * time.Second,
+		LogLevel:             "warn",
+		BatchSize:            100,
+		RateLimit:            4,
+		RetryMaxAttempts:     3,
+		RetryInitialInterval: 500 * time.Millisecond,
+		RetryMaxInterval:     5 * time.Second,
+		OutboxMaxBatches:     1000,
+		OutboxMaxBytes:       10 << 20,
 	}
 	cfg.updateFromFlags()
 	cfg.updateFromEnv()
+	if cfg.AgentID != "" {
+		if hostname, err := os.Hostname(); err == nil {
+			cfg.Hostname = hostname
+		}
+	}
 	return &cfg
 }
 
-func (cfg *config) updateFromFlags() {
+func (cfg *Config) updateFromFlags() {
 	flagAddress := flag.String("a", cfg.Address, "Server address.")
+	flagGRPCAddress := flag.String("g", cfg.GRPCAddress, "gRPC server address.")
+	flagReportMode := flag.String("m", cfg.ReportMode, "Report mode: batch, json, url or grpc.")
 	flagReportInterval := flag.Duration("r", cfg.ReportInterval, "Report interval in seconds.")
 	flagPollInterval := flag.Duration("p", cfg.PollInterval, "Poll interval in seconds.")
 	flagHash := flag.String("k", cfg.HashingKey, "Hashing key.")
+	flagCryptoKey := flag.String("crypto-key", cfg.CryptoKey, "Path to the server's public key to encrypt payloads.")
 	flagLogLevel := flag.String("ll", cfg.LogLevel, "Logging Level.")
+	flagBatchSize := flag.Int("b", cfg.BatchSize, "Max metrics in a single batch request, 0 means no limit.")
+	flagRateLimit := flag.Int("l", cfg.RateLimit, "Max simultaneous requests to the server.")
+	flagRetryMaxAttempts := flag.Int("ra", cfg.RetryMaxAttempts, "Max attempts per report cycle, 1 disables retries.")
+	flagRetryInitialInterval := flag.Duration("ri", cfg.RetryInitialInterval, "Delay before the first retry.")
+	flagRetryMaxInterval := flag.Duration("rm", cfg.RetryMaxInterval, "Max delay between retries.")
+	flagOutboxFile := flag.String("o", cfg.OutboxFile, "File to keep undelivered batches, empty disables outbox.")
+	flagOutboxMaxBatches := flag.Int("ob", cfg.OutboxMaxBatches, "Max batches in outbox, 0 means no limit.")
+	flagOutboxMaxBytes := flag.Int("os", cfg.OutboxMaxBytes, "Max outbox size in bytes, 0 means no limit.")
+	flagAgentID := flag.String("id", cfg.AgentID, "Agent ID attached to metrics as `agent_id` label, metrics are unlabeled if empty.")
 
 	flag.Parse()
 
 	cfg.Address = *flagAddress
+	cfg.GRPCAddress = *flagGRPCAddress
+	cfg.ReportMode = *flagReportMode
 	cfg.ReportInterval = *flagReportInterval
 	cfg.PollInterval = *flagPollInterval
 	cfg.HashingKey = *flagHash
+	cfg.CryptoKey = *flagCryptoKey
 	cfg.LogLevel = *flagLogLevel
+	cfg.BatchSize = *flagBatchSize
+	cfg.RateLimit = *flagRateLimit
+	cfg.RetryMaxAttempts = *flagRetryMaxAttempts
+	cfg.RetryInitialInterval = *flagRetryInitialInterval
+	cfg.RetryMaxInterval = *flagRetryMaxInterval
+	cfg.OutboxFile = *flagOutboxFile
+	cfg.OutboxMaxBatches = *flagOutboxMaxBatches
+	cfg.OutboxMaxBytes = *flagOutboxMaxBytes
+	cfg.AgentID = *flagAgentID
 }
 
-func (cfg *config) updateFromEnv() {
+func (cfg *Config) updateFromEnv() {
 	if addr, ok := os.LookupEnv("ADDRESS"); ok {
 		cfg.Address = addr
 	}
+	if addr, ok := os.LookupEnv("GRPC_ADDRESS"); ok {
+		cfg.GRPCAddress = addr
+	}
+	if mode, ok := os.LookupEnv("REPORT_MODE"); ok {
+		cfg.ReportMode = mode
+	}
 	if dur, ok := os.LookupEnv("POLL_INTERVAL"); ok {
 		pollInterval, err := time.ParseDuration(dur)
 		if err != nil {
@@ -65,7 +138,65 @@ func (cfg *config) updateFromEnv() {
 	if hashingKey, ok := os.LookupEnv("KEY"); ok {
 		cfg.HashingKey = hashingKey
 	}
+	if cryptoKey, ok := os.LookupEnv("CRYPTO_KEY"); ok {
+		cfg.CryptoKey = cryptoKey
+	}
 	if ll, ok := os.LookupEnv("LOG_LEVEL"); ok {
 		cfg.LogLevel = ll
 	}
+	if size, ok := os.LookupEnv("BATCH_SIZE"); ok {
+		batchSize, err := strconv.Atoi(size)
+		if err != nil {
+			log.Fatalf("Can't parse %s: %s", size, err.Error())
+		}
+		cfg.BatchSize = batchSize
+	}
+	if limit, ok := os.LookupEnv("RATE_LIMIT"); ok {
+		rateLimit, err := strconv.Atoi(limit)
+		if err != nil {
+			log.Fatalf("Can't parse %s: %s", limit, err.Error())
+		}
+		cfg.RateLimit = rateLimit
+	}
+	if attempts, ok := os.LookupEnv("RETRY_MAX_ATTEMPTS"); ok {
+		maxAttempts, err := strconv.Atoi(attempts)
+		if err != nil {
+			log.Fatalf("Can't parse %s: %s", attempts, err.Error())
+		}
+		cfg.RetryMaxAttempts = maxAttempts
+	}
+	if dur, ok := os.LookupEnv("RETRY_INITIAL_INTERVAL"); ok {
+		initialInterval, err := time.ParseDuration(dur)
+		if err != nil {
+			log.Fatalf("Can't parse %s: %s", dur, err.Error())
+		}
+		cfg.RetryInitialInterval = initialInterval
+	}
+	if dur, ok := os.LookupEnv("RETRY_MAX_INTERVAL"); ok {
+		maxInterval, err := time.ParseDuration(dur)
+		if err != nil {
+			log.Fatalf("Can't parse %s: %s", dur, err.Error())
+		}
+		cfg.RetryMaxInterval = maxInterval
+	}
+	if file, ok := os.LookupEnv("OUTBOX_FILE"); ok {
+		cfg.OutboxFile = file
+	}
+	if qty, ok := os.LookupEnv("OUTBOX_MAX_BATCHES"); ok {
+		maxBatches, err := strconv.Atoi(qty)
+		if err != nil {
+			log.Fatalf("Can't parse %s: %s", qty, err.Error())
+		}
+		cfg.OutboxMaxBatches = maxBatches
+	}
+	if size, ok := os.LookupEnv("OUTBOX_MAX_BYTES"); ok {
+		maxBytes, err := strconv.Atoi(size)
+		if err != nil {
+			log.Fatalf("Can't parse %s: %s", size, err.Error())
+		}
+		cfg.OutboxMaxBytes = maxBytes
+	}
+	if id, ok := os.LookupEnv("AGENT_ID"); ok {
+		cfg.AgentID = id
+	}
 }
@@ -0,0 +1,32 @@
+// Generates an RSA key pair for encrypting agent payloads:
+// the public key goes to the agent, the private key goes to the server.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/encryption"
+)
+
+func main() {
+	bits := flag.Int("bits", 4096, "RSA key size in bits.")
+	privPath := flag.String("private", "private.pem", "File for the private key (server).")
+	pubPath := flag.String("public", "public.pem", "File for the public key (agent).")
+	flag.Parse()
+
+	privPEM, pubPEM, err := encryption.GenerateKeys(*bits)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := os.WriteFile(*privPath, privPEM, 0o600); err != nil {
+		log.Fatalf("Can't write private key: %v", err)
+	}
+	if err := os.WriteFile(*pubPath, pubPEM, 0o644); err != nil { // nolint: gosec
+		log.Fatalf("Can't write public key: %v", err)
+	}
+
+	log.Printf("Keys written to `%s` and `%s`.\n", *privPath, *pubPath)
+}
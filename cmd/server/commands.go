@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/amiskov/metrics-and-alerting/cmd/server/config"
+	"github.com/amiskov/metrics-and-alerting/pkg/backup"
+	"github.com/amiskov/metrics-and-alerting/pkg/backup/filestore"
+	"github.com/amiskov/metrics-and-alerting/pkg/backup/s3store"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/postgres"
+)
+
+const commandsUsage = `usage: server [flags] migrate status|up|down [steps] [-drop-data]
+       server [flags] backup dump|restore [file]`
+
+// Runs the command given after flags instead of serving, e.g. `server -d <dsn> migrate status`.
+func runCommand(ctx context.Context, cfg *config.Config, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(ctx, cfg, args[1:])
+	case "backup":
+		return runBackup(ctx, cfg, args[1:])
+	default:
+		return fmt.Errorf("unknown command `%s`, %s", args[0], commandsUsage)
+	}
+}
+
+// Shows migrations status or migrates the database up or down by `steps` (1 by default).
+func runMigrate(ctx context.Context, cfg *config.Config, args []string) error {
+	if cfg.PgDSN == "" {
+		return errors.New("database DSN is not set")
+	}
+	if len(args) == 0 {
+		return errors.New(commandsUsage)
+	}
+
+	db, closeDB := postgres.New(ctx, cfg.PgDSN)
+	defer closeDB()
+
+	switch args[0] {
+	case "status":
+		statuses, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied at " + s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Printf("%04d %-20s %s\n", s.Version, s.Name, applied)
+		}
+	case "up":
+		applied, err := db.MigrateUp()
+		if err != nil {
+			return err
+		}
+		printMigrations("Applied", applied)
+	case "down":
+		// rolling back tables and columns loses their data, so it must be confirmed
+		steps, dropData := 1, false
+		for _, arg := range args[1:] {
+			if arg == "-drop-data" {
+				dropData = true
+				continue
+			}
+			n, err := strconv.Atoi(arg)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("bad steps `%s`, %s", arg, commandsUsage)
+			}
+			steps = n
+		}
+		rolledBack, err := db.MigrateDown(steps, dropData)
+		if errors.Is(err, postgres.ErrorDropsData) {
+			return fmt.Errorf("%w, confirm with `-drop-data`", err)
+		}
+		if err != nil {
+			return err
+		}
+		printMigrations("Rolled back", rolledBack)
+	default:
+		return fmt.Errorf("unknown migrate command `%s`, %s", args[0], commandsUsage)
+	}
+	return nil
+}
+
+// Dumps Postgres metrics to the JSON snapshot or restores the snapshot into the empty Postgres.
+// Without the file the S3 bucket is used if set, `STORE_FILE` otherwise.
+// Restoring takes `RESTORE_AT` into account.
+func runBackup(ctx context.Context, cfg *config.Config, args []string) error {
+	if cfg.PgDSN == "" {
+		return errors.New("database DSN is not set")
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New(commandsUsage)
+	}
+
+	db, closeDB := postgres.New(ctx, cfg.PgDSN)
+	defer closeDB()
+
+	var store backup.Storer
+	target := ""
+	if len(args) == 1 && cfg.S3Bucket != "" {
+		bucket, err := s3store.New(s3Options(cfg))
+		if err != nil {
+			return err
+		}
+		store, target = bucket, "s3://"+cfg.S3Bucket+"/"+cfg.S3Prefix
+	} else {
+		file := cfg.StoreFile
+		if len(args) > 1 {
+			file = args[1]
+		}
+		fileStore, closeFile, err := filestore.New(file, fileStoreOptions(cfg))
+		if err != nil {
+			return err
+		}
+		defer closeFile()
+		store, target = fileStore, file
+	}
+	worker := backup.New(ctx, nil, db, store, nil)
+
+	switch args[0] {
+	case "dump":
+		if err := worker.Dump(); err != nil {
+			return err
+		}
+		fmt.Printf("Dumped metrics to `%s`.\n", target)
+	case "restore":
+		if _, err := db.MigrateUp(); err != nil {
+			return err
+		}
+		// counters are added on restoring, so existing ones would be doubled
+		existing, err := db.GetAll()
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return fmt.Errorf("database has %d metrics already, restore into the empty one", len(existing))
+		}
+		if err := worker.Restore(cfg.RestoreAt); err != nil {
+			return err
+		}
+		fmt.Printf("Restored metrics from `%s`.\n", target)
+	default:
+		return fmt.Errorf("unknown backup command `%s`, %s", args[0], commandsUsage)
+	}
+	return nil
+}
+
+func printMigrations(action string, statuses []postgres.MigrationStatus) {
+	if len(statuses) == 0 {
+		fmt.Println("Nothing to migrate.")
+		return
+	}
+	for _, s := range statuses {
+		fmt.Printf("%s %04d %s\n", action, s.Version, s.Name)
+	}
+}
@@ -5,17 +5,46 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
 	Address       string
+	GRPCAddress   string // gRPC API is disabled if empty
 	StoreInterval time.Duration
 	StoreFile     string
+	StoreChecksum bool // snapshot files start with the checksum header
 	Restore       bool
 	HashingKey    string
+	CryptoKey     string // path to the private key, metric writes must come encrypted if set
 	PgDSN         string
 	LogLevel      string
+	TrustedSubnet string // CIDR, write requests from other addresses are rejected if set
+	HistorySize   int    // samples kept per metric by the in-memory storage
+	// Timestamped copies of the store file, none if 0
+	StoreGenerations int
+	StoreMaxAge      time.Duration // generations are kept forever if 0
+	StoreGzip        bool          // compress generations
+	RestoreAt        time.Time     // restore the generation taken at or before that time instead of the latest
+	WALFile          string        // write-ahead log of updates between dumps, not used if empty
+	PgDump           bool          // Postgres metrics are dumped to `StoreFile` too, off by default
+	// Retention tiers like `raw:24h,1m:720h`, history is kept forever if empty
+	Retention       string
+	CompactInterval time.Duration
+	AlertRulesFile  string // JSON array of alert rules, no rules if empty
+	AlertInterval   time.Duration
+	WebhookURLs     []string // alert notifications are sent to all of them
+	WebhookKey      string   // signs notifications with HMAC-SHA256 if set
+	WebhookWindow   time.Duration
+	// S3-compatible storage like `http://localhost:9000`, snapshots are dumped there
+	// instead of `StoreFile` if `S3Bucket` is set
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3Prefix    string // prepended to object keys, like `metrics/`
+	S3AccessKey string
+	S3SecretKey string // from `S3_SECRET_KEY` only, so it isn't seen in the process list
 }
 
 func Parse() *Config {
@@ -25,7 +54,16 @@ func Parse() *Config {
 		Restore:       true,
 		StoreInterval: 300 * time.Second,
 		StoreFile:     "/tmp/devops-metrics-db.json",
+		StoreChecksum: true,
 		LogLevel:      "warn",
+		HistorySize:   1000,
+
+		Retention:       "raw:24h,1m:720h,1h:8760h",
+		CompactInterval: time.Minute,
+		AlertInterval:   10 * time.Second,
+		WebhookWindow:   30 * time.Second,
+
+		S3Region: "us-east-1",
 	}
 	cfg.updateFromFlags()
 	cfg.updateFromEnv()
@@ -34,31 +72,116 @@ func Parse() *Config {
 
 func (cfg *Config) updateFromFlags() {
 	flagAddress := flag.String("a", cfg.Address, "Server address.")
+	flagGRPCAddress := flag.String("g", cfg.GRPCAddress, "gRPC server address, empty disables gRPC.")
 	flagRestore := flag.Bool("r", cfg.Restore, "Should server restore metrics from file on start?")
 	flagStoreInterval := flag.Duration("i", cfg.StoreInterval, "Report interval in seconds.")
 	flagStoreFile := flag.String("f", cfg.StoreFile, "File to store metrics.")
+	flagStoreChecksum := flag.Bool("sc", cfg.StoreChecksum, "Write the checksum header to the store file.")
+	flagStoreGenerations := flag.Int("sg", cfg.StoreGenerations, "Generations of the store file to keep.")
+	flagStoreMaxAge := flag.Duration("sma", cfg.StoreMaxAge, "Max age of the store file generations, 0 keeps them forever.")
+	flagStoreGzip := flag.Bool("sz", cfg.StoreGzip, "Compress the store file generations.")
+	flagRestoreAt := flag.String("ra", "", "Restore the generation at or before that time (RFC 3339) instead of the latest.")
+	flagWALFile := flag.String("wal", cfg.WALFile, "Write-ahead log of updates between dumps, empty disables it.")
 	flagHashingKey := flag.String("k", cfg.HashingKey, "Hashing key.")
+	flagCryptoKey := flag.String("crypto-key", cfg.CryptoKey, "Path to the private key to decrypt agent payloads.")
 	flagPgDSN := flag.String("d", cfg.PgDSN, "Postgres DSN.")
+	flagPgDump := flag.Bool("pd", cfg.PgDump, "Dump Postgres metrics to the store file too.")
+	flagTrustedSubnet := flag.String("t", cfg.TrustedSubnet, "Trusted subnet (CIDR) for agents' `X-Real-IP`.")
+	flagHistorySize := flag.Int("hs", cfg.HistorySize, "Samples kept per metric in memory, 0 disables history.")
+	flagRetention := flag.String("rt", cfg.Retention, "Retention tiers `resolution:ttl`, comma separated, the first is `raw`.")
+	flagCompactInterval := flag.Duration("ci", cfg.CompactInterval, "Interval of history compaction.")
+	flagAlertRulesFile := flag.String("ar", cfg.AlertRulesFile, "File with alert rules.")
+	flagAlertInterval := flag.Duration("ai", cfg.AlertInterval, "Interval of alert rules evaluation.")
+	flagWebhookURLs := flag.String("wu", "", "Comma separated webhook URLs for alert notifications.")
+	flagWebhookKey := flag.String("wk", cfg.WebhookKey, "Key to sign alert notifications.")
+	flagWebhookWindow := flag.Duration("ww", cfg.WebhookWindow, "Window to group alert notifications.")
+	flagS3Endpoint := flag.String("s3-endpoint", cfg.S3Endpoint, "S3-compatible storage endpoint for snapshots.")
+	flagS3Region := flag.String("s3-region", cfg.S3Region, "S3 region.")
+	flagS3Bucket := flag.String("s3-bucket", cfg.S3Bucket, "S3 bucket for snapshots, empty disables S3.")
+	flagS3Prefix := flag.String("s3-prefix", cfg.S3Prefix, "Prefix of snapshot keys in the S3 bucket.")
+	flagS3AccessKey := flag.String("s3-access-key", cfg.S3AccessKey, "S3 access key ID.")
 	flagLogLevel := flag.String("ll", cfg.PgDSN, "Minimal logging level: debug, info, warn, error, dpanic, panic, fatal.")
 
 	flag.Parse()
 
 	cfg.Address = *flagAddress
+	cfg.GRPCAddress = *flagGRPCAddress
 	cfg.Restore = *flagRestore
 	cfg.StoreInterval = *flagStoreInterval
 	cfg.StoreFile = *flagStoreFile
+	cfg.StoreChecksum = *flagStoreChecksum
+	cfg.StoreGenerations = *flagStoreGenerations
+	cfg.StoreMaxAge = *flagStoreMaxAge
+	cfg.StoreGzip = *flagStoreGzip
+	if *flagRestoreAt != "" {
+		cfg.RestoreAt = parseTime(*flagRestoreAt)
+	}
+	cfg.WALFile = *flagWALFile
 	cfg.HashingKey = *flagHashingKey
+	cfg.CryptoKey = *flagCryptoKey
 	cfg.PgDSN = *flagPgDSN // priority is higher than `flagStoreFile`
+	cfg.PgDump = *flagPgDump
 	cfg.LogLevel = *flagLogLevel
+	cfg.TrustedSubnet = *flagTrustedSubnet
+	cfg.HistorySize = *flagHistorySize
+	cfg.Retention = *flagRetention
+	cfg.CompactInterval = *flagCompactInterval
+	cfg.AlertRulesFile = *flagAlertRulesFile
+	cfg.AlertInterval = *flagAlertInterval
+	cfg.WebhookURLs = splitList(*flagWebhookURLs)
+	cfg.WebhookKey = *flagWebhookKey
+	cfg.WebhookWindow = *flagWebhookWindow
+	cfg.S3Endpoint = *flagS3Endpoint
+	cfg.S3Region = *flagS3Region
+	cfg.S3Bucket = *flagS3Bucket
+	cfg.S3Prefix = *flagS3Prefix
+	cfg.S3AccessKey = *flagS3AccessKey
 }
 
 func (cfg *Config) updateFromEnv() {
 	if addr, ok := os.LookupEnv("ADDRESS"); ok {
 		cfg.Address = addr
 	}
+	if addr, ok := os.LookupEnv("GRPC_ADDRESS"); ok {
+		cfg.GRPCAddress = addr
+	}
 	if file, ok := os.LookupEnv("STORE_FILE"); ok {
 		cfg.StoreFile = file
 	}
+	if checksumEnv, ok := os.LookupEnv("STORE_CHECKSUM"); ok {
+		checksum, err := strconv.ParseBool(checksumEnv)
+		if err != nil {
+			log.Fatalf("Can't parse %s env var: %s", checksumEnv, err.Error())
+		}
+		cfg.StoreChecksum = checksum
+	}
+	if generations, ok := os.LookupEnv("STORE_GENERATIONS"); ok {
+		n, err := strconv.Atoi(generations)
+		if err != nil {
+			log.Fatalf("Can't parse %s: %s", generations, err.Error())
+		}
+		cfg.StoreGenerations = n
+	}
+	if maxAgeEnv, ok := os.LookupEnv("STORE_MAX_AGE"); ok {
+		maxAge, err := time.ParseDuration(maxAgeEnv)
+		if err != nil {
+			log.Fatalf("Can't parse %s env var: %s", maxAgeEnv, err.Error())
+		}
+		cfg.StoreMaxAge = maxAge
+	}
+	if gzipEnv, ok := os.LookupEnv("STORE_GZIP"); ok {
+		gzip, err := strconv.ParseBool(gzipEnv)
+		if err != nil {
+			log.Fatalf("Can't parse %s env var: %s", gzipEnv, err.Error())
+		}
+		cfg.StoreGzip = gzip
+	}
+	if restoreAt, ok := os.LookupEnv("RESTORE_AT"); ok {
+		cfg.RestoreAt = parseTime(restoreAt)
+	}
+	if file, ok := os.LookupEnv("WAL_FILE"); ok {
+		cfg.WALFile = file
+	}
 	if restoreEnv, ok := os.LookupEnv("RESTORE"); ok {
 		restore, err := strconv.ParseBool(restoreEnv)
 		if err != nil {
@@ -76,10 +199,100 @@ func (cfg *Config) updateFromEnv() {
 	if hashingKey, ok := os.LookupEnv("KEY"); ok {
 		cfg.HashingKey = hashingKey
 	}
+	if cryptoKey, ok := os.LookupEnv("CRYPTO_KEY"); ok {
+		cfg.CryptoKey = cryptoKey
+	}
 	if dsn, ok := os.LookupEnv("DATABASE_DSN"); ok {
 		cfg.PgDSN = dsn
 	}
+	if dumpEnv, ok := os.LookupEnv("DATABASE_DUMP"); ok {
+		dump, err := strconv.ParseBool(dumpEnv)
+		if err != nil {
+			log.Fatalf("Can't parse %s env var: %s", dumpEnv, err.Error())
+		}
+		cfg.PgDump = dump
+	}
 	if ll, ok := os.LookupEnv("LOG_LEVEL"); ok {
 		cfg.LogLevel = ll
 	}
+	if subnet, ok := os.LookupEnv("TRUSTED_SUBNET"); ok {
+		cfg.TrustedSubnet = subnet
+	}
+	if size, ok := os.LookupEnv("HISTORY_SIZE"); ok {
+		historySize, err := strconv.Atoi(size)
+		if err != nil {
+			log.Fatalf("Can't parse %s: %s", size, err.Error())
+		}
+		cfg.HistorySize = historySize
+	}
+	if retention, ok := os.LookupEnv("RETENTION"); ok {
+		cfg.Retention = retention
+	}
+	if intervalEnv, ok := os.LookupEnv("COMPACT_INTERVAL"); ok {
+		compactInterval, err := time.ParseDuration(intervalEnv)
+		if err != nil {
+			log.Fatalf("Can't parse %s env var: %s", intervalEnv, err.Error())
+		}
+		cfg.CompactInterval = compactInterval
+	}
+	if file, ok := os.LookupEnv("ALERT_RULES_FILE"); ok {
+		cfg.AlertRulesFile = file
+	}
+	if intervalEnv, ok := os.LookupEnv("ALERT_INTERVAL"); ok {
+		alertInterval, err := time.ParseDuration(intervalEnv)
+		if err != nil {
+			log.Fatalf("Can't parse %s env var: %s", intervalEnv, err.Error())
+		}
+		cfg.AlertInterval = alertInterval
+	}
+	if urls, ok := os.LookupEnv("WEBHOOK_URLS"); ok {
+		cfg.WebhookURLs = splitList(urls)
+	}
+	if key, ok := os.LookupEnv("WEBHOOK_KEY"); ok {
+		cfg.WebhookKey = key
+	}
+	if windowEnv, ok := os.LookupEnv("WEBHOOK_WINDOW"); ok {
+		window, err := time.ParseDuration(windowEnv)
+		if err != nil {
+			log.Fatalf("Can't parse %s env var: %s", windowEnv, err.Error())
+		}
+		cfg.WebhookWindow = window
+	}
+	if endpoint, ok := os.LookupEnv("S3_ENDPOINT"); ok {
+		cfg.S3Endpoint = endpoint
+	}
+	if region, ok := os.LookupEnv("S3_REGION"); ok {
+		cfg.S3Region = region
+	}
+	if bucket, ok := os.LookupEnv("S3_BUCKET"); ok {
+		cfg.S3Bucket = bucket
+	}
+	if prefix, ok := os.LookupEnv("S3_PREFIX"); ok {
+		cfg.S3Prefix = prefix
+	}
+	if key, ok := os.LookupEnv("S3_ACCESS_KEY"); ok {
+		cfg.S3AccessKey = key
+	}
+	if key, ok := os.LookupEnv("S3_SECRET_KEY"); ok {
+		cfg.S3SecretKey = key
+	}
+}
+
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		log.Fatalf("Can't parse %s: %s", s, err.Error())
+	}
+	return t
+}
+
+// Splits comma separated values skipping empty ones.
+func splitList(s string) []string {
+	res := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
 }
@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"os/signal"
 	"syscall"
 
 	"github.com/amiskov/metrics-and-alerting/cmd/server/config"
+	"github.com/amiskov/metrics-and-alerting/pkg/alerting"
 	"github.com/amiskov/metrics-and-alerting/pkg/backup"
 	"github.com/amiskov/metrics-and-alerting/pkg/backup/filestore"
+	"github.com/amiskov/metrics-and-alerting/pkg/backup/s3store"
 	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/retention"
 	"github.com/amiskov/metrics-and-alerting/pkg/server/api"
+	"github.com/amiskov/metrics-and-alerting/pkg/server/grpcapi"
 	"github.com/amiskov/metrics-and-alerting/pkg/server/repo"
 	"github.com/amiskov/metrics-and-alerting/pkg/storage/inmem"
 	"github.com/amiskov/metrics-and-alerting/pkg/storage/postgres"
@@ -20,29 +25,98 @@ func main() {
 	appCtx, cancelAppCtx := context.WithCancel(context.Background())
 	envCfg := config.Parse()
 
+	if args := flag.Args(); len(args) > 0 {
+		if err := runCommand(appCtx, envCfg, args); err != nil {
+			log.Fatalln(err)
+		}
+		cancelAppCtx()
+		return
+	}
+
 	lggr := logger.Run(envCfg.LogLevel)
 
-	storage, closeStorage := initStorage(appCtx, envCfg)
+	storage, ruleStore, closeStorage := initStorage(appCtx, envCfg)
 	defer closeStorage()
 
-	repo := repo.New(appCtx, []byte(envCfg.HashingKey), storage)
-
-	// Run backup to file (if needed) only for inmemory storage
-	if envCfg.StoreFile != "" && envCfg.PgDSN == "" {
+	// Run backup to file (if needed), Postgres is only dumped and only if asked
+	var repoStorage repo.Storage = storage
+	waitBackup := func() {}
+	if envCfg.StoreFile != "" && (envCfg.PgDSN == "" || envCfg.PgDump) {
 		terminated := make(chan bool)
-		initBackupToFile(appCtx, storage, terminated, envCfg)
-		go func() {
-			<-terminated
-			close(terminated)
-			log.Println("Data was successfully backed up.")
-		}()
+		fileRules, updates, closeBackup := initBackupToFile(appCtx, storage, terminated, envCfg)
+		if envCfg.PgDSN == "" {
+			// alert rules of the inmemory setup are kept in the backup file
+			ruleStore, repoStorage = fileRules, updates
+		}
+		if closeBackup != nil {
+			// the latest metrics are dumped on termination
+			waitBackup = func() {
+				<-terminated
+				closeBackup()
+				log.Println("Data was successfully backed up.")
+			}
+		}
 	}
 
-	metricsAPI := api.New(repo, logger.NewLoggingMiddleware(lggr))
+	repo := repo.New(appCtx, []byte(envCfg.HashingKey), repoStorage)
+
+	// Compact and clean up the history for both storages
+	tiers, err := retention.ParseTiers(envCfg.Retention)
+	if err != nil {
+		log.Fatalf("Can't parse %s: %s", envCfg.Retention, err.Error())
+	}
+	if len(tiers) > 0 && envCfg.CompactInterval > 0 {
+		compactor := retention.New(appCtx, storage, tiers)
+		go compactor.Run(envCfg.CompactInterval)
+	}
+
+	rules := []alerting.Rule{}
+	if envCfg.AlertRulesFile != "" {
+		rules, err = alerting.LoadRules(envCfg.AlertRulesFile)
+		if err != nil {
+			log.Fatalf("Can't load alert rules: %s", err.Error())
+		}
+	}
+	var notifier alerting.Notifier
+	if len(envCfg.WebhookURLs) > 0 {
+		webhook := alerting.NewWebhook(appCtx, alerting.WebhookOptions{
+			URLs:   envCfg.WebhookURLs,
+			Key:    envCfg.WebhookKey,
+			Window: envCfg.WebhookWindow,
+		})
+		go webhook.Run()
+		notifier = webhook
+	}
+	alerts := alerting.New(appCtx, repo, rules, notifier)
+	if ruleStore != nil {
+		if err := alerts.Persist(ruleStore); err != nil {
+			log.Fatalf("Can't load alert rules: %s", err.Error())
+		}
+	}
+	alerts.SetHistoryLimits(historyLimits(envCfg, tiers))
+	if envCfg.AlertInterval > 0 {
+		go alerts.Run(envCfg.AlertInterval)
+	}
+
+	metricsAPI := api.New(repo, alerts, logger.NewLoggingMiddleware(lggr), api.Options{
+		CryptoKey:     envCfg.CryptoKey,
+		TrustedSubnet: envCfg.TrustedSubnet,
+	})
 	go metricsAPI.Run(envCfg.Address)
 
 	log.Printf("Serving at http://%s\n", envCfg.Address)
 
+	stopGRPC := func() {}
+	if envCfg.GRPCAddress != "" {
+		grpcAPI := grpcapi.New(repo, lggr, grpcapi.Options{
+			HashingKey:    envCfg.HashingKey,
+			TrustedSubnet: envCfg.TrustedSubnet,
+		})
+		go grpcAPI.Run(envCfg.GRPCAddress)
+		stopGRPC = grpcAPI.Stop
+		log.Printf("Serving gRPC at %s\n", envCfg.GRPCAddress)
+	}
+
 	// Managing user signals
 	osSignalCtx, stopBySyscall := signal.NotifyContext(context.Background(),
 		syscall.SIGTERM,
@@ -52,35 +126,107 @@ func main() {
 
 	<-osSignalCtx.Done()
 	log.Println("Terminating server, please wait...")
+	stopGRPC()
 	cancelAppCtx()
+	waitBackup()
 	stopBySyscall()
 }
 
-func initStorage(ctx context.Context, cfg *config.Config) (repo.Storage, func()) {
+// Storage of the latest metrics and their history.
+type metricsStorage interface {
+	repo.Storage
+	retention.Store
+}
+
+// Returns the storage of metrics and the storage of alert rules if the first one can keep them.
+func initStorage(ctx context.Context, cfg *config.Config) (metricsStorage, alerting.RuleStore, func()) {
 	// Using PostgreSQL
 	if cfg.PgDSN != "" {
-		db, closer := postgres.New(ctx, cfg)
+		db, closer := postgres.New(ctx, cfg.PgDSN)
 		db.Migrate()
-		return db, closer
+		return db, db, closer
 	}
 
-	db := inmem.New(ctx, []byte(cfg.HashingKey))
-	return db, func() {}
+	db := inmem.NewWithHistory(ctx, []byte(cfg.HashingKey), cfg.HistorySize)
+	return db, nil, func() {}
 }
 
-func initBackupToFile(ctx context.Context, db backup.Sourcer, terminated chan<- bool, cfg *config.Config) func() {
-	storeToBackup, closeFile, err := filestore.New(cfg.StoreFile)
+// Restores metrics and runs the backup worker. Returns the file storage which keeps alert rules of the inmemory setup
+// and the storage to update metrics through, it logs updates if the WAL is used.
+func initBackupToFile(ctx context.Context, db metricsStorage, terminated chan<- bool,
+	cfg *config.Config,
+) (alerting.RuleStore, repo.Storage, func()) {
+	storeToBackup, closeFile, err := filestore.New(cfg.StoreFile, fileStoreOptions(cfg))
 	if err != nil {
 		logger.Log(ctx).Errorf("main: failed creating file storage: %s", err.Error())
-		return nil
+		return nil, db, nil
+	}
+
+	var updates repo.Storage = db
+	var wal *backup.WAL
+	if cfg.WALFile != "" && cfg.PgDSN == "" {
+		wal, err = backup.NewWAL(ctx, cfg.WALFile)
+		if err != nil {
+			log.Fatalf("Can't open the write-ahead log: %s", err.Error())
+		}
+		updates = wal.Storage(db)
 	}
 
-	backup := backup.New(ctx, terminated, db, storeToBackup)
-	go backup.Run(cfg.Restore, cfg.StoreInterval)
+	// snapshots go off-host if the bucket is set, the file keeps alert rules anyway
+	var snapshots backup.Storer = storeToBackup
+	if cfg.S3Bucket != "" {
+		bucket, err := s3store.New(s3Options(cfg))
+		if err != nil {
+			log.Fatalf("Can't use S3 storage: %s", err.Error())
+		}
+		snapshots = bucket
+	}
 
-	return func() {
+	// Postgres keeps its data, it's restored explicitly with `server backup restore`
+	restore := cfg.Restore && cfg.PgDSN == ""
+	backup := backup.New(ctx, terminated, db, snapshots, wal)
+	backup.Run(restore, cfg.RestoreAt, cfg.StoreInterval)
+
+	return storeToBackup, updates, func() {
 		if err := closeFile(); err != nil {
 			logger.Log(ctx).Errorf("main: failed closing file `%s`", cfg.StoreFile)
 		}
 	}
 }
+
+func fileStoreOptions(cfg *config.Config) filestore.Options {
+	return filestore.Options{
+		Checksum:    cfg.StoreChecksum,
+		Generations: cfg.StoreGenerations,
+		MaxAge:      cfg.StoreMaxAge,
+		Gzip:        cfg.StoreGzip,
+	}
+}
+
+func s3Options(cfg *config.Config) s3store.Options {
+	return s3store.Options{
+		Endpoint: cfg.S3Endpoint,
+		Bucket:   cfg.S3Bucket,
+		Prefix:   cfg.S3Prefix,
+		Credentials: s3store.Credentials{
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			Region:    cfg.S3Region,
+		},
+		Generations: cfg.StoreGenerations,
+		MaxAge:      cfg.StoreMaxAge,
+	}
+}
+
+// Postgres keeps all raw samples, the inmemory storage keeps `HistorySize` of them.
+// Raw samples are removed by the compactor after the TTL of the `raw` tier.
+func historyLimits(cfg *config.Config, tiers []retention.Tier) alerting.HistoryLimits {
+	limits := alerting.HistoryLimits{Samples: -1}
+	if cfg.PgDSN == "" {
+		limits.Samples = cfg.HistorySize
+	}
+	if len(tiers) > 0 && cfg.CompactInterval > 0 {
+		limits.RawTTL = tiers[0].TTL
+	}
+	return limits
+}
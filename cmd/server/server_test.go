@@ -1,12 +1,22 @@
 package main_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/amiskov/metrics-and-alerting/pkg/alerting"
+	"github.com/amiskov/metrics-and-alerting/pkg/encryption"
 	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
 	"github.com/amiskov/metrics-and-alerting/pkg/server/api"
 	"github.com/amiskov/metrics-and-alerting/pkg/server/repo"
 	"github.com/amiskov/metrics-and-alerting/pkg/storage/inmem"
@@ -87,7 +97,7 @@ func TestUpdateMetric(t *testing.T) {
 			repo := repo.New(ctx, hashingKey, storage)
 
 			loggingMiddleware := logger.NewLoggingMiddleware(logger.Run("debug"))
-			metricsAPI := api.New(repo, loggingMiddleware)
+			metricsAPI := api.New(repo, nil, loggingMiddleware, api.Options{})
 			metricsAPI.Router.ServeHTTP(w, request)
 
 			res := w.Result()
@@ -103,3 +113,727 @@ func TestUpdateMetric(t *testing.T) {
 		})
 	}
 }
+
+func gzipped(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		code int
+	}{
+		{
+			name: "test gzipped batch success",
+			body: gzipped(t, []byte(`[{"id":"Alloc","type":"gauge","value":1.5}]`)),
+			code: http.StatusOK,
+		},
+		{
+			name: "test malformed gzip",
+			body: []byte(`[{"id":"Alloc","type":"gauge","value":1.5}]`),
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "test decompressed body too large",
+			body: gzipped(t, make([]byte, 11<<20)),
+			code: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(tt.body))
+			request.Header.Set("Content-Type", "application/json")
+			request.Header.Set("Content-Encoding", "gzip")
+
+			w := httptest.NewRecorder()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			storage := inmem.New(ctx, nil)
+			repo := repo.New(ctx, nil, storage)
+
+			metricsAPI := api.New(repo, nil, logger.NewLoggingMiddleware(logger.Run("debug")), api.Options{})
+			metricsAPI.Router.ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestEncryptionRequired(t *testing.T) {
+	privPEM, pubPEM, err := encryption.GenerateKeys(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	privPath, pubPath := filepath.Join(dir, "private.pem"), filepath.Join(dir, "public.pem")
+	if err := os.WriteFile(privPath, privPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pubPath, pubPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := encryption.ReadPublicKey(pubPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := []byte(`[{"id":"Alloc","type":"gauge","value":1.5}]`)
+	encrypted, err := encryption.Encrypt(pub, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      []byte
+		encrypted bool
+		code      int
+	}{
+		{
+			name:      "test encrypted batch",
+			method:    http.MethodPost,
+			path:      "/updates/",
+			body:      encrypted,
+			encrypted: true,
+			code:      http.StatusOK,
+		},
+		{
+			name:   "test plaintext batch",
+			method: http.MethodPost,
+			path:   "/updates/",
+			body:   batch,
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "test plaintext JSON update",
+			method: http.MethodPost,
+			path:   "/update/",
+			body:   []byte(`{"id":"Alloc","type":"gauge","value":1.5}`),
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "test update with URL params",
+			method: http.MethodPost,
+			path:   "/update/gauge/Alloc/1.5",
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "test plaintext read",
+			method: http.MethodGet,
+			path:   "/j",
+			code:   http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(tt.body))
+			request.Header.Set("Content-Type", "application/json")
+			if tt.encrypted {
+				request.Header.Set(encryption.Header, encryption.Scheme)
+			}
+
+			w := httptest.NewRecorder()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			storage := inmem.New(ctx, nil)
+			repo := repo.New(ctx, nil, storage)
+
+			cfg := api.Options{CryptoKey: privPath}
+			metricsAPI := api.New(repo, nil, logger.NewLoggingMiddleware(logger.Run("debug")), cfg)
+			metricsAPI.Router.ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		realIP string
+		code   int
+	}{
+		{
+			name:   "test write from trusted subnet",
+			method: http.MethodPost,
+			path:   "/update/gauge/Alloc/1.5",
+			realIP: "10.0.0.7",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "test write from untrusted address",
+			method: http.MethodPost,
+			path:   "/update/gauge/Alloc/1.5",
+			realIP: "192.168.1.7",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "test batch write without address",
+			method: http.MethodPost,
+			path:   "/updates/",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "test read from untrusted address",
+			method: http.MethodGet,
+			path:   "/j",
+			realIP: "192.168.1.7",
+			code:   http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.realIP != "" {
+				request.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			w := httptest.NewRecorder()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			storage := inmem.New(ctx, nil)
+			repo := repo.New(ctx, nil, storage)
+
+			cfg := api.Options{TrustedSubnet: "10.0.0.0/24"}
+			metricsAPI := api.New(repo, nil, logger.NewLoggingMiddleware(logger.Run("debug")), cfg)
+			metricsAPI.Router.ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "test text format",
+			contentType: "text/plain; version=0.0.4; charset=utf-8",
+			body: "# TYPE Alloc gauge\nAlloc 1.5\n" +
+				"# TYPE PollCount counter\nPollCount 3\n" +
+				"# TYPE _5m_load_avg gauge\n_5m_load_avg 0.25\n",
+		},
+		{
+			name:        "test openmetrics format",
+			accept:      "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5",
+			contentType: "application/openmetrics-text; version=1.0.0; charset=utf-8",
+			body: "# TYPE Alloc gauge\nAlloc 1.5\n" +
+				"# TYPE PollCount counter\nPollCount_total 3\n" +
+				"# TYPE _5m_load_avg gauge\n_5m_load_avg 0.25\n" +
+				"# EOF\n",
+		},
+		{
+			name:        "test text format preferred",
+			accept:      "application/openmetrics-text;q=0.3,text/plain",
+			contentType: "text/plain; version=0.0.4; charset=utf-8",
+			body: "# TYPE Alloc gauge\nAlloc 1.5\n" +
+				"# TYPE PollCount counter\nPollCount 3\n" +
+				"# TYPE _5m_load_avg gauge\n_5m_load_avg 0.25\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			storage := inmem.New(ctx, nil)
+			repo := repo.New(ctx, nil, storage)
+			metricsAPI := api.New(repo, nil, logger.NewLoggingMiddleware(logger.Run("debug")), api.Options{})
+			for _, path := range []string{
+				"/update/gauge/Alloc/1.5",
+				"/update/counter/PollCount/3",
+				"/update/gauge/5m.load-avg/0.25",
+			} {
+				w := httptest.NewRecorder()
+				metricsAPI.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("Failed seeding `%s`: status %d", path, w.Code)
+				}
+			}
+
+			request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.accept != "" {
+				request.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			metricsAPI.Router.ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("Expected status code %d, got %d", http.StatusOK, res.StatusCode)
+			}
+			if ct := res.Header.Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Expected Content-Type `%s`, got `%s`", tt.contentType, ct)
+			}
+			if body := w.Body.String(); body != tt.body {
+				t.Errorf("Expected body:\n%s\ngot:\n%s", tt.body, body)
+			}
+		})
+	}
+}
+
+func TestPrometheusCollisions(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		body  string
+	}{
+		{
+			name:  "test gauge and counter with the same name",
+			paths: []string{"/update/gauge/Load/1", "/update/counter/Load/2"},
+			body:  "# TYPE Load_counter counter\nLoad_counter 2\n# TYPE Load_gauge gauge\nLoad_gauge 1\n",
+		},
+		{
+			name:  "test names sanitized to the same one",
+			paths: []string{"/update/gauge/a_b/2", "/update/gauge/a.b/1"},
+			body:  "# TYPE a_b gauge\na_b 1\n",
+		},
+		{
+			name:  "test suffixed name is taken",
+			paths: []string{"/update/gauge/Load/1", "/update/counter/Load/2", "/update/counter/Load_gauge/3"},
+			body:  "# TYPE Load_counter counter\nLoad_counter 2\n# TYPE Load_gauge counter\nLoad_gauge 3\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			storage := inmem.New(ctx, nil)
+			repo := repo.New(ctx, nil, storage)
+			metricsAPI := api.New(repo, nil, logger.NewLoggingMiddleware(logger.Run("debug")), api.Options{})
+			for _, path := range tt.paths {
+				w := httptest.NewRecorder()
+				metricsAPI.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("Failed seeding `%s`: status %d", path, w.Code)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			metricsAPI.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			if body := w.Body.String(); body != tt.body {
+				t.Errorf("Expected body:\n%s\ngot:\n%s", tt.body, body)
+			}
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		code    int
+		samples int
+	}{
+		{
+			name:    "test full history",
+			path:    "/history/gauge/Alloc",
+			code:    http.StatusOK,
+			samples: 3,
+		},
+		{
+			name:    "test history downsampled",
+			path:    "/history/gauge/Alloc?step=1h",
+			code:    http.StatusOK,
+			samples: 1,
+		},
+		{
+			name:    "test history out of range",
+			path:    "/history/gauge/Alloc?from=2000-01-01T00:00:00Z&to=2000-01-02T00:00:00Z",
+			code:    http.StatusOK,
+			samples: 0,
+		},
+		{
+			name: "test history bad range",
+			path: "/history/gauge/Alloc?from=2000-01-02T00:00:00Z&to=2000-01-01T00:00:00Z",
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "test history unknown type",
+			path: "/history/unknown/Alloc",
+			code: http.StatusNotImplemented,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			storage := inmem.NewWithHistory(ctx, nil, 10)
+			repo := repo.New(ctx, nil, storage)
+			metricsAPI := api.New(repo, nil, logger.NewLoggingMiddleware(logger.Run("debug")), api.Options{})
+			for _, path := range []string{
+				"/update/gauge/Alloc/1",
+				"/update/gauge/Alloc/2",
+				"/update/gauge/Alloc/3",
+			} {
+				w := httptest.NewRecorder()
+				metricsAPI.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("Failed seeding `%s`: status %d", path, w.Code)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			metricsAPI.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.code {
+				t.Fatalf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			h := models.History{}
+			if err := json.NewDecoder(res.Body).Decode(&h); err != nil {
+				t.Fatalf("Failed decoding history: %v", err)
+			}
+			if len(h.Samples) != tt.samples {
+				t.Fatalf("Expected %d samples, got %d", tt.samples, len(h.Samples))
+			}
+			if tt.samples > 0 && *h.Samples[len(h.Samples)-1].Value != 3 {
+				t.Errorf("Expected the latest value 3, got %v", *h.Samples[len(h.Samples)-1].Value)
+			}
+		})
+	}
+}
+
+func TestLabels(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	storage := inmem.New(ctx, nil)
+	repo := repo.New(ctx, nil, storage)
+	metricsAPI := api.New(repo, nil, logger.NewLoggingMiddleware(logger.Run("debug")), api.Options{})
+	for _, body := range []string{
+		`{"id": "Alloc", "type": "gauge", "value": 1, "labels": {"host": "web1", "agent_id": "a1"}}`,
+		`{"id": "Alloc", "type": "gauge", "value": 2, "labels": {"host": "web2", "agent_id": "a2"}}`,
+		`{"id": "Alloc", "type": "gauge", "value": 3}`,
+	} {
+		w := httptest.NewRecorder()
+		metricsAPI.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed seeding `%s`: status %d", body, w.Code)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		code   int
+		values []float64
+	}{
+		{
+			name:   "test all series",
+			path:   "/j",
+			code:   http.StatusOK,
+			values: []float64{3, 1, 2},
+		},
+		{
+			name:   "test filter by label",
+			path:   "/j?label=host:web2",
+			code:   http.StatusOK,
+			values: []float64{2},
+		},
+		{
+			name:   "test filter by labels",
+			path:   "/j?label=host:web1&label=agent_id:a2",
+			code:   http.StatusOK,
+			values: []float64{},
+		},
+		{
+			name: "test bad label",
+			path: "/j?label=host",
+			code: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			metricsAPI.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if w.Code != tt.code {
+				t.Fatalf("Expected status code %d, got %d", tt.code, w.Code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			metrics := []models.Metrics{}
+			if err := json.NewDecoder(w.Body).Decode(&metrics); err != nil {
+				t.Fatalf("Failed decoding metrics: %v", err)
+			}
+			if len(metrics) != len(tt.values) {
+				t.Fatalf("Expected %d metrics, got %+v", len(tt.values), metrics)
+			}
+			for i, m := range metrics {
+				if *m.Value != tt.values[i] {
+					t.Errorf("Expected value %v, got %v", tt.values[i], *m.Value)
+				}
+			}
+		})
+	}
+
+	t.Run("test get series", func(t *testing.T) {
+		body := `{"id": "Alloc", "type": "gauge", "labels": {"host": "web2", "agent_id": "a2"}}`
+		w := httptest.NewRecorder()
+		metricsAPI.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/value/", strings.NewReader(body)))
+
+		m := models.Metrics{}
+		if err := json.NewDecoder(w.Body).Decode(&m); err != nil {
+			t.Fatalf("Failed decoding metric: %v", err)
+		}
+		if m.Value == nil || *m.Value != 2 || m.Labels["host"] != "web2" {
+			t.Errorf("Expected the series of web2, got %+v", m)
+		}
+	})
+}
+
+func TestAlerts(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		code   int
+		alerts int
+	}{
+		{
+			name:   "test firing alerts",
+			path:   "/alerts",
+			code:   http.StatusOK,
+			alerts: 1,
+		},
+		{
+			name:   "test pending alerts",
+			path:   "/alerts?state=pending",
+			code:   http.StatusOK,
+			alerts: 0,
+		},
+		{
+			name: "test unknown state",
+			path: "/alerts?state=silenced",
+			code: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			storage := inmem.New(ctx, nil)
+			repo := repo.New(ctx, nil, storage)
+			rules := []alerting.Rule{{
+				Name:       "HighAlloc",
+				MetricType: models.MGauge,
+				MetricName: "Alloc",
+				Comparison: ">",
+				Threshold:  100,
+			}}
+			alerts := alerting.New(ctx, repo, rules, nil)
+			metricsAPI := api.New(repo, alerts, logger.NewLoggingMiddleware(logger.Run("debug")), api.Options{})
+
+			w := httptest.NewRecorder()
+			metricsAPI.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/gauge/Alloc/150", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Failed updating metric: status %d", w.Code)
+			}
+			alerts.Evaluate(time.Now())
+
+			w = httptest.NewRecorder()
+			metricsAPI.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.code {
+				t.Fatalf("Expected status code %d, got %d", tt.code, res.StatusCode)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			got := []alerting.Alert{}
+			if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+				t.Fatalf("Failed decoding alerts: %v", err)
+			}
+			if len(got) != tt.alerts {
+				t.Errorf("Expected %d alerts, got %d", tt.alerts, len(got))
+			}
+		})
+	}
+}
+
+func TestRulesAPI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	storage := inmem.New(ctx, nil)
+	repo := repo.New(ctx, nil, storage)
+	alerts := alerting.New(ctx, repo, nil, nil)
+	metricsAPI := api.New(repo, alerts, logger.NewLoggingMiddleware(logger.Run("debug")), api.Options{})
+
+	// steps depend on each other
+	steps := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{
+			name:   "test create rule",
+			method: http.MethodPost,
+			path:   "/api/rules",
+			body:   `{"name":"HighAlloc","metric_type":"gauge","metric_name":"Alloc","comparison":">","threshold":100}`,
+			code:   http.StatusCreated,
+		},
+		{
+			name:   "test create duplicate rule",
+			method: http.MethodPost,
+			path:   "/api/rules",
+			body:   `{"name":"HighAlloc","metric_type":"gauge","metric_name":"Alloc","comparison":">","threshold":100}`,
+			code:   http.StatusConflict,
+		},
+		{
+			name:   "test create rule with unknown metric type",
+			method: http.MethodPost,
+			path:   "/api/rules",
+			body:   `{"name":"Bad","metric_type":"histogram","metric_name":"Alloc","comparison":">"}`,
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "test update rule",
+			method: http.MethodPut,
+			path:   "/api/rules/HighAlloc",
+			body:   `{"metric_type":"gauge","metric_name":"Alloc","comparison":">","threshold":200,"for":"1m"}`,
+			code:   http.StatusOK,
+		},
+		{
+			name:   "test update missing rule",
+			method: http.MethodPut,
+			path:   "/api/rules/Missing",
+			body:   `{"metric_type":"gauge","metric_name":"Alloc","comparison":">"}`,
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "test get rule",
+			method: http.MethodGet,
+			path:   "/api/rules/HighAlloc",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "test delete rule",
+			method: http.MethodDelete,
+			path:   "/api/rules/HighAlloc",
+			code:   http.StatusNoContent,
+		},
+		{
+			name:   "test get deleted rule",
+			method: http.MethodGet,
+			path:   "/api/rules/HighAlloc",
+			code:   http.StatusNotFound,
+		},
+	}
+	for _, s := range steps {
+		t.Run(s.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			request := httptest.NewRequest(s.method, s.path, bytes.NewBufferString(s.body))
+			metricsAPI.Router.ServeHTTP(w, request)
+
+			if w.Code != s.code {
+				t.Errorf("Expected status code %d, got %d: %s", s.code, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if rules := alerts.Rules(); len(rules) != 0 {
+		t.Errorf("Expected no rules, got %+v", rules)
+	}
+}
+
+func TestSilencesAPI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	storage := inmem.New(ctx, nil)
+	repo := repo.New(ctx, nil, storage)
+	alerts := alerting.New(ctx, repo, nil, nil)
+	metricsAPI := api.New(repo, alerts, logger.NewLoggingMiddleware(logger.Run("debug")), api.Options{})
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		metricsAPI.Router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return w
+	}
+
+	w := serve(http.MethodPost, "/api/silences", `{"comment":"no matchers","ends_at":"2100-01-01T00:00:00Z"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for silence without matchers, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = serve(http.MethodPost, "/api/silences",
+		`{"metric_name":"Heap*","comment":"deploy","ends_at":"2100-01-01T00:00:00Z"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	created := alerting.Silence{}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	w = serve(http.MethodGet, "/", "")
+	if !strings.Contains(w.Body.String(), "deploy") {
+		t.Errorf("Expected the silence on the index page, got %s", w.Body.String())
+	}
+
+	if w = serve(http.MethodDelete, "/api/silences/"+created.ID, ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if w = serve(http.MethodDelete, "/api/silences/"+created.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
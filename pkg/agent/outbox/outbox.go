@@ -0,0 +1,213 @@
+// Package `outbox` keeps metric batches which weren't delivered to the server in a file
+// and gives them back in the order they were added.
+//
+// Counters in batches are deltas. When the outbox is full the oldest batch is evicted:
+// its gauges are dropped as stale, but its counters are merged into the next batch,
+// so no increments are lost.
+package outbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+type Outbox struct {
+	mx         *sync.Mutex
+	filePath   string
+	maxBatches int // 0 means no limit
+	maxBytes   int // 0 means no limit
+	batches    []batch
+}
+
+type batch struct {
+	metrics []models.Metrics
+	size    int // bytes of encoded metrics
+}
+
+// Creates the outbox stored in `filePath` and loads batches left from the previous run.
+func New(filePath string, maxBatches int, maxBytes int) (*Outbox, error) {
+	o := &Outbox{
+		mx:         new(sync.Mutex),
+		filePath:   filePath,
+		maxBatches: maxBatches,
+		maxBytes:   maxBytes,
+	}
+
+	content, err := os.ReadFile(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("outbox: failed reading `%s`: %w", filePath, err)
+	}
+	if len(content) == 0 {
+		return o, nil
+	}
+
+	stored := [][]models.Metrics{}
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("outbox: failed decoding `%s`: %w", filePath, err)
+	}
+	for _, metrics := range stored {
+		b, err := newBatch(metrics)
+		if err != nil {
+			return nil, err
+		}
+		o.batches = append(o.batches, b)
+	}
+	log.Printf("Outbox `%s` has %d undelivered batch(es).\n", filePath, len(o.batches))
+
+	return o, nil
+}
+
+func (o *Outbox) Len() int {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	return len(o.batches)
+}
+
+// Adds the batch to the end of the outbox evicting the oldest batches if limits are exceeded.
+func (o *Outbox) Push(metrics []models.Metrics) error {
+	b, err := newBatch(metrics)
+	if err != nil {
+		return err
+	}
+
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	o.batches = append(o.batches, b)
+	if err := o.evict(); err != nil {
+		return err
+	}
+	return o.save()
+}
+
+// Returns the oldest batch, `false` if the outbox is empty.
+func (o *Outbox) Front() ([]models.Metrics, bool) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	if len(o.batches) == 0 {
+		return nil, false
+	}
+	return o.batches[0].metrics, true
+}
+
+// Removes the oldest batch, should be called once it's delivered.
+func (o *Outbox) Pop() error {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	if len(o.batches) == 0 {
+		return nil
+	}
+	o.batches = o.batches[1:]
+	return o.save()
+}
+
+// ============ Not exported
+
+func newBatch(metrics []models.Metrics) (batch, error) {
+	jbz, err := json.Marshal(metrics)
+	if err != nil {
+		return batch{}, fmt.Errorf("outbox: failed encoding batch: %w", err)
+	}
+	return batch{metrics: metrics, size: len(jbz)}, nil
+}
+
+func (o *Outbox) totalSize() int {
+	total := 0
+	for _, b := range o.batches {
+		total += b.size
+	}
+	return total
+}
+
+func (o *Outbox) overLimits() bool {
+	return (o.maxBatches > 0 && len(o.batches) > o.maxBatches) ||
+		(o.maxBytes > 0 && o.totalSize() > o.maxBytes)
+}
+
+// Drops the oldest batches while limits are exceeded, the latest batch is always kept.
+func (o *Outbox) evict() error {
+	for len(o.batches) > 1 && o.overLimits() {
+		merged, err := newBatch(mergeCounters(o.batches[0].metrics, o.batches[1].metrics))
+		if err != nil {
+			return err
+		}
+		log.Printf("Outbox is full, evicted the oldest batch of %d metric(s).\n", len(o.batches[0].metrics))
+		o.batches[1] = merged
+		o.batches = o.batches[1:]
+	}
+	return nil
+}
+
+// Returns `dst` with counter deltas from `src` added. Gauges from `src` are ignored.
+func mergeCounters(src, dst []models.Metrics) []models.Metrics {
+	merged := make([]models.Metrics, len(dst), len(dst)+len(src))
+	copy(merged, dst)
+
+	for _, m := range src {
+		if m.MType != models.MCounter || m.Delta == nil {
+			continue
+		}
+		found := false
+		for k, d := range merged {
+			if d.MType == models.MCounter && d.ID == m.ID && d.Delta != nil {
+				sum := *d.Delta + *m.Delta
+				merged[k].Delta = &sum
+				merged[k].Hash = "" // not valid anymore
+				found = true
+				break
+			}
+		}
+		if !found {
+			m.Hash = ""
+			merged = append(merged, m)
+		}
+	}
+	return merged
+}
+
+// Atomically replaces the outbox file with the current batches.
+func (o *Outbox) save() error {
+	stored := make([][]models.Metrics, 0, len(o.batches))
+	for _, b := range o.batches {
+		stored = append(stored, b.metrics)
+	}
+	jbz, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("outbox: failed encoding batches: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(o.filePath), filepath.Base(o.filePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("outbox: failed creating temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after successful rename
+
+	if _, err := tmp.Write(jbz); err != nil {
+		tmp.Close()
+		return fmt.Errorf("outbox: failed writing `%s`: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("outbox: failed syncing `%s`: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("outbox: failed closing `%s`: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), o.filePath); err != nil {
+		return fmt.Errorf("outbox: failed replacing `%s`: %w", o.filePath, err)
+	}
+	return nil
+}
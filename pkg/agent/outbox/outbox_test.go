@@ -0,0 +1,110 @@
+package outbox_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/agent/outbox"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+func batch(pollCount int64, alloc float64) []models.Metrics {
+	return []models.Metrics{
+		{ID: "PollCount", MType: models.MCounter, Delta: &pollCount},
+		{ID: "Alloc", MType: models.MGauge, Value: &alloc},
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "outbox.json")
+
+	box, err := outbox.New(filePath, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		if err := box.Push(batch(i, float64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("test oldest batch evicted", func(t *testing.T) {
+		if box.Len() != 2 {
+			t.Errorf("Expected 2 batches, got %d", box.Len())
+		}
+	})
+
+	t.Run("test batches survive restart in order with merged counters", func(t *testing.T) {
+		restored, err := outbox.New(filePath, 2, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantDeltas := []int64{1 + 2, 3} // evicted counter merged into the next batch
+		wantValues := []float64{2, 3}   // evicted gauge dropped
+		for k := range wantDeltas {
+			metrics, ok := restored.Front()
+			if !ok {
+				t.Fatalf("Expected batch %d, outbox is empty", k)
+			}
+			if *metrics[0].Delta != wantDeltas[k] {
+				t.Errorf("Expected PollCount %d, got %d", wantDeltas[k], *metrics[0].Delta)
+			}
+			if *metrics[1].Value != wantValues[k] {
+				t.Errorf("Expected Alloc %f, got %f", wantValues[k], *metrics[1].Value)
+			}
+			if err := restored.Pop(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, ok := restored.Front(); ok {
+			t.Error("Expected empty outbox")
+		}
+	})
+}
+
+func TestOutboxMaxBytes(t *testing.T) {
+	jbz, err := json.Marshal(batch(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(jbz) // single-digit values keep every batch of the same size
+
+	tests := []struct {
+		name      string
+		maxBytes  int
+		wantLen   int
+		wantDelta int64 // PollCount of the oldest batch
+	}{
+		{name: "test no eviction under the limit", maxBytes: 3 * size, wantLen: 3, wantDelta: 1},
+		{name: "test oldest batch evicted over the limit", maxBytes: 3*size - 1, wantLen: 2, wantDelta: 1 + 2},
+		{name: "test latest batch kept even if it's too big", maxBytes: 1, wantLen: 1, wantDelta: 1 + 2 + 3},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			box, err := outbox.New(filepath.Join(t.TempDir(), "outbox.json"), 0, tt.maxBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := int64(1); i <= 3; i++ {
+				if err := box.Push(batch(i, float64(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if box.Len() != tt.wantLen {
+				t.Errorf("Expected %d batches, got %d", tt.wantLen, box.Len())
+			}
+			metrics, ok := box.Front()
+			if !ok {
+				t.Fatal("Expected non-empty outbox")
+			}
+			if *metrics[0].Delta != tt.wantDelta {
+				t.Errorf("Expected PollCount %d, got %d", tt.wantDelta, *metrics[0].Delta)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package reporter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+// Response body of `/updates/` when the server rejected some metrics of the batch.
+type bulkUpdateResponse struct {
+	Error    string   `json:"error"`
+	Rejected []string `json:"rejected"`
+}
+
+var (
+	// The batch wasn't delivered but may be delivered later.
+	errNotDelivered = errors.New("batch not delivered")
+	// The server refuses the batch for good, it's dropped with its counters instead of blocking the outbox.
+	errRejected = errors.New("batch rejected")
+)
+
+// Delivers the batch, returns `errNotDelivered` if the batch should be sent again later
+// and `errRejected` if it never gets accepted.
+type batchSender func(batch []models.Metrics) error
+
+// Sends the snapshot in batches of at most `batchSize` metrics.
+// Batches which can't be delivered go to the outbox (if any) after the previously queued ones.
+func (r *reporter) sendMetricsBatch(metrics []models.Metrics, send batchSender) {
+	batches := splitBatches(metrics, r.batchSize)
+
+	// Keep order: fresh batches can't overtake the queued ones
+	if !r.replayOutbox(send) {
+		for _, batch := range batches {
+			r.keepUndelivered(batch)
+		}
+		return
+	}
+
+	// Batches of one snapshot have different metrics, so their order doesn't matter
+	jobs := make([]func(), 0, len(batches))
+	for _, batch := range batches {
+		batch := batch
+		jobs = append(jobs, func() {
+			if err := send(batch); err != nil {
+				logger.Log(r.ctx).Error(err)
+				if !errors.Is(err, errRejected) {
+					r.keepUndelivered(batch)
+				}
+			}
+		})
+	}
+	r.pool.runAll(jobs)
+}
+
+// Puts the batch into the outbox or, if there is no outbox, gives its counters back to the store.
+func (r *reporter) keepUndelivered(batch []models.Metrics) {
+	if r.outbox == nil {
+		r.giveBack(batch)
+		return
+	}
+	if err := r.outbox.Push(batch); err != nil {
+		logger.Log(r.ctx).Errorf("reporter: failed queueing batch: %v", err)
+		r.giveBack(batch)
+	}
+}
+
+// Sends queued batches oldest-first. Returns `true` if there is nothing queued anymore.
+func (r *reporter) replayOutbox(send batchSender) bool {
+	if r.outbox == nil {
+		return true
+	}
+	for {
+		batch, ok := r.outbox.Front()
+		if !ok {
+			return true
+		}
+		err := send(batch)
+		if errors.Is(err, errRejected) {
+			logger.Log(r.ctx).Errorf("reporter: dropping queued batch: %v", err)
+		} else if err != nil {
+			logger.Log(r.ctx).Errorf("reporter: failed replaying outbox (%d batch(es) left): %v", r.outbox.Len(), err)
+			return false
+		}
+		if err := r.outbox.Pop(); err != nil {
+			logger.Log(r.ctx).Errorf("reporter: failed removing batch from outbox: %v", err)
+			return false
+		}
+	}
+}
+
+// Sends the batch to `/updates/`, implements `batchSender`.
+// Partially accepted batches are delivered: the rejected metrics are invalid and only logged.
+// Client errors other than 429 reject the batch, other failures keep it undelivered,
+// so counter increments aren't lost.
+func (r *reporter) sendBatch(batch []models.Metrics) error {
+	postURL := r.serverURL + "/updates/"
+
+	signed, err := r.sign(batch)
+	if err != nil {
+		return fmt.Errorf("failed signing batch: %v. %w", err, errNotDelivered)
+	}
+
+	jbz, err := json.Marshal(signed)
+	if err != nil {
+		return fmt.Errorf("failed encoding batch: %v. %w", err, errNotDelivered)
+	}
+
+	payload, header, err := r.encodeJSON(jbz)
+	if err != nil {
+		return fmt.Errorf("%v. %w", err, errNotDelivered)
+	}
+
+	resp, errPost := r.post(postURL, header, payload)
+	if errPost != nil {
+		return fmt.Errorf("%v. %w", errPost, errNotDelivered)
+	}
+	defer closeBody(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		log.Printf("Sent batch of %d metrics to `%s`.\n", len(batch), postURL)
+	case http.StatusPartialContent:
+		body := bulkUpdateResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			logger.Log(r.ctx).Errorf("reporter: failed decoding partial update response: %v", err)
+			return nil
+		}
+		logger.Log(r.ctx).Warnf("reporter: server rejected metrics %v: %s", body.Rejected, body.Error)
+	case http.StatusTooManyRequests:
+		return fmt.Errorf("reporter: batch of %d metrics throttled. %w", len(batch), errNotDelivered)
+	default:
+		if resp.StatusCode/100 == 4 {
+			return fmt.Errorf("reporter: batch of %d metrics refused with status %d. %w",
+				len(batch), resp.StatusCode, errRejected)
+		}
+		return fmt.Errorf("reporter: batch of %d metrics failed with status %d. %w",
+			len(batch), resp.StatusCode, errNotDelivered)
+	}
+	return nil
+}
+
+// Splits metrics into chunks of at most `size` items. Non-positive `size` means a single chunk.
+func splitBatches(metrics []models.Metrics, size int) [][]models.Metrics {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if size <= 0 || size >= len(metrics) {
+		return [][]models.Metrics{metrics}
+	}
+
+	batches := make([][]models.Metrics, 0, (len(metrics)+size-1)/size)
+	for start := 0; start < len(metrics); start += size {
+		end := start + size
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		batches = append(batches, metrics[start:end])
+	}
+	return batches
+}
@@ -0,0 +1,234 @@
+package reporter_test
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/agent/reporter"
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/inmem"
+)
+
+func TestBatchSize(t *testing.T) {
+	logger.Run("error")
+
+	tests := []struct {
+		name      string
+		metrics   int
+		batchSize int
+		wantSizes []int
+	}{
+		{name: "no limit", metrics: 5, batchSize: 0, wantSizes: []int{5}},
+		{name: "limit above metrics", metrics: 5, batchSize: 10, wantSizes: []int{5}},
+		{name: "limit equals metrics", metrics: 5, batchSize: 5, wantSizes: []int{5}},
+		{name: "last batch is smaller", metrics: 5, batchSize: 2, wantSizes: []int{1, 2, 2}},
+		{name: "batch per metric", metrics: 3, batchSize: 1, wantSizes: []int{1, 1, 1}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, func(n int) int { return http.StatusOK })
+			defer server.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			db := inmem.New(ctx, nil)
+			for i := 0; i < tt.metrics; i++ {
+				val := float64(i)
+				m := models.Metrics{ID: fmt.Sprintf("Gauge%d", i), MType: models.MGauge, Value: &val}
+				if err := db.Update(m); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			opts := server.options()
+			opts.BatchSize = tt.batchSize
+			terminated := make(chan bool, 1)
+			go reporter.New(ctx, db, terminated, opts).ReportWithBatch()
+
+			sizes := []int{}
+			ids := map[string]bool{}
+			for _, batch := range server.waitBatches(t, len(tt.wantSizes)) {
+				sizes = append(sizes, len(batch))
+				for _, m := range batch {
+					ids[m.ID] = true
+				}
+			}
+			cancel()
+			<-terminated
+
+			// batches of a snapshot may be sent in any order
+			sort.Ints(sizes)
+			if fmt.Sprint(sizes) != fmt.Sprint(tt.wantSizes) {
+				t.Errorf("Expected batch sizes %v, got %v", tt.wantSizes, sizes)
+			}
+			if len(ids) != tt.metrics {
+				t.Errorf("Expected %d distinct metrics, got %d", tt.metrics, len(ids))
+			}
+		})
+	}
+}
+
+func TestPartialUpdateResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantLevel zapcore.Level
+		wantLog   string
+	}{
+		{
+			name:      "rejected metrics are logged",
+			body:      `{"error":"bad metrics","rejected":["Bad","Worse"]}`,
+			wantLevel: zapcore.WarnLevel,
+			wantLog:   "server rejected metrics [Bad Worse]: bad metrics",
+		},
+		{
+			name:      "nothing rejected",
+			body:      `{"error":"","rejected":[]}`,
+			wantLevel: zapcore.WarnLevel,
+			wantLog:   "server rejected metrics []: ",
+		},
+		{
+			name:      "broken response",
+			body:      `{"rejected":`,
+			wantLevel: zapcore.ErrorLevel,
+			wantLog:   "failed decoding partial update response",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, func(n int) int { return http.StatusPartialContent })
+			server.body = tt.body
+			defer server.Close()
+
+			core, logs := observer.New(zapcore.DebugLevel)
+			ctx, cancel := context.WithCancel(
+				context.WithValue(context.Background(), logger.LoggerKey, zap.New(core).Sugar()))
+			defer cancel()
+
+			db := inmem.New(ctx, nil)
+			one := int64(1)
+			if err := db.Update(models.Metrics{ID: "PollCount", MType: models.MCounter, Delta: &one}); err != nil {
+				t.Fatal(err)
+			}
+
+			terminated := make(chan bool, 1)
+			go reporter.New(ctx, db, terminated, server.options()).ReportWithBatch()
+
+			// A partially accepted batch is delivered: no retries, the counter isn't kept
+			batches := server.waitBatches(t, 2)
+			cancel()
+			<-terminated
+
+			if delta := *batches[1][0].Delta; delta != 0 {
+				t.Errorf("Expected the counter reset after the partial update, got delta %d", delta)
+			}
+			found := logs.FilterMessageSnippet(tt.wantLog).All()
+			if len(found) == 0 || found[0].Level != tt.wantLevel {
+				t.Errorf("Expected %s log `%s`, got %v", tt.wantLevel, tt.wantLog, logs.All())
+			}
+		})
+	}
+}
+
+// Receives batches sent to `/updates/` (failed attempts too) and hands them to the test in order of arrival.
+type fakeServer struct {
+	*httptest.Server
+	status  func(n int) int // response status of the request number `n` (starting from 1)
+	body    string
+	delay   time.Duration // before responding
+	batches chan []models.Metrics
+
+	inFlight    int32
+	maxInFlight int32 // the most requests handled at once
+}
+
+func newFakeServer(t *testing.T, status func(n int) int) *fakeServer {
+	t.Helper()
+	s := &fakeServer{status: status, batches: make(chan []models.Metrics, 100)}
+	var (
+		mx       sync.Mutex
+		requests int
+	)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		requests++
+		code := s.status(requests)
+		mx.Unlock()
+
+		n := atomic.AddInt32(&s.inFlight, 1)
+		defer atomic.AddInt32(&s.inFlight, -1)
+		for max := atomic.LoadInt32(&s.maxInFlight); n > max; max = atomic.LoadInt32(&s.maxInFlight) {
+			if atomic.CompareAndSwapInt32(&s.maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(s.delay)
+
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		batch := []models.Metrics{}
+		if err := json.NewDecoder(gz).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+
+		rw.WriteHeader(code)
+		if s.body != "" {
+			_, _ = rw.Write([]byte(s.body))
+		}
+		s.receive(batch)
+	}))
+	return s
+}
+
+// Never blocks, so the server can be closed while the agent still reports.
+func (s *fakeServer) receive(batch []models.Metrics) {
+	select {
+	case s.batches <- batch:
+	default:
+	}
+}
+
+func (s *fakeServer) options() reporter.Options {
+	return reporter.Options{
+		Address:        strings.TrimPrefix(s.URL, "http://"),
+		ReportInterval: 20 * time.Millisecond,
+		Retry:          reporter.RetryPolicy{MaxAttempts: 1},
+		RateLimit:      1,
+	}
+}
+
+// Waits for `n` requests.
+func (s *fakeServer) waitBatches(t *testing.T, n int) [][]models.Metrics {
+	t.Helper()
+	batches := make([][]models.Metrics, 0, n)
+	for len(batches) < n {
+		select {
+		case batch := <-s.batches:
+			batches = append(batches, batch)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d requests, got %d", n, len(batches))
+		}
+	}
+	return batches
+}
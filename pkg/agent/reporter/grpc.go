@@ -0,0 +1,88 @@
+package reporter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	pb "github.com/amiskov/metrics-and-alerting/pkg/proto"
+)
+
+// Run the process which intervally streams metrics from updater to the gRPC server.
+func (r *reporter) ReportWithGRPC() {
+	conn, err := grpc.Dial(r.grpcAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("reporter: can't connect to gRPC server `%s`: %v", r.grpcAddress, err)
+	}
+	go func() {
+		<-r.ctx.Done()
+		conn.Close()
+	}()
+
+	r.grpcClient = pb.NewMetricsClient(conn)
+	r.runReporter(withGRPC)
+}
+
+// Streams the batch through `Push`, implements `batchSender`.
+// Partially accepted batches are delivered: the rejected metrics are invalid and only logged.
+// Other failures keep the batch undelivered, so counter increments aren't lost.
+func (r *reporter) pushBatch(batch []models.Metrics) error {
+	signed, err := r.sign(batch)
+	if err != nil {
+		return fmt.Errorf("failed signing batch: %v. %w", err, errNotDelivered)
+	}
+
+	var resp *pb.BatchUpdateResponse
+	err = r.withRetry(r.grpcAddress, func() (bool, error) {
+		ctx, cancel := context.WithTimeout(r.ctx, 10*time.Second)
+		defer cancel()
+		if r.realIP != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-real-ip", r.realIP)
+		}
+
+		stream, err := r.grpcClient.Push(ctx)
+		if err != nil {
+			return isRetryableCode(err), err
+		}
+		for _, m := range signed {
+			if err := stream.Send(pb.FromModel(m)); err != nil {
+				// The real error is returned by `CloseAndRecv`
+				break
+			}
+		}
+		resp, err = stream.CloseAndRecv()
+		if err != nil {
+			return isRetryableCode(err), err
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%v. %w", err, errNotDelivered)
+	}
+
+	if len(resp.GetRejected()) > 0 {
+		logger.Log(r.ctx).Warnf("reporter: server rejected metrics %v", resp.GetRejected())
+		return nil
+	}
+	log.Printf("Pushed batch of %d metrics to `%s`.\n", len(batch), r.grpcAddress)
+	return nil
+}
+
+// Transient failures worth retrying, like 5xx and 429 over HTTP.
+func isRetryableCode(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Canceled:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,47 +1,52 @@
 package reporter
 
 import (
-	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-	"sync"
-	"time"
 
 	"github.com/amiskov/metrics-and-alerting/pkg/models"
 )
 
 func (r *reporter) sendMetricsJSON(metrics []models.Metrics) {
-	var wg sync.WaitGroup
+	jobs := make([]func(), 0, len(metrics))
 	for _, m := range metrics {
 		m := m
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			r.sendMetricJSON(m)
-		}()
+		jobs = append(jobs, func() {
+			if err := r.sendMetricJSON(m); err != nil {
+				log.Println(err)
+				r.giveBack([]models.Metrics{m})
+			}
+		})
 	}
-	wg.Wait()
+	r.pool.runAll(jobs)
 }
 
-func (r reporter) sendMetricJSON(m models.Metrics) {
+// Returns an error if the metric wasn't delivered but may be delivered later.
+func (r reporter) sendMetricJSON(m models.Metrics) error {
 	postURL := r.serverURL + "/update/"
-	contentType := "Content-Type: application/json"
-
-	client := http.Client{}
-	client.Timeout = 10 * time.Second
 
 	jbz, err := json.Marshal(m)
 	if err != nil {
 		log.Printf("Error marshaling JSON: %+v", err)
-		return
+		return nil
+	}
+
+	payload, header, err := r.encodeJSON(jbz)
+	if err != nil {
+		return err
 	}
 
-	resp, errPost := client.Post(postURL, contentType, bytes.NewBuffer(jbz))
+	resp, errPost := r.post(postURL, header, payload)
 	if errPost != nil {
-		log.Println(errPost)
-		return
+		return errPost
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to send JSON %+v to `%s`. Status: %d", string(jbz), postURL, resp.StatusCode)
 	}
-	defer resp.Body.Close()
 	log.Printf("Sent JSON %+v to `%s`.\n", string(jbz), postURL)
+	return nil
 }
@@ -0,0 +1,38 @@
+package reporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/encryption"
+)
+
+// Returns the gzipped (and encrypted if the public key is set) JSON payload with headers describing it.
+func (r *reporter) encodeJSON(jbz []byte) ([]byte, http.Header, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(jbz); err != nil {
+		return nil, nil, fmt.Errorf("failed compressing payload: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed compressing payload: %w", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Encoding", "gzip")
+
+	if r.publicKey == nil {
+		return buf.Bytes(), header, nil
+	}
+
+	// Compress first: encrypted data doesn't compress
+	encrypted, err := encryption.Encrypt(r.publicKey, buf.Bytes())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed encrypting payload: %w", err)
+	}
+	header.Set(encryption.Header, encryption.Scheme)
+	return encrypted, header, nil
+}
@@ -0,0 +1,59 @@
+package reporter
+
+import (
+	"context"
+	"sync"
+)
+
+// Fixed number of workers sending reports, so a big snapshot doesn't turn into
+// a burst of parallel connections.
+type workerPool struct {
+	ctx  context.Context
+	jobs chan func()
+}
+
+// Starts `size` workers, they stop when the context is done.
+func newWorkerPool(ctx context.Context, size int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &workerPool{
+		ctx:  ctx,
+		jobs: make(chan func()),
+	}
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case job := <-p.jobs:
+			job()
+		}
+	}
+}
+
+// Runs jobs in the pool and waits for all of them to finish.
+// Once the context is done, the remaining jobs run one by one in the caller's goroutine.
+func (p *workerPool) runAll(jobs []func()) {
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		job := job
+		wg.Add(1)
+		select {
+		case p.jobs <- func() {
+			defer wg.Done()
+			job()
+		}:
+		case <-p.ctx.Done():
+			job()
+			wg.Done()
+		}
+	}
+	wg.Wait()
+}
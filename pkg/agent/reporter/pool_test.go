@@ -0,0 +1,93 @@
+package reporter_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/agent/reporter"
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/inmem"
+)
+
+func TestRateLimit(t *testing.T) {
+	logger.Run("error")
+
+	tests := []struct {
+		name      string
+		rateLimit int
+	}{
+		{name: "test single worker", rateLimit: 1},
+		{name: "test several workers", rateLimit: 3},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			db := inmem.New(ctx, nil)
+			for i := 0; i < 12; i++ {
+				val := float64(i)
+				if err := db.Update(models.Metrics{ID: fmt.Sprintf("Gauge%d", i), MType: models.MGauge, Value: &val}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			server := newFakeServer(t, func(int) int { return http.StatusOK })
+			server.delay = 10 * time.Millisecond
+			defer server.Close()
+
+			opts := server.options()
+			opts.BatchSize = 1
+			opts.RateLimit = tt.rateLimit
+			opts.ReportInterval = time.Second // a single report
+			terminated := make(chan bool, 1)
+			go reporter.New(ctx, db, terminated, opts).ReportWithBatch()
+
+			server.waitBatches(t, 12)
+			cancel()
+			<-terminated
+
+			if got := atomic.LoadInt32(&server.maxInFlight); got != int32(tt.rateLimit) {
+				t.Errorf("Expected %d requests at once, got %d", tt.rateLimit, got)
+			}
+		})
+	}
+}
+
+func TestSlowReport(t *testing.T) {
+	logger.Run("error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := inmem.New(ctx, nil)
+	one := int64(1)
+	if err := db.Update(models.Metrics{ID: "PollCount", MType: models.MCounter, Delta: &one}); err != nil {
+		t.Fatal(err)
+	}
+
+	// every report takes several report intervals
+	server := newFakeServer(t, func(int) int { return http.StatusOK })
+	server.delay = 70 * time.Millisecond
+	defer server.Close()
+
+	opts := server.options()
+	opts.RateLimit = 4
+	terminated := make(chan bool, 1)
+	go reporter.New(ctx, db, terminated, opts).ReportWithBatch()
+
+	server.waitBatches(t, 3)
+	cancel()
+	<-terminated
+
+	// free workers don't start the next report while the previous one is in flight
+	if got := atomic.LoadInt32(&server.maxInFlight); got != 1 {
+		t.Errorf("Expected reports one by one, got %d at once", got)
+	}
+}
@@ -3,20 +3,30 @@ package reporter
 
 import (
 	"context"
+	"crypto/rsa"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"time"
 
+	"github.com/amiskov/metrics-and-alerting/pkg/agent/outbox"
+	"github.com/amiskov/metrics-and-alerting/pkg/encryption"
 	"github.com/amiskov/metrics-and-alerting/pkg/logger"
 	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	pb "github.com/amiskov/metrics-and-alerting/pkg/proto"
 )
 
 const (
 	withJSON = iota
 	withURL
+	withBatch
+	withGRPC
 )
 
 type store interface {
-	GetAll() ([]models.Metrics, error)
+	SnapshotAndReset() ([]models.Metrics, error)
+	BulkUpdate([]models.Metrics) error
 }
 
 type reporter struct {
@@ -26,19 +36,83 @@ type reporter struct {
 	reportInterval time.Duration
 	serverURL      string
 	hashingKey     []byte
+	batchSize      int
+	retryPolicy    RetryPolicy
+	retries        *retryBudget   // of the current report cycle
+	outbox         *outbox.Outbox // nil if undelivered batches are not kept
+	client         *http.Client   // shared by workers to reuse keep-alive connections
+	pool           *workerPool
+	publicKey      *rsa.PublicKey // payloads are encrypted if set
+	realIP         string         // agent's address for `X-Real-IP`
+	grpcAddress    string
+	grpcClient     pb.MetricsClient  // set in gRPC mode only
+	labels         map[string]string // attached to metrics, URL params can't carry them
 }
 
-func New(ctx context.Context, db store, terminated chan<- bool,
-	reportInterval time.Duration, address string, hashingKey string,
-) *reporter {
-	return &reporter{
+// Options of the reporter. Empty optional values disable the features.
+type Options struct {
+	Address          string // HTTP server `host:port`
+	GRPCAddress      string // gRPC server `host:port`
+	ReportInterval   time.Duration
+	HashingKey       string
+	CryptoKey        string // path to the server's public key, payloads are encrypted if set
+	BatchSize        int
+	RateLimit        int // max simultaneous requests to the server
+	Retry            RetryPolicy
+	OutboxFile       string // undelivered batches are kept in the file if set
+	OutboxMaxBatches int
+	OutboxMaxBytes   int
+	Labels           map[string]string // attached to every metric
+}
+
+func New(ctx context.Context, db store, terminated chan<- bool, opts Options) *reporter {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = opts.RateLimit // keep a connection per worker
+
+	r := &reporter{
 		metrics:        db,
 		ctx:            ctx,
 		terminated:     terminated,
-		reportInterval: reportInterval,
-		serverURL:      "http://" + address,
-		hashingKey:     []byte(hashingKey),
+		reportInterval: opts.ReportInterval,
+		serverURL:      "http://" + opts.Address,
+		hashingKey:     []byte(opts.HashingKey),
+		batchSize:      opts.BatchSize,
+		retryPolicy:    opts.Retry,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   10 * time.Second,
+		},
+		pool:        newWorkerPool(ctx, opts.RateLimit),
+		grpcAddress: opts.GRPCAddress,
+		labels:      map[string]string{},
+	}
+	for k, v := range opts.Labels {
+		r.labels[k] = v
+	}
+
+	if opts.OutboxFile != "" {
+		box, err := outbox.New(opts.OutboxFile, opts.OutboxMaxBatches, opts.OutboxMaxBytes)
+		if err != nil {
+			log.Fatalf("reporter: can't open outbox: %v", err)
+		}
+		r.outbox = box
+	}
+
+	if opts.CryptoKey != "" {
+		publicKey, err := encryption.ReadPublicKey(opts.CryptoKey)
+		if err != nil {
+			log.Fatalf("reporter: can't read public key: %v", err)
+		}
+		r.publicKey = publicKey
+	}
+
+	realIP, err := outboundIP(opts.Address)
+	if err != nil {
+		log.Printf("Can't detect agent's address, `X-Real-IP` won't be sent: %v\n", err)
 	}
+	r.realIP = realIP
+
+	return r
 }
 
 // Run the process which intervally sends metrics from updater as URL params.
@@ -51,6 +125,11 @@ func (r *reporter) ReportWithJSON() {
 	r.runReporter(withJSON)
 }
 
+// Run the process which intervally sends metrics from updater as JSON batches to `/updates/`.
+func (r *reporter) ReportWithBatch() {
+	r.runReporter(withBatch)
+}
+
 func (r *reporter) runReporter(apiType int) {
 	ticker := time.NewTicker(r.reportInterval)
 
@@ -61,30 +140,104 @@ func (r *reporter) runReporter(apiType int) {
 		r.terminated <- true
 	}()
 
+	// Reports run one by one in this loop, so a slow report never overlaps the next one
 	for range ticker.C {
-		metrics, err := r.metrics.GetAll()
+		r.retries = r.retryPolicy.newBudget()
+
+		// Counters in the snapshot are increments since the previous report
+		metrics, err := r.metrics.SnapshotAndReset()
 		if err != nil {
 			logger.Log(r.ctx).Errorf("can't get metrics: %v", err)
 			return
 		}
-
-		// Actualize hashes
-		if len(r.hashingKey) > 0 {
-			for k, m := range metrics {
-				hash, hErr := m.GetHash(r.hashingKey)
-				if hErr != nil {
-					logger.Log(r.ctx).Error("reporter: failed creating hash %v", hErr)
-					return
-				}
-				metrics[k].Hash = hash
-			}
+		if apiType != withURL {
+			metrics = r.label(metrics)
 		}
 
 		switch apiType {
 		case withJSON:
-			r.sendMetricsJSON(metrics)
+			signed, err := r.sign(metrics)
+			if err != nil {
+				logger.Log(r.ctx).Errorf("reporter: %v", err)
+				r.giveBack(metrics)
+				return
+			}
+			r.sendMetricsJSON(signed)
 		case withURL:
 			r.sendMetrics(metrics)
+		case withBatch:
+			r.sendMetricsBatch(metrics, r.sendBatch) // signs every batch right before sending
+		case withGRPC:
+			r.sendMetricsBatch(metrics, r.pushBatch)
+		}
+
+		// Skip the tick missed while reporting, the next report starts on schedule
+		select {
+		case <-ticker.C:
+		default:
+		}
+	}
+}
+
+// Returns undelivered counter increments to the store so they are sent with the next report.
+// Gauges are skipped: the store already has fresher values.
+func (r *reporter) giveBack(metrics []models.Metrics) {
+	counters := make([]models.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		if m.MType == models.MCounter && m.Delta != nil {
+			m.Hash = ""
+			m.Labels = nil // the store keeps unlabeled metrics
+			counters = append(counters, m)
+		}
+	}
+	if len(counters) == 0 {
+		return
+	}
+	if err := r.metrics.BulkUpdate(counters); err != nil {
+		logger.Log(r.ctx).Errorf("reporter: failed keeping undelivered counters: %v", err)
+	}
+}
+
+// Attaches the agent labels to metrics.
+func (r *reporter) label(metrics []models.Metrics) []models.Metrics {
+	if len(r.labels) == 0 {
+		return metrics
+	}
+	for k := range metrics {
+		metrics[k].Labels = r.labels
+	}
+	return metrics
+}
+
+// Returns a copy of metrics with actual hashes (if the hashing key is set).
+func (r *reporter) sign(metrics []models.Metrics) ([]models.Metrics, error) {
+	signed := make([]models.Metrics, len(metrics))
+	copy(signed, metrics)
+	if len(r.hashingKey) == 0 {
+		return signed, nil
+	}
+	for k, m := range signed {
+		hash, err := m.GetHash(r.hashingKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed creating hash: %w", err)
 		}
+		signed[k].Hash = hash
+	}
+	return signed, nil
+}
+
+// Returns the address of the interface used to reach the server.
+// Nothing is sent: connecting UDP socket only selects the route.
+func outboundIP(serverAddress string) (string, error) {
+	conn, err := net.Dial("udp", serverAddress)
+	if err != nil {
+		return "", fmt.Errorf("failed resolving route to `%s`: %w", serverAddress, err)
+	}
+	defer conn.Close()
+
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return "", fmt.Errorf("unexpected local address `%s`", conn.LocalAddr())
 	}
+	return addr.IP.String(), nil
 }
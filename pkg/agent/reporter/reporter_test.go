@@ -0,0 +1,266 @@
+package reporter_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/agent/outbox"
+	"github.com/amiskov/metrics-and-alerting/pkg/agent/reporter"
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/inmem"
+)
+
+func TestReportRetries(t *testing.T) {
+	logger.Run("error")
+
+	tests := []struct {
+		name         string
+		metrics      int
+		batchSize    int
+		statuses     []int // responses in order, the last one repeats
+		wantRequests int   // in the first report cycle
+	}{
+		{
+			name:         "retries server errors until success",
+			metrics:      1,
+			statuses:     []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK},
+			wantRequests: 3,
+		},
+		{
+			name:         "gives up after max attempts",
+			metrics:      1,
+			statuses:     []int{http.StatusServiceUnavailable},
+			wantRequests: 3,
+		},
+		{
+			name:         "doesn't retry client errors",
+			metrics:      1,
+			statuses:     []int{http.StatusBadRequest},
+			wantRequests: 1,
+		},
+		{
+			name:         "caps retries per report cycle",
+			metrics:      3,
+			batchSize:    1,
+			statuses:     []int{http.StatusServiceUnavailable},
+			wantRequests: 5, // 3 attempts for the first batch, single attempts for the rest
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			db := inmem.New(ctx, nil)
+			setGauges := func(val float64) {
+				for i := 0; i < tt.metrics; i++ {
+					m := models.Metrics{ID: fmt.Sprintf("Gauge%d", i), MType: models.MGauge, Value: &val}
+					if err := db.Update(m); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+			setGauges(1)
+
+			server := newFakeServer(t, func(n int) int {
+				if n == tt.wantRequests {
+					// The first cycle already has its snapshot, the next one sends new values
+					setGauges(2)
+				}
+				if n > len(tt.statuses) {
+					n = len(tt.statuses)
+				}
+				return tt.statuses[n-1]
+			})
+			defer server.Close()
+
+			opts := server.options()
+			opts.BatchSize = tt.batchSize
+			opts.Retry.MaxAttempts = 3
+			opts.Retry.InitialInterval = time.Millisecond
+			opts.Retry.MaxInterval = 5 * time.Millisecond
+			terminated := make(chan bool, 1)
+			go reporter.New(ctx, db, terminated, opts).ReportWithBatch()
+
+			batches := server.waitBatches(t, tt.wantRequests+1)
+			cancel()
+			<-terminated
+
+			for n, batch := range batches {
+				for _, m := range batch {
+					if nextCycle := *m.Value == 2; nextCycle != (n == tt.wantRequests) {
+						t.Fatalf("Expected %d requests in the first report cycle, request %d has `%s` %v",
+							tt.wantRequests, n+1, m.ID, *m.Value)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCounterDeltas(t *testing.T) {
+	logger.Run("error")
+
+	tests := []struct {
+		name       string
+		status     int     // response to the first report
+		wantDeltas []int64 // in the first three reports
+	}{
+		// undelivered increments go with the next report
+		{name: "server error", status: http.StatusServiceUnavailable, wantDeltas: []int64{3, 3, 0}},
+		{name: "throttled", status: http.StatusTooManyRequests, wantDeltas: []int64{3, 3, 0}},
+		// the server never accepts the batch, so it's dropped
+		{name: "client error", status: http.StatusBadRequest, wantDeltas: []int64{3, 0, 0}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, func(n int) int {
+				if n == 1 {
+					return tt.status
+				}
+				return http.StatusOK
+			})
+			defer server.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			db := inmem.New(ctx, nil)
+			one := int64(1)
+			for i := 0; i < 3; i++ {
+				if err := db.Update(models.Metrics{ID: "PollCount", MType: models.MCounter, Delta: &one}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			terminated := make(chan bool, 1)
+			go reporter.New(ctx, db, terminated, server.options()).ReportWithBatch()
+
+			// Failed report, then two delivered ones
+			batches := server.waitBatches(t, 3)
+			cancel()
+			<-terminated
+
+			for k, want := range tt.wantDeltas {
+				if got := *batches[k][0].Delta; got != want {
+					t.Errorf("Expected delta %d in report %d, got %d", want, k+1, got)
+				}
+			}
+		})
+	}
+}
+
+func TestOutboxReplay(t *testing.T) {
+	logger.Run("error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := inmem.New(ctx, nil)
+	setAlloc := func(val float64) {
+		if err := db.Update(models.Metrics{ID: "Alloc", MType: models.MGauge, Value: &val}); err != nil {
+			t.Error(err)
+		}
+	}
+	setAlloc(1)
+	three := int64(3)
+	if err := db.Update(models.Metrics{ID: "PollCount", MType: models.MCounter, Delta: &three}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server is down for two report cycles
+	server := newFakeServer(t, func(n int) int {
+		if n <= 2 {
+			setAlloc(float64(n + 1)) // the next cycle sends the next value
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	defer server.Close()
+
+	opts := server.options()
+	opts.OutboxFile = filepath.Join(t.TempDir(), "outbox.json")
+	terminated := make(chan bool, 1)
+	go reporter.New(ctx, db, terminated, opts).ReportWithBatch()
+
+	batches := server.waitBatches(t, 5)
+	cancel()
+	<-terminated
+
+	want := []struct {
+		alloc float64
+		delta int64
+	}{
+		{alloc: 1, delta: 3}, // failed, queued
+		{alloc: 1, delta: 3}, // failed replay, the fresh batch is queued behind
+		{alloc: 1, delta: 3}, // replayed oldest-first
+		{alloc: 2, delta: 0},
+		{alloc: 3, delta: 0}, // fresh batch once the outbox is empty
+	}
+	for k, w := range want {
+		got := map[string]models.Metrics{}
+		for _, m := range batches[k] {
+			got[m.ID] = m
+		}
+		if *got["Alloc"].Value != w.alloc || *got["PollCount"].Delta != w.delta {
+			t.Errorf("Expected request %d with Alloc %v and PollCount %d, got %v and %d",
+				k+1, w.alloc, w.delta, *got["Alloc"].Value, *got["PollCount"].Delta)
+		}
+	}
+
+	box, err := outbox.New(opts.OutboxFile, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if box.Len() != 0 {
+		t.Errorf("Expected empty outbox after replay, got %d batch(es)", box.Len())
+	}
+}
+
+func TestOutboxDropsRejected(t *testing.T) {
+	logger.Run("error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := inmem.New(ctx, nil)
+	three := int64(3)
+	if err := db.Update(models.Metrics{ID: "PollCount", MType: models.MCounter, Delta: &three}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first batch is queued while the server is down and refused when replayed
+	server := newFakeServer(t, func(n int) int {
+		switch n {
+		case 1:
+			return http.StatusServiceUnavailable
+		case 2:
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	})
+	defer server.Close()
+
+	opts := server.options()
+	opts.OutboxFile = filepath.Join(t.TempDir(), "outbox.json")
+	terminated := make(chan bool, 1)
+	go reporter.New(ctx, db, terminated, opts).ReportWithBatch()
+
+	batches := server.waitBatches(t, 4)
+	cancel()
+	<-terminated
+
+	// the replay doesn't stop at the refused batch
+	for k, want := range []int64{3, 3, 0, 0} {
+		if got := *batches[k][0].Delta; got != want {
+			t.Errorf("Expected delta %d in request %d, got %d", want, k+1, got)
+		}
+	}
+}
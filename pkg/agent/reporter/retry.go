@@ -0,0 +1,98 @@
+package reporter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/retry"
+)
+
+// Describes how failed reports are retried within a report cycle.
+type RetryPolicy struct {
+	MaxAttempts     int           // attempts per report cycle including the first one, values below 1 mean 1
+	InitialInterval time.Duration // delay before the first retry, doubled on every next one
+	MaxInterval     time.Duration // upper bound for a single delay
+}
+
+// Returns the delay before the retry after the failed `attempt` (starting from 1).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	return retry.Backoff{InitialInterval: p.InitialInterval, MaxInterval: p.MaxInterval}.Delay(attempt)
+}
+
+// Retries left in the current report cycle. All requests of the cycle share them, so a cycle
+// against a failing server makes `MaxAttempts - 1` retries in total, not per request.
+type retryBudget struct {
+	left int32
+}
+
+func (p RetryPolicy) newBudget() *retryBudget {
+	return &retryBudget{left: int32(p.MaxAttempts - 1)}
+}
+
+// Reports whether a retry is allowed and spends it. Nil budget allows none.
+func (b *retryBudget) take() bool {
+	return b != nil && atomic.AddInt32(&b.left, -1) >= 0
+}
+
+// POSTs the body following the retry policy. The response is returned for the first
+// non-retryable status, the caller is responsible for checking the status and closing the body.
+func (r *reporter) post(postURL string, header http.Header, body []byte) (*http.Response, error) {
+	var resp *http.Response
+	err := r.withRetry(postURL, func() (bool, error) {
+		req, err := http.NewRequest(http.MethodPost, postURL, bytes.NewReader(body))
+		if err != nil {
+			return false, fmt.Errorf("failed creating request: %w", err)
+		}
+		req.Header = header.Clone()
+		if r.realIP != "" {
+			req.Header.Set("X-Real-IP", r.realIP)
+		}
+
+		res, err := r.client.Do(req)
+		if err != nil {
+			return true, err
+		}
+		if retry.IsRetryableStatus(res.StatusCode) {
+			closeBody(res)
+			return true, fmt.Errorf("server responded with status %d", res.StatusCode)
+		}
+		resp = res
+		return false, nil
+	})
+	return resp, err
+}
+
+// Calls `try` until it succeeds, fails with a non-retryable error or the retries of the cycle are exhausted.
+// `try` reports whether its error is worth retrying.
+func (r *reporter) withRetry(target string, try func() (retryable bool, err error)) error {
+	for attempt := 1; ; attempt++ {
+		retryable, err := try()
+		if err == nil {
+			return nil
+		}
+		if !retryable {
+			return fmt.Errorf("reporter: request to `%s` failed: %w", target, err)
+		}
+		if !r.retries.take() {
+			return fmt.Errorf("reporter: giving up on `%s` after %d attempt(s): %w", target, attempt, err)
+		}
+
+		delay := r.retryPolicy.backoff(attempt)
+		logger.Log(r.ctx).Warnf("reporter: attempt %d to `%s` failed: %v. Retrying in %s.", attempt, target, err, delay)
+
+		if err := retry.Sleep(r.ctx, delay); err != nil {
+			return fmt.Errorf("reporter: retry to `%s` cancelled: %w", target, err)
+		}
+	}
+}
+
+// Reads the rest of the body before closing, so the keep-alive connection can be reused.
+func closeBody(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -1,42 +1,45 @@
 package reporter
 
 import (
+	"fmt"
 	"log"
 	"net/http"
-	"sync"
-	"time"
 
 	"github.com/amiskov/metrics-and-alerting/pkg/logger"
 	"github.com/amiskov/metrics-and-alerting/pkg/models"
 )
 
 func (r *reporter) sendMetrics(metrics []models.Metrics) {
-	var wg sync.WaitGroup
+	jobs := make([]func(), 0, len(metrics))
 	for _, m := range metrics {
 		m := m
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			r.sendMetric(m)
-		}()
+		jobs = append(jobs, func() {
+			if err := r.sendMetric(m); err != nil {
+				log.Println(err)
+				r.giveBack([]models.Metrics{m})
+			}
+		})
 	}
-	wg.Wait()
+	r.pool.runAll(jobs)
 }
 
-func (r reporter) sendMetric(m models.Metrics) {
+// Returns an error if the metric wasn't delivered but may be delivered later.
+func (r reporter) sendMetric(m models.Metrics) error {
 	val, err := m.GetStrVal()
 	if err != nil {
 		logger.Log(r.ctx).Error("bad metric format: %#v", m)
-		return
+		return nil
 	}
 	postURL := r.serverURL + "/update/" + m.MType + "/" + m.ID + "/" + val
-	client := http.Client{}
-	client.Timeout = 10 * time.Second
-	resp, errPost := client.Post(postURL, "Content-Type: text/plain", nil)
+	resp, errPost := r.post(postURL, http.Header{"Content-Type": {"text/plain"}}, nil)
 	if errPost != nil {
-		log.Printf("Failed to send metric. URL: `%s`. Error: %v\n", postURL, errPost)
-		return
+		return fmt.Errorf("failed to send metric. URL: `%s`. Error: %w", postURL, errPost)
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to send metric. URL: `%s`. Status: %d", postURL, resp.StatusCode)
 	}
-	defer resp.Body.Close()
 	log.Printf("Sent to `%s`.\n", postURL)
+	return nil
 }
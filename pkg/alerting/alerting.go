@@ -0,0 +1,382 @@
+// Package `alerting` evaluates alert rules against the latest metrics periodically.
+package alerting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+type State string
+
+const (
+	StatePending  State = "pending"  // condition is true for less than `For`
+	StateFiring   State = "firing"   // condition is true for at least `For`
+	StateResolved State = "resolved" // condition became false after firing
+)
+
+// Resolved alerts are listed for this time and then forgotten.
+const resolvedRetention = 15 * time.Minute
+
+type Alert struct {
+	Rule       Rule              `json:"rule"`
+	Labels     map[string]string `json:"labels"`
+	State      State             `json:"state"`
+	Value      float64           `json:"value"`     // the latest evaluated value
+	ActiveAt   time.Time         `json:"active_at"` // when the condition became true
+	FiredAt    *time.Time        `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time        `json:"resolved_at,omitempty"`
+	Silenced   bool              `json:"silenced"` // notifications about the alert are suppressed
+	notified   State             // the latest state sent to the notifier
+	series     map[string]string // labels of the matched series, `nil` for never received metrics
+}
+
+// Rules fire separately for every matched series.
+func (a Alert) key() string {
+	return models.SeriesName(a.Rule.Name, a.series)
+}
+
+type Repo interface {
+	// Returns all series of the metric having the labels.
+	Series(metricType string, metricName string, labels map[string]string) ([]models.Metrics, error)
+	History(metricType string, metricName string, q models.HistoryQuery) (models.History, error)
+}
+
+// Receives alerts which became firing or resolved. Shouldn't block for long.
+type Notifier interface {
+	Notify(alerts []Alert)
+}
+
+// Raw samples kept by the storage, `rate` rules need at least two of them within the window.
+type HistoryLimits struct {
+	Samples int           // raw samples kept per series, unlimited if negative
+	RawTTL  time.Duration // raw samples are compacted after that, kept forever if 0
+}
+
+type engine struct {
+	ctx      context.Context
+	repo     Repo
+	notifier Notifier  // optional
+	store    RuleStore // optional, rules are kept in memory only if not set
+	mx       sync.RWMutex
+	writeMx  sync.Mutex // serializes changes of rules, so the store is written without holding `mx`
+	rules    []Rule
+	alerts   map[string]*Alert  // by rule name and series labels
+	silences map[string]Silence // by ID
+	history  HistoryLimits
+	started  time.Time // metrics missing since the start are stale
+}
+
+func New(ctx context.Context, repo Repo, rules []Rule, n Notifier) *engine {
+	return &engine{
+		ctx:      ctx,
+		repo:     repo,
+		notifier: n,
+		rules:    rules,
+		alerts:   make(map[string]*Alert),
+		silences: make(map[string]Silence),
+		history:  HistoryLimits{Samples: -1},
+		started:  time.Now(),
+	}
+}
+
+// Sets limits of the metrics history. Rules which can't be evaluated with them are logged,
+// new ones are rejected.
+func (e *engine) SetHistoryLimits(l HistoryLimits) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	e.history = l
+	for _, r := range e.rules {
+		if err := e.checkHistory(r); err != nil {
+			logger.Log(e.ctx).Warnf("alerting: rule `%s` never fires: %v", r.Name, err)
+		}
+	}
+}
+
+// Evaluates rules every `interval` until the context is done.
+func (e *engine) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			log.Println("Alerting stopped.")
+			return
+		case <-ticker.C:
+			e.Evaluate(time.Now())
+		}
+	}
+}
+
+// Evaluates all rules, updates states of their alerts and notifies about firing and resolved ones
+// unless they are silenced. Changes made while silenced are notified when the silence ends.
+func (e *engine) Evaluate(now time.Time) {
+	notify := e.evaluate(now)
+	if e.notifier != nil && len(notify) > 0 {
+		e.notifier.Notify(notify)
+	}
+}
+
+// Returns alerts in the given states (all alerts if none given) sorted by rule name and series.
+func (e *engine) Alerts(states ...State) []Alert {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+
+	alerts := []Alert{}
+	for _, a := range e.alerts {
+		if len(states) > 0 && !hasState(states, a.State) {
+			continue
+		}
+		alert := *a
+		alert.Silenced = e.isSilenced(alert, time.Now())
+		alerts = append(alerts, alert)
+	}
+
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].key() < alerts[j].key()
+	})
+	return alerts
+}
+
+// ============ Not exported
+
+// Value of the rule for one of its series.
+type sample struct {
+	series  map[string]string
+	value   float64
+	matches bool
+}
+
+// Returns firing and resolved alerts which weren't notified yet. The repo may be slow,
+// so rules are evaluated without holding the lock, changes made meanwhile win.
+func (e *engine) evaluate(now time.Time) []Alert {
+	e.mx.RLock()
+	rules := make([]Rule, len(e.rules))
+	copy(rules, e.rules)
+	e.mx.RUnlock()
+
+	samples := make(map[string][]sample, len(rules))
+	for _, r := range rules {
+		s, err := e.samples(r, now)
+		if err != nil {
+			logger.Log(e.ctx).Errorf("alerting: failed evaluating rule `%s`: %v", r.Name, err)
+			continue
+		}
+		samples[r.Name] = s
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	for _, r := range rules {
+		s, ok := samples[r.Name]
+		if i := e.ruleIndex(r.Name); !ok || i < 0 || !reflect.DeepEqual(e.rules[i], r) {
+			continue
+		}
+		matched := make(map[string]bool, len(s))
+		for _, v := range s {
+			key := models.SeriesName(r.Name, v.series)
+			matched[key] = true
+			e.transition(key, r, v, now)
+		}
+		// missing series don't match the rule
+		for key, a := range e.alerts {
+			if a.Rule.Name == r.Name && !matched[key] {
+				e.transition(key, r, sample{series: a.series, value: a.Value}, now)
+			}
+		}
+	}
+
+	notify := []Alert{}
+	for _, a := range e.alerts {
+		if e.shouldNotify(a, now) {
+			a.notified = a.State
+			notify = append(notify, *a)
+		}
+	}
+	sort.Slice(notify, func(i, j int) bool {
+		return notify[i].key() < notify[j].key()
+	})
+	e.pruneSilences(now)
+
+	for key, a := range e.alerts {
+		// resolved alerts which were never notified are kept until the silence ends
+		if a.State == StateResolved && a.notified == StateResolved && now.Sub(*a.ResolvedAt) > resolvedRetention {
+			delete(e.alerts, key)
+		}
+	}
+	return notify
+}
+
+// Updates the alert of the rule for the series.
+func (e *engine) transition(key string, r Rule, s sample, now time.Time) {
+	a, ok := e.alerts[key]
+
+	if !s.matches {
+		if !ok {
+			return
+		}
+		switch {
+		case a.State == StatePending && a.notified == StateFiring:
+			// the previous firing is notified, its resolving is still to be notified
+			a.State = StateResolved
+			a.Value = s.value
+			a.ResolvedAt = &now
+		case a.State == StatePending:
+			delete(e.alerts, key)
+		case a.State == StateFiring:
+			a.State = StateResolved
+			a.Value = s.value
+			a.ResolvedAt = &now
+		}
+		return
+	}
+
+	if !ok || a.State == StateResolved {
+		notified := StateResolved
+		if ok {
+			notified = a.notified
+		}
+		a = &Alert{State: StatePending, ActiveAt: now, notified: notified, series: s.series}
+		e.alerts[key] = a
+	}
+	a.Rule = r
+	a.Labels = r.labels(s.series)
+	a.Value = s.value
+
+	if a.State == StatePending && now.Sub(a.ActiveAt) >= time.Duration(r.For) {
+		a.State = StateFiring
+		a.FiredAt = &now
+	}
+}
+
+// Firing and resolved alerts are notified if the state differs from the notified one
+// and the alert isn't silenced. New alerts are considered notified as resolved,
+// so resolving of the never notified firing isn't notified.
+func (e *engine) shouldNotify(a *Alert, now time.Time) bool {
+	return a.State != StatePending && a.State != a.notified && !e.isSilenced(*a, now)
+}
+
+// Returns values of the rule for every series having its labels.
+func (e *engine) samples(r Rule, now time.Time) ([]sample, error) {
+	series, err := e.repo.Series(r.MetricType, r.MetricName, r.Labels)
+	if err != nil {
+		return nil, err
+	}
+	if r.Kind == KindStale && len(series) == 0 {
+		// metrics which were never received are stale since the engine start
+		value := now.Sub(e.started).Seconds()
+		return []sample{{value: value, matches: r.matches(value)}}, nil
+	}
+
+	samples := make([]sample, 0, len(series))
+	for _, m := range series {
+		value, err := e.value(r, m, now)
+		if err != nil && !errors.Is(err, models.ErrorMetricNotFound) {
+			return nil, err
+		}
+		// series without a value don't match any rule
+		samples = append(samples, sample{series: m.Labels, value: value, matches: err == nil && r.matches(value)})
+	}
+	return samples, nil
+}
+
+// Returns the value of the rule for the series compared to the threshold.
+func (e *engine) value(r Rule, m models.Metrics, now time.Time) (float64, error) {
+	switch {
+	case r.Kind == KindStale:
+		return e.staleness(m, now), nil
+	case r.Kind == KindRate:
+		return e.rate(r, m, now)
+	case m.MType == models.MGauge && m.Value != nil:
+		return *m.Value, nil
+	case m.MType == models.MCounter && m.Delta != nil:
+		return float64(*m.Delta), nil
+	default:
+		return 0, fmt.Errorf("metric `%s` has no value. %w", m.ID, models.ErrorMetricNotFound)
+	}
+}
+
+// Returns an error if the rule needs more history than kept. Must be called with the lock held.
+func (e *engine) checkHistory(r Rule) error {
+	if r.Kind != KindRate {
+		return nil
+	}
+	if e.history.Samples >= 0 && e.history.Samples < 2 {
+		return fmt.Errorf("rate needs at least 2 raw samples, %d kept. %w", e.history.Samples, ErrorBadRule)
+	}
+	if e.history.RawTTL > 0 && e.history.RawTTL < time.Duration(r.Window) {
+		logger.Log(e.ctx).Warnf("alerting: rule `%s` rate is evaluated over %s of raw samples, not %s",
+			r.Name, e.history.RawTTL, time.Duration(r.Window))
+	}
+	return nil
+}
+
+// Returns the per-second increase of the counter series over the rule window.
+// The counter is considered reset if its value decreased.
+func (e *engine) rate(r Rule, m models.Metrics, now time.Time) (float64, error) {
+	h, err := e.repo.History(r.MetricType, r.MetricName, models.HistoryQuery{
+		From:   now.Add(-time.Duration(r.Window)),
+		To:     now,
+		Labels: m.Labels,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	samples := make([]models.Sample, 0, len(h.Samples))
+	for _, s := range h.Samples {
+		if s.Delta != nil {
+			samples = append(samples, s)
+		}
+	}
+	if len(samples) < 2 {
+		return 0, fmt.Errorf("not enough samples of `%s` for the rate. %w", r.MetricName, models.ErrorMetricNotFound)
+	}
+
+	first, last := samples[0], samples[len(samples)-1]
+	elapsed := last.Timestamp.Sub(first.Timestamp).Seconds()
+	if elapsed <= 0 {
+		return 0, fmt.Errorf("samples of `%s` have the same time. %w", r.MetricName, models.ErrorMetricNotFound)
+	}
+
+	increase := int64(0)
+	for i := 1; i < len(samples); i++ {
+		prev, cur := *samples[i-1].Delta, *samples[i].Delta
+		if cur < prev {
+			increase += cur
+		} else {
+			increase += cur - prev
+		}
+	}
+	return float64(increase) / elapsed, nil
+}
+
+// Returns seconds since the series update, series without the update time are stale
+// since the engine start.
+func (e *engine) staleness(m models.Metrics, now time.Time) float64 {
+	updated := e.started
+	if m.UpdatedAt != nil {
+		updated = *m.UpdatedAt
+	}
+	return now.Sub(updated).Seconds()
+}
+
+func hasState(states []State, s State) bool {
+	for _, st := range states {
+		if st == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,762 @@
+package alerting_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/alerting"
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	"github.com/amiskov/metrics-and-alerting/pkg/server/repo"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/inmem"
+)
+
+func TestLoadRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name: "test valid rules",
+			rules: `[{"name": "HighAlloc", "metric_type": "gauge", "metric_name": "Alloc",
+				"comparison": ">", "threshold": 100, "for": "1m", "severity": "critical"}]`,
+		},
+		{
+			name:    "test unknown metric type",
+			rules:   `[{"name": "HighAlloc", "metric_type": "histogram", "metric_name": "Alloc", "comparison": ">"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "test unknown comparison",
+			rules:   `[{"name": "HighAlloc", "metric_type": "gauge", "metric_name": "Alloc", "comparison": "=>"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "test bad duration",
+			rules:   `[{"name": "HighAlloc", "metric_type": "gauge", "metric_name": "Alloc", "comparison": ">", "for": 60}]`,
+			wantErr: true,
+		},
+		{
+			name:    "test rate of gauge",
+			rules:   `[{"name": "Fast", "kind": "rate", "metric_type": "gauge", "metric_name": "Alloc", "comparison": ">", "window": "1m"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "test staleness without window",
+			rules:   `[{"name": "NoPolls", "kind": "stale", "metric_type": "counter", "metric_name": "PollCount"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "test unknown kind",
+			rules:   `[{"name": "HighAlloc", "kind": "delta", "metric_type": "gauge", "metric_name": "Alloc", "comparison": ">"}]`,
+			wantErr: true,
+		},
+		{
+			name: "test duplicate names",
+			rules: `[{"name": "HighAlloc", "metric_type": "gauge", "metric_name": "Alloc", "comparison": ">"},
+				{"name": "HighAlloc", "metric_type": "gauge", "metric_name": "HeapAlloc", "comparison": ">"}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			if err := os.WriteFile(path, []byte(tt.rules), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := alerting.LoadRules(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error: %v, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	logger.Run("error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := repo.New(ctx, nil, inmem.New(ctx, nil))
+	setAlloc := func(v float64) {
+		if err := db.Update(models.Metrics{ID: "Alloc", MType: models.MGauge, Value: &v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rule := alerting.Rule{
+		Name:       "HighAlloc",
+		MetricType: models.MGauge,
+		MetricName: "Alloc",
+		Comparison: ">",
+		Threshold:  100,
+		For:        alerting.Duration(time.Minute),
+	}
+	if err := rule.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	engine := alerting.New(ctx, db, []alerting.Rule{rule}, nil)
+
+	start := time.Now()
+	steps := []struct {
+		name  string
+		alloc float64 // 0 means the metric isn't updated
+		after time.Duration
+		want  alerting.State // empty means no alert
+	}{
+		{name: "test missing metric", after: 0},
+		{name: "test below threshold", alloc: 50, after: 0},
+		{name: "test pending", alloc: 150, after: 10 * time.Second, want: alerting.StatePending},
+		{name: "test still pending", alloc: 150, after: 50 * time.Second, want: alerting.StatePending},
+		{name: "test firing", alloc: 150, after: 70 * time.Second, want: alerting.StateFiring},
+		{name: "test resolved", alloc: 50, after: 80 * time.Second, want: alerting.StateResolved},
+		{name: "test pending again", alloc: 150, after: 90 * time.Second, want: alerting.StatePending},
+		{name: "test pending cleared", alloc: 50, after: 100 * time.Second},
+	}
+	for _, s := range steps {
+		t.Run(s.name, func(t *testing.T) {
+			if s.alloc != 0 {
+				setAlloc(s.alloc)
+			}
+			engine.Evaluate(start.Add(s.after))
+
+			alerts := engine.Alerts()
+			if s.want == "" {
+				if len(alerts) != 0 {
+					t.Fatalf("Expected no alerts, got %+v", alerts)
+				}
+				return
+			}
+			if len(alerts) != 1 {
+				t.Fatalf("Expected 1 alert, got %d", len(alerts))
+			}
+			if alerts[0].State != s.want {
+				t.Errorf("Expected state `%s`, got `%s`", s.want, alerts[0].State)
+			}
+			if alerts[0].Value != s.alloc {
+				t.Errorf("Expected value %v, got %v", s.alloc, alerts[0].Value)
+			}
+		})
+	}
+}
+
+func TestLabelSubset(t *testing.T) {
+	logger.Run("error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := repo.New(ctx, nil, inmem.New(ctx, nil))
+	for _, labels := range []map[string]string{
+		{"agent_id": "a1", "host": "web1"},
+		{"agent_id": "a2", "host": "web2"},
+	} {
+		alloc := 150.0
+		if err := db.Update(models.Metrics{ID: "Alloc", MType: models.MGauge, Value: &alloc, Labels: labels}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		labels     map[string]string
+		wantAgents []string // `agent_id` of firing alerts
+	}{
+		{name: "test subset of labels", labels: map[string]string{"agent_id": "a1"}, wantAgents: []string{"a1"}},
+		{name: "test exact labels", labels: map[string]string{"agent_id": "a2", "host": "web2"}, wantAgents: []string{"a2"}},
+		{name: "test every series", labels: nil, wantAgents: []string{"a1", "a2"}},
+		{name: "test unknown labels", labels: map[string]string{"agent_id": "a3"}, wantAgents: []string{}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rule := alerting.Rule{Name: "HighAlloc", MetricType: models.MGauge, MetricName: "Alloc", Labels: tt.labels, Comparison: ">", Threshold: 100}
+			if err := rule.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			engine := alerting.New(ctx, db, []alerting.Rule{rule}, nil)
+			engine.Evaluate(time.Now())
+
+			agents := []string{}
+			for _, a := range engine.Alerts(alerting.StateFiring) {
+				agents = append(agents, a.Labels["agent_id"])
+			}
+			if !reflect.DeepEqual(agents, tt.wantAgents) {
+				t.Errorf("Expected alerts of %v, got %v", tt.wantAgents, agents)
+			}
+		})
+	}
+}
+
+// Returns the fixed counter history, implements `alerting.Repo`.
+type counterRepo struct {
+	samples []models.Sample
+	updated time.Time
+}
+
+func (r counterRepo) Series(metricType, metricName string, labels map[string]string) ([]models.Metrics, error) {
+	if len(r.samples) == 0 {
+		return nil, nil
+	}
+	last := r.samples[len(r.samples)-1]
+	return []models.Metrics{{ID: metricName, MType: metricType, Delta: last.Delta, UpdatedAt: &r.updated}}, nil
+}
+
+func (r counterRepo) History(metricType, metricName string, q models.HistoryQuery) (models.History, error) {
+	h := models.History{ID: metricName, MType: metricType}
+	for _, s := range r.samples {
+		if !s.Timestamp.Before(q.From) && !s.Timestamp.After(q.To) {
+			h.Samples = append(h.Samples, s)
+		}
+	}
+	return h, nil
+}
+
+func TestRateAndStaleness(t *testing.T) {
+	logger.Run("error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	samples := func(deltas ...int64) []models.Sample {
+		res := make([]models.Sample, len(deltas))
+		for i := range deltas {
+			res[i] = models.Sample{Timestamp: now.Add(time.Duration(i-len(deltas)+1) * 10 * time.Second), Delta: &deltas[i]}
+		}
+		return res
+	}
+	rate := alerting.Rule{
+		Name: "FastPolls", Kind: alerting.KindRate, MetricType: models.MCounter, MetricName: "PollCount",
+		Comparison: ">", Threshold: 1, Window: alerting.Duration(time.Minute),
+	}
+	stale := alerting.Rule{
+		Name: "NoPolls", Kind: alerting.KindStale, MetricType: models.MCounter, MetricName: "PollCount",
+		Window: alerting.Duration(time.Minute),
+	}
+
+	tests := []struct {
+		name      string
+		rule      alerting.Rule
+		repo      counterRepo
+		wantValue float64
+		wantFired bool
+	}{
+		{
+			name:      "test fast counter",
+			rule:      rate,
+			repo:      counterRepo{samples: samples(0, 20, 40), updated: now},
+			wantValue: 2,
+			wantFired: true,
+		},
+		{
+			name: "test slow counter",
+			rule: rate,
+			repo: counterRepo{samples: samples(0, 5, 10), updated: now},
+		},
+		{
+			name:      "test counter reset",
+			rule:      rate,
+			repo:      counterRepo{samples: samples(100, 120, 30), updated: now},
+			wantValue: 2.5,
+			wantFired: true,
+		},
+		{
+			name: "test not enough samples",
+			rule: rate,
+			repo: counterRepo{samples: samples(100), updated: now},
+		},
+		{
+			name: "test fresh metric",
+			rule: stale,
+			repo: counterRepo{samples: samples(1), updated: now.Add(-30 * time.Second)},
+		},
+		{
+			name:      "test stale metric",
+			rule:      stale,
+			repo:      counterRepo{samples: samples(1), updated: now.Add(-2 * time.Minute)},
+			wantValue: 120,
+			wantFired: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			engine := alerting.New(ctx, tt.repo, []alerting.Rule{tt.rule}, nil)
+			engine.Evaluate(now)
+
+			alerts := engine.Alerts(alerting.StateFiring)
+			if !tt.wantFired {
+				if len(alerts) != 0 {
+					t.Errorf("Expected no alerts, got %+v", alerts)
+				}
+				return
+			}
+			if len(alerts) != 1 {
+				t.Fatalf("Expected the firing alert, got %+v", alerts)
+			}
+			if alerts[0].Value != tt.wantValue {
+				t.Errorf("Expected value %v, got %v", tt.wantValue, alerts[0].Value)
+			}
+		})
+	}
+}
+
+func TestHistoryLimits(t *testing.T) {
+	rate := alerting.Rule{
+		Name: "FastPolls", Kind: alerting.KindRate, MetricType: models.MCounter, MetricName: "PollCount",
+		Comparison: ">", Threshold: 1, Window: alerting.Duration(time.Hour),
+	}
+	threshold := alerting.Rule{Name: "HighAlloc", MetricType: models.MGauge, MetricName: "Alloc", Comparison: ">"}
+
+	tests := []struct {
+		name     string
+		limits   alerting.HistoryLimits
+		warnings int
+		wantErr  bool
+	}{
+		{name: "test unlimited history", limits: alerting.HistoryLimits{Samples: -1}},
+		{name: "test history disabled", limits: alerting.HistoryLimits{Samples: 0}, warnings: 1, wantErr: true},
+		{name: "test single sample", limits: alerting.HistoryLimits{Samples: 1}, warnings: 1, wantErr: true},
+		{name: "test raw samples shorter than window", limits: alerting.HistoryLimits{Samples: 1000, RawTTL: time.Minute}, warnings: 2},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.WarnLevel)
+			ctx, cancel := context.WithCancel(context.WithValue(context.Background(), logger.LoggerKey, zap.New(core).Sugar()))
+			defer cancel()
+
+			engine := alerting.New(ctx, counterRepo{}, []alerting.Rule{rate, threshold}, nil)
+			engine.SetHistoryLimits(tt.limits)
+
+			added := rate
+			added.Name = "AddedFastPolls"
+			_, err := engine.AddRule(added)
+			if tt.wantErr != errors.Is(err, alerting.ErrorBadRule) {
+				t.Errorf("Expected the rule rejected %v, got %v", tt.wantErr, err)
+			}
+			if _, err := engine.AddRule(alerting.Rule{Name: "LowAlloc", MetricType: models.MGauge, MetricName: "Alloc", Comparison: "<"}); err != nil {
+				t.Errorf("Expected the threshold rule added, got %v", err)
+			}
+			if logs.Len() != tt.warnings {
+				t.Errorf("Expected %d warnings, got %+v", tt.warnings, logs.All())
+			}
+		})
+	}
+}
+
+// Keeps rules and silences in memory, implements `alerting.RuleStore`.
+type ruleStore struct {
+	rules    map[string]alerting.Rule
+	silences map[string]alerting.Silence
+}
+
+func newRuleStore(rules ...alerting.Rule) ruleStore {
+	s := ruleStore{rules: map[string]alerting.Rule{}, silences: map[string]alerting.Silence{}}
+	for _, r := range rules {
+		s.rules[r.Name] = r
+	}
+	return s
+}
+
+func (s ruleStore) LoadRules() ([]alerting.Rule, error) {
+	rules := []alerting.Rule{}
+	for _, r := range s.rules {
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func (s ruleStore) SaveRule(r alerting.Rule) error {
+	s.rules[r.Name] = r
+	return nil
+}
+
+func (s ruleStore) DeleteRule(name string) error {
+	delete(s.rules, name)
+	return nil
+}
+
+func (s ruleStore) LoadSilences() ([]alerting.Silence, error) {
+	silences := []alerting.Silence{}
+	for _, sl := range s.silences {
+		silences = append(silences, sl)
+	}
+	return silences, nil
+}
+
+func (s ruleStore) SaveSilence(sl alerting.Silence) error {
+	s.silences[sl.ID] = sl
+	return nil
+}
+
+func (s ruleStore) DeleteSilence(id string) error {
+	delete(s.silences, id)
+	return nil
+}
+
+func TestPersist(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rule := func(name string, threshold float64) alerting.Rule {
+		return alerting.Rule{Name: name, MetricType: models.MGauge, MetricName: "Alloc", Comparison: ">", Threshold: threshold}
+	}
+	store := newRuleStore(rule("Stored", 1), rule("FromFile", 1))
+
+	engine := alerting.New(ctx, repo.New(ctx, nil, inmem.New(ctx, nil)), []alerting.Rule{rule("FromFile", 2)}, nil)
+	if err := engine.Persist(store); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := engine.Rules()
+	if len(rules) != 2 || rules[0].Name != "FromFile" || rules[0].Threshold != 2 || rules[1].Name != "Stored" {
+		t.Fatalf("Expected stored rules overridden by the given ones, got %+v", rules)
+	}
+	if store.rules["FromFile"].Threshold != 2 {
+		t.Errorf("Expected the given rule to be saved, got %+v", store.rules["FromFile"])
+	}
+
+	if _, err := engine.AddRule(rule("Added", 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.DeleteRule("Stored"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.rules["Added"]; !ok {
+		t.Error("Expected the added rule to be saved")
+	}
+	if _, ok := store.rules["Stored"]; ok {
+		t.Error("Expected the deleted rule to be removed from the store")
+	}
+
+	silence, err := engine.AddSilence(alerting.Silence{MetricName: "Alloc", EndsAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := alerting.Silence{ID: "expired", MetricName: "Alloc", EndsAt: time.Now().Add(-48 * time.Hour)}
+	store.silences[expired.ID] = expired
+
+	restarted := alerting.New(ctx, repo.New(ctx, nil, inmem.New(ctx, nil)), nil, nil)
+	if err := restarted.Persist(store); err != nil {
+		t.Fatal(err)
+	}
+	silences := restarted.Silences()
+	if len(silences) != 1 || silences[0].ID != silence.ID {
+		t.Errorf("Expected the stored silence after restart, got %+v", silences)
+	}
+	if _, ok := store.silences[expired.ID]; ok {
+		t.Error("Expected the expired silence to be removed from the store")
+	}
+}
+
+// Blocks saving until `release` is closed.
+type slowStore struct {
+	ruleStore
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (s slowStore) SaveRule(r alerting.Rule) error {
+	close(s.saving)
+	<-s.release
+	return s.ruleStore.SaveRule(r)
+}
+
+func TestSlowStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	engine := alerting.New(ctx, repo.New(ctx, nil, inmem.New(ctx, nil)), nil, nil)
+	store := slowStore{newRuleStore(), make(chan struct{}), make(chan struct{})}
+	if err := engine.Persist(store); err != nil {
+		t.Fatal(err)
+	}
+
+	added := make(chan error)
+	go func() {
+		_, err := engine.AddRule(alerting.Rule{Name: "Slow", MetricType: models.MGauge, MetricName: "Alloc", Comparison: ">", Threshold: 1})
+		added <- err
+	}()
+	<-store.saving
+
+	evaluated := make(chan struct{})
+	go func() {
+		engine.Evaluate(time.Now())
+		_ = engine.Alerts()
+		close(evaluated)
+	}()
+	select {
+	case <-evaluated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Evaluate is blocked by the store")
+	}
+
+	close(store.release)
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.Rule("Slow"); err != nil {
+		t.Errorf("Expected the rule added after saving, got %v", err)
+	}
+}
+
+func TestSlowRepo(t *testing.T) {
+	logger.Run("error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := slowRepo{make(chan struct{}), make(chan struct{})}
+	rule := alerting.Rule{Name: "HighAlloc", MetricType: models.MGauge, MetricName: "Alloc", Comparison: ">", Threshold: 100}
+	engine := alerting.New(ctx, db, []alerting.Rule{rule}, nil)
+
+	evaluated := make(chan struct{})
+	go func() {
+		engine.Evaluate(time.Now())
+		close(evaluated)
+	}()
+	<-db.reading
+
+	deleted := make(chan error)
+	go func() {
+		_ = engine.Alerts()
+		deleted <- engine.DeleteRule("HighAlloc")
+	}()
+	select {
+	case err := <-deleted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Rules are blocked by the repo")
+	}
+
+	close(db.release)
+	<-evaluated
+	if alerts := engine.Alerts(); len(alerts) != 0 {
+		t.Errorf("Expected no alerts of the rule deleted while evaluating, got %+v", alerts)
+	}
+}
+
+// Blocks reading series until released, implements `alerting.Repo`.
+type slowRepo struct {
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (r slowRepo) Series(metricType, metricName string, labels map[string]string) ([]models.Metrics, error) {
+	close(r.reading)
+	<-r.release
+	alloc := 150.0
+	return []models.Metrics{{ID: metricName, MType: metricType, Value: &alloc}}, nil
+}
+
+func (r slowRepo) History(metricType, metricName string, q models.HistoryQuery) (models.History, error) {
+	return models.History{ID: metricName, MType: metricType}, nil
+}
+
+// Keeps notified alerts, implements `alerting.Notifier`.
+type notifier struct {
+	alerts []alerting.Alert
+}
+
+func (n *notifier) Notify(alerts []alerting.Alert) {
+	n.alerts = append(n.alerts, alerts...)
+}
+
+func TestSilence(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := repo.New(ctx, nil, inmem.New(ctx, nil))
+	alloc := 150.0
+	if err := db.Update(models.Metrics{ID: "HeapAlloc", MType: models.MGauge, Value: &alloc}); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := alerting.Rule{Name: "HighHeap", MetricType: models.MGauge, MetricName: "HeapAlloc", Comparison: ">", Threshold: 100}
+	if err := rule.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		silence  alerting.Silence
+		notified int
+	}{
+		{
+			name:     "test matching pattern",
+			silence:  alerting.Silence{MetricName: "Heap*", EndsAt: time.Now().Add(time.Hour)},
+			notified: 0,
+		},
+		{
+			name:     "test matching label",
+			silence:  alerting.Silence{Labels: map[string]string{"severity": "warning"}, EndsAt: time.Now().Add(time.Hour)},
+			notified: 0,
+		},
+		{
+			name:     "test not matching agent",
+			silence:  alerting.Silence{AgentID: "web1", EndsAt: time.Now().Add(time.Hour)},
+			notified: 1,
+		},
+		{
+			name: "test silence in the future",
+			silence: alerting.Silence{
+				MetricName: "Heap*",
+				StartsAt:   time.Now().Add(time.Hour),
+				EndsAt:     time.Now().Add(2 * time.Hour),
+			},
+			notified: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &notifier{}
+			engine := alerting.New(ctx, db, []alerting.Rule{rule}, n)
+			if _, err := engine.AddSilence(tt.silence); err != nil {
+				t.Fatal(err)
+			}
+
+			engine.Evaluate(time.Now())
+
+			if len(n.alerts) != tt.notified {
+				t.Errorf("Expected %d notifications, got %d", tt.notified, len(n.alerts))
+			}
+			// silences don't stop evaluation
+			alerts := engine.Alerts(alerting.StateFiring)
+			if len(alerts) != 1 {
+				t.Fatalf("Expected the firing alert, got %+v", alerts)
+			}
+			if alerts[0].Silenced != (tt.notified == 0) {
+				t.Errorf("Expected silenced %v, got %v", tt.notified == 0, alerts[0].Silenced)
+			}
+		})
+	}
+}
+
+func TestSilenceBySeriesLabels(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := repo.New(ctx, nil, inmem.New(ctx, nil))
+	alloc := 150.0
+	series := map[string]string{"agent_id": "a1", "host": "web1"}
+	if err := db.Update(models.Metrics{ID: "HeapAlloc", MType: models.MGauge, Value: &alloc, Labels: series}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rule doesn't name the agent
+	rule := alerting.Rule{Name: "HighHeap", MetricType: models.MGauge, MetricName: "HeapAlloc",
+		Labels: map[string]string{"host": "web1"}, Comparison: ">", Threshold: 100}
+	if err := rule.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		agentID  string
+		notified int
+	}{
+		{name: "test agent of the series", agentID: "a1", notified: 0},
+		{name: "test other agent", agentID: "a2", notified: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &notifier{}
+			engine := alerting.New(ctx, db, []alerting.Rule{rule}, n)
+			if _, err := engine.AddSilence(alerting.Silence{AgentID: tt.agentID, EndsAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+
+			engine.Evaluate(time.Now())
+
+			if len(n.alerts) != tt.notified {
+				t.Errorf("Expected %d notifications, got %d", tt.notified, len(n.alerts))
+			}
+			alerts := engine.Alerts(alerting.StateFiring)
+			if len(alerts) != 1 {
+				t.Fatalf("Expected the firing alert, got %+v", alerts)
+			}
+			for k, v := range series {
+				if alerts[0].Labels[k] != v {
+					t.Errorf("Expected the series label %s=%s, got %v", k, v, alerts[0].Labels)
+				}
+			}
+		})
+	}
+}
+
+func TestSilenceEnd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := repo.New(ctx, nil, inmem.New(ctx, nil))
+	setAlloc := func(v float64) {
+		if err := db.Update(models.Metrics{ID: "HeapAlloc", MType: models.MGauge, Value: &v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rule := alerting.Rule{Name: "HighHeap", MetricType: models.MGauge, MetricName: "HeapAlloc", Comparison: ">", Threshold: 100}
+	if err := rule.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	steps := []struct {
+		name  string
+		alloc float64
+		after time.Duration
+		want  []alerting.State // notified states
+	}{
+		{name: "test firing while silenced", alloc: 150, after: 0},
+		{name: "test firing after silence", alloc: 150, after: 2 * time.Hour, want: []alerting.State{alerting.StateFiring}},
+		{name: "test firing isn't repeated", alloc: 150, after: 3 * time.Hour},
+		{name: "test resolved while silenced", alloc: 50, after: 4 * time.Hour},
+		{name: "test resolved after silence", alloc: 50, after: 6 * time.Hour, want: []alerting.State{alerting.StateResolved}},
+		{name: "test firing and resolved while silenced", alloc: 150, after: 7 * time.Hour},
+		{name: "test never notified firing", alloc: 50, after: 8 * time.Hour},
+		{name: "test nothing after silence", alloc: 50, after: 10 * time.Hour},
+	}
+
+	n := &notifier{}
+	engine := alerting.New(ctx, db, []alerting.Rule{rule}, n)
+	for _, window := range [][2]time.Duration{{0, time.Hour}, {4 * time.Hour, 5 * time.Hour}, {7 * time.Hour, 9 * time.Hour}} {
+		silence := alerting.Silence{MetricName: "HeapAlloc", StartsAt: start.Add(window[0]), EndsAt: start.Add(window[1])}
+		if _, err := engine.AddSilence(silence); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, s := range steps {
+		t.Run(s.name, func(t *testing.T) {
+			n.alerts = nil
+			setAlloc(s.alloc)
+			engine.Evaluate(start.Add(s.after))
+
+			if len(n.alerts) != len(s.want) {
+				t.Fatalf("Expected %d notifications, got %+v", len(s.want), n.alerts)
+			}
+			for i, a := range n.alerts {
+				if a.State != s.want[i] {
+					t.Errorf("Expected state `%s`, got `%s`", s.want[i], a.State)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package alerting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+var ErrorBadRule = errors.New("bad alert rule")
+
+const defaultSeverity = "warning"
+
+// Kinds of rules, they differ in the value compared to the threshold.
+const (
+	KindThreshold = "threshold" // the metric value, the default
+	KindRate      = "rate"      // per-second increase of the counter over `Window`
+	KindStale     = "stale"     // fires if the metric isn't updated for `Window`, no comparison
+)
+
+// Alert fires when the value compared to the threshold is true for at least `For`.
+type Rule struct {
+	Name       string            `json:"name"`
+	Kind       string            `json:"kind"`
+	MetricType string            `json:"metric_type"`
+	MetricName string            `json:"metric_name"`
+	Labels     map[string]string `json:"labels,omitempty"`     // series of the metric, the one without labels by default
+	Comparison string            `json:"comparison,omitempty"` // one of `>`, `>=`, `<`, `<=`, `==`, `!=`
+	Threshold  float64           `json:"threshold"`
+	Window     Duration          `json:"window,omitempty"`
+	For        Duration          `json:"for"`
+	Severity   string            `json:"severity"`
+}
+
+// Duration which is (un)marshaled to JSON as a string like `5m`.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like `5m`: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Reads rules from the JSON file with an array of rules.
+func LoadRules(path string) ([]Rule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("alerting: failed reading rules file: %w", err)
+	}
+
+	rules := []Rule{}
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("alerting: failed parsing rules file: %w", err)
+	}
+
+	names := make(map[string]bool, len(rules))
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return nil, fmt.Errorf("alerting: rule #%d: %w", i, err)
+		}
+		if names[rules[i].Name] {
+			return nil, fmt.Errorf("alerting: duplicate rule `%s`. %w", rules[i].Name, ErrorBadRule)
+		}
+		names[rules[i].Name] = true
+	}
+
+	return rules, nil
+}
+
+// Checks the rule and sets defaults.
+func (r *Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("empty name. %w", ErrorBadRule)
+	}
+	if r.MetricType != models.MGauge && r.MetricType != models.MCounter {
+		return fmt.Errorf("rule `%s`: %s `%s`. %w", r.Name, models.ErrorUnknownMetricType, r.MetricType, ErrorBadRule)
+	}
+	if r.MetricName == "" {
+		return fmt.Errorf("rule `%s`: empty metric name. %w", r.Name, ErrorBadRule)
+	}
+	if err := models.ValidateLabels(r.Labels); err != nil {
+		return fmt.Errorf("rule `%s`: %v. %w", r.Name, err, ErrorBadRule)
+	}
+
+	if r.Kind == "" {
+		r.Kind = KindThreshold
+	}
+	switch r.Kind {
+	case KindThreshold:
+	case KindRate:
+		if r.MetricType != models.MCounter {
+			return fmt.Errorf("rule `%s`: rate is defined for counters only. %w", r.Name, ErrorBadRule)
+		}
+		if r.Window <= 0 {
+			return fmt.Errorf("rule `%s`: rate needs a positive `window`. %w", r.Name, ErrorBadRule)
+		}
+	case KindStale:
+		if r.Window <= 0 {
+			return fmt.Errorf("rule `%s`: staleness needs a positive `window`. %w", r.Name, ErrorBadRule)
+		}
+	default:
+		return fmt.Errorf("rule `%s`: unknown kind `%s`. %w", r.Name, r.Kind, ErrorBadRule)
+	}
+
+	if _, ok := comparisons[r.Comparison]; !ok && r.Kind != KindStale {
+		return fmt.Errorf("rule `%s`: unknown comparison `%s`. %w", r.Name, r.Comparison, ErrorBadRule)
+	}
+	if r.For < 0 {
+		return fmt.Errorf("rule `%s`: negative `for`. %w", r.Name, ErrorBadRule)
+	}
+	if r.Severity == "" {
+		r.Severity = defaultSeverity
+	}
+	return nil
+}
+
+var comparisons = map[string]func(value, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+// Returns `true` if the value matches the rule condition.
+// The value of stale rules is seconds since the last update.
+func (r Rule) matches(value float64) bool {
+	if r.Kind == KindStale {
+		return value >= time.Duration(r.Window).Seconds()
+	}
+	return comparisons[r.Comparison](value, r.Threshold)
+}
+
+// Labels identifying alerts of the rule for receivers. Labels of the matched series
+// (e.g. `agent_id` of a rule matching by `host`) are added to the rule ones.
+func (r Rule) labels(series map[string]string) map[string]string {
+	labels := map[string]string{}
+	for k, v := range series {
+		labels[k] = v
+	}
+	for k, v := range r.Labels {
+		labels[k] = v
+	}
+	labels["alertname"] = r.Name
+	labels["severity"] = r.Severity
+	labels["metric_type"] = r.MetricType
+	labels["metric_name"] = r.MetricName
+	return labels
+}
@@ -0,0 +1,162 @@
+package alerting
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+var (
+	ErrorBadSilence      = errors.New("bad silence")
+	ErrorSilenceNotFound = errors.New("silence not found")
+)
+
+// Expired silences are listed for this time and then forgotten.
+const expiredSilenceRetention = 24 * time.Hour
+
+// Label of alerts with the ID of the agent which sent the metric.
+const AgentIDLabel = "agent_id"
+
+// Suppresses notifications about matching alerts between `StartsAt` and `EndsAt`.
+// Alerts are still evaluated. The alert matches if it matches all the set matchers.
+type Silence struct {
+	ID         string            `json:"id"`
+	MetricName string            `json:"metric_name,omitempty"` // pattern like `Heap*`, see `path.Match`
+	Labels     map[string]string `json:"labels,omitempty"`      // alert labels must be equal
+	AgentID    string            `json:"agent_id,omitempty"`
+	StartsAt   time.Time         `json:"starts_at"`
+	EndsAt     time.Time         `json:"ends_at"`
+	Comment    string            `json:"comment"`
+}
+
+// Checks the silence and sets defaults.
+func (s *Silence) Validate(now time.Time) error {
+	if s.MetricName == "" && len(s.Labels) == 0 && s.AgentID == "" {
+		return fmt.Errorf("silence must have at least one matcher. %w", ErrorBadSilence)
+	}
+	if _, err := path.Match(s.MetricName, ""); err != nil {
+		return fmt.Errorf("bad metric name pattern `%s`: %v. %w", s.MetricName, err, ErrorBadSilence)
+	}
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return fmt.Errorf("silence must end after it starts. %w", ErrorBadSilence)
+	}
+	return nil
+}
+
+func (s Silence) IsActive(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+// Returns all silences sorted by start time.
+func (e *engine) Silences() []Silence {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+
+	silences := make([]Silence, 0, len(e.silences))
+	for _, s := range e.silences {
+		silences = append(silences, s)
+	}
+	sort.Slice(silences, func(i, j int) bool {
+		return silences[i].StartsAt.Before(silences[j].StartsAt)
+	})
+	return silences
+}
+
+func (e *engine) AddSilence(s Silence) (Silence, error) {
+	if err := s.Validate(time.Now()); err != nil {
+		return s, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return s, fmt.Errorf("alerting: failed generating silence ID: %w", err)
+	}
+	s.ID = hex.EncodeToString(id)
+
+	e.writeMx.Lock()
+	defer e.writeMx.Unlock()
+
+	if e.store != nil {
+		if err := e.store.SaveSilence(s); err != nil {
+			return s, fmt.Errorf("alerting: failed saving silence: %w", err)
+		}
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	e.silences[s.ID] = s
+
+	return s, nil
+}
+
+func (e *engine) DeleteSilence(id string) error {
+	e.writeMx.Lock()
+	defer e.writeMx.Unlock()
+
+	e.mx.RLock()
+	_, ok := e.silences[id]
+	e.mx.RUnlock()
+	if !ok {
+		return fmt.Errorf("`%s`: %w", id, ErrorSilenceNotFound)
+	}
+	if e.store != nil {
+		if err := e.store.DeleteSilence(id); err != nil {
+			return fmt.Errorf("alerting: failed deleting silence `%s`: %w", id, err)
+		}
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	delete(e.silences, id)
+
+	return nil
+}
+
+// ============ Not exported
+
+func (s Silence) matches(a Alert) bool {
+	if s.MetricName != "" {
+		if ok, _ := path.Match(s.MetricName, a.Rule.MetricName); !ok {
+			return false
+		}
+	}
+	for k, v := range s.Labels {
+		if a.Labels[k] != v {
+			return false
+		}
+	}
+	if s.AgentID != "" && a.Labels[AgentIDLabel] != s.AgentID {
+		return false
+	}
+	return true
+}
+
+// Must be called with the lock held.
+func (e *engine) isSilenced(a Alert, now time.Time) bool {
+	for _, s := range e.silences {
+		if s.IsActive(now) && s.matches(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Silence) isExpired(now time.Time) bool {
+	return now.Sub(s.EndsAt) > expiredSilenceRetention
+}
+
+// Must be called with the lock held. Pruned silences are removed from the store on the next start.
+func (e *engine) pruneSilences(now time.Time) {
+	for id, s := range e.silences {
+		if s.isExpired(now) {
+			delete(e.silences, id)
+		}
+	}
+}
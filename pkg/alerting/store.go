@@ -0,0 +1,228 @@
+package alerting
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	ErrorRuleNotFound = errors.New("alert rule not found")
+	ErrorRuleExists   = errors.New("alert rule already exists")
+)
+
+// Persistent storage of rules and silences: Postgres or the backup file.
+type RuleStore interface {
+	LoadRules() ([]Rule, error)
+	SaveRule(Rule) error // inserts or replaces the rule with the same name
+	DeleteRule(name string) error
+	LoadSilences() ([]Silence, error)
+	SaveSilence(Silence) error // inserts or replaces the silence with the same ID
+	DeleteSilence(id string) error
+}
+
+// Keeps rules and silences in the store. Stored rules are loaded, rules given to `New`
+// (e.g. from the rules file) are saved replacing the stored ones with the same name.
+// So the rules file wins: its rule deleted through the API comes back on the next start
+// unless it's removed from the file too. Expired silences are removed from the store.
+func (e *engine) Persist(s RuleStore) error {
+	e.writeMx.Lock()
+	defer e.writeMx.Unlock()
+
+	stored, err := s.LoadRules()
+	if err != nil {
+		return fmt.Errorf("alerting: failed loading rules: %w", err)
+	}
+
+	byName := make(map[string]Rule, len(stored)+len(e.rules))
+	for _, r := range stored {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("alerting: stored rule is invalid: %w", err)
+		}
+		byName[r.Name] = r
+	}
+	for _, r := range e.Rules() {
+		if err := s.SaveRule(r); err != nil {
+			return fmt.Errorf("alerting: failed saving rule `%s`: %w", r.Name, err)
+		}
+		byName[r.Name] = r
+	}
+
+	silences, err := s.LoadSilences()
+	if err != nil {
+		return fmt.Errorf("alerting: failed loading silences: %w", err)
+	}
+	now := time.Now()
+	for i := 0; i < len(silences); i++ {
+		if !silences[i].isExpired(now) {
+			continue
+		}
+		if err := s.DeleteSilence(silences[i].ID); err != nil {
+			return fmt.Errorf("alerting: failed deleting silence `%s`: %w", silences[i].ID, err)
+		}
+		silences = append(silences[:i], silences[i+1:]...)
+		i--
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	for _, sl := range silences {
+		e.silences[sl.ID] = sl
+	}
+
+	e.rules = make([]Rule, 0, len(byName))
+	for _, r := range byName {
+		e.rules = append(e.rules, r)
+	}
+	sortRules(e.rules)
+	e.store = s
+
+	return nil
+}
+
+// Returns all rules sorted by name.
+func (e *engine) Rules() []Rule {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+
+	rules := make([]Rule, len(e.rules))
+	copy(rules, e.rules)
+	sortRules(rules)
+	return rules
+}
+
+func (e *engine) Rule(name string) (Rule, error) {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+
+	i := e.ruleIndex(name)
+	if i < 0 {
+		return Rule{}, ErrorRuleNotFound
+	}
+	return e.rules[i], nil
+}
+
+func (e *engine) AddRule(r Rule) (Rule, error) {
+	if err := r.Validate(); err != nil {
+		return r, err
+	}
+
+	e.writeMx.Lock()
+	defer e.writeMx.Unlock()
+
+	if _, err := e.Rule(r.Name); err == nil {
+		return r, fmt.Errorf("`%s`: %w", r.Name, ErrorRuleExists)
+	}
+	if err := e.checkRule(r); err != nil {
+		return r, err
+	}
+	if err := e.save(r); err != nil {
+		return r, err
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	e.rules = append(e.rules, r)
+
+	return r, nil
+}
+
+// Replaces the rule, its alert is evaluated against the new rule next time.
+func (e *engine) UpdateRule(name string, r Rule) (Rule, error) {
+	if r.Name == "" {
+		r.Name = name
+	}
+	if r.Name != name {
+		return r, fmt.Errorf("rule can't be renamed. %w", ErrorBadRule)
+	}
+	if err := r.Validate(); err != nil {
+		return r, err
+	}
+
+	e.writeMx.Lock()
+	defer e.writeMx.Unlock()
+
+	if _, err := e.Rule(name); err != nil {
+		return r, fmt.Errorf("`%s`: %w", name, err)
+	}
+	if err := e.checkRule(r); err != nil {
+		return r, err
+	}
+	if err := e.save(r); err != nil {
+		return r, err
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	e.rules[e.ruleIndex(name)] = r
+
+	return r, nil
+}
+
+// Deletes the rule and its alert.
+func (e *engine) DeleteRule(name string) error {
+	e.writeMx.Lock()
+	defer e.writeMx.Unlock()
+
+	if _, err := e.Rule(name); err != nil {
+		return fmt.Errorf("`%s`: %w", name, err)
+	}
+	if e.store != nil {
+		if err := e.store.DeleteRule(name); err != nil {
+			return fmt.Errorf("alerting: failed deleting rule `%s`: %w", name, err)
+		}
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	i := e.ruleIndex(name)
+	e.rules = append(e.rules[:i], e.rules[i+1:]...)
+	for key, a := range e.alerts {
+		if a.Rule.Name == name {
+			delete(e.alerts, key)
+		}
+	}
+
+	return nil
+}
+
+// ============ Not exported
+
+func (e *engine) checkRule(r Rule) error {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+
+	if err := e.checkHistory(r); err != nil {
+		return fmt.Errorf("`%s`: %w", r.Name, err)
+	}
+	return nil
+}
+
+// Must be called holding `writeMx`.
+func (e *engine) save(r Rule) error {
+	if e.store == nil {
+		return nil
+	}
+	if err := e.store.SaveRule(r); err != nil {
+		return fmt.Errorf("alerting: failed saving rule `%s`: %w", r.Name, err)
+	}
+	return nil
+}
+
+// Returns -1 if there is no rule with the name.
+func (e *engine) ruleIndex(name string) int {
+	for i, r := range e.rules {
+		if r.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func sortRules(rules []Rule) {
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Name < rules[j].Name
+	})
+}
@@ -0,0 +1,235 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/retry"
+)
+
+// Header with the hex HMAC-SHA256 of the payload, like `sha256=<hex>`.
+const SignatureHeader = "X-Signature"
+
+// Delivery retries, the interval doubles after every failed attempt.
+const webhookMaxAttempts = 4
+
+var webhookBackoff = retry.Backoff{InitialInterval: 200 * time.Millisecond, MaxInterval: 5 * time.Second}
+
+// Body of the webhook request.
+type Notification struct {
+	Status    State     `json:"status"` // `firing` if any of alerts is firing, `resolved` otherwise
+	Alerts    []Alert   `json:"alerts"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Posts alerts to webhook URLs. Alerts are grouped during the window: if the alert
+// changed its state several times, only the latest state is sent, and only if it differs
+// from the state already sent, so flapping alerts don't flood receivers.
+// Delivery is tracked per URL: a failing receiver doesn't make others get duplicates.
+type webhook struct {
+	ctx    context.Context
+	urls   []string
+	key    []byte
+	window time.Duration
+	client *http.Client
+	queued chan struct{} // wakes up `Run` if there is no window
+
+	mx      sync.Mutex
+	pending map[string]map[string]Alert // the latest alerts of the window by URL and alert
+	sent    map[string]map[string]State // delivered states by URL and alert
+}
+
+// Options of the webhook notifier.
+type WebhookOptions struct {
+	URLs   []string // alert notifications are sent to all of them
+	Key    string   // signs notifications with HMAC-SHA256 if set
+	Window time.Duration
+}
+
+func NewWebhook(ctx context.Context, opts WebhookOptions) *webhook {
+	w := &webhook{
+		ctx:     ctx,
+		urls:    opts.URLs,
+		key:     []byte(opts.Key),
+		window:  opts.Window,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queued:  make(chan struct{}, 1),
+		pending: make(map[string]map[string]Alert),
+		sent:    make(map[string]map[string]State),
+	}
+	for _, url := range w.urls {
+		w.pending[url] = make(map[string]Alert)
+		w.sent[url] = make(map[string]State)
+	}
+	return w
+}
+
+// Queues alerts till the end of the window, or till `Run` picks them up if there is no window.
+// Never sends anything itself, so rules evaluation isn't blocked by slow receivers.
+func (w *webhook) Notify(alerts []Alert) {
+	w.mx.Lock()
+	for _, url := range w.urls {
+		for _, a := range alerts {
+			w.pending[url][a.key()] = a
+		}
+	}
+	w.mx.Unlock()
+
+	if w.window <= 0 {
+		select {
+		case w.queued <- struct{}{}:
+		default: // `Run` is already woken up
+		}
+	}
+}
+
+// Sends queued alerts at the end of every window, or as soon as they are queued
+// if there is no window, until the context is done.
+func (w *webhook) Run() {
+	var tick <-chan time.Time
+	if w.window > 0 {
+		ticker := time.NewTicker(w.window)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			log.Println("Webhook notifier stopped.")
+			return
+		case <-tick:
+			w.Flush()
+		case <-w.queued:
+			w.Flush()
+		}
+	}
+}
+
+// Sends queued alerts whose state differs from the one delivered to the URL.
+func (w *webhook) Flush() {
+	for _, url := range w.urls {
+		w.flush(url)
+	}
+}
+
+// Returns the hex HMAC-SHA256 of the body, receivers use it to check the `X-Signature` header.
+func Sign(key, body []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ============ Not exported
+
+func (w *webhook) flush(url string) {
+	alerts := w.takePending(url)
+	if len(alerts) == 0 {
+		return
+	}
+
+	n := Notification{Status: StateResolved, Alerts: alerts, Timestamp: time.Now()}
+	for _, a := range alerts {
+		if a.State == StateFiring {
+			n.Status = StateFiring
+		}
+	}
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		logger.Log(w.ctx).Errorf("alerting: failed marshaling notification: %v", err)
+		return
+	}
+
+	err = w.post(url, body)
+	if err != nil {
+		logger.Log(w.ctx).Errorf("alerting: failed notifying `%s`: %v", url, err)
+	}
+
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	for _, a := range alerts {
+		if err == nil {
+			w.sent[url][a.key()] = a.State
+			continue
+		}
+		// try again with the next window unless there is a newer state
+		if _, ok := w.pending[url][a.key()]; !ok {
+			w.pending[url][a.key()] = a
+		}
+	}
+}
+
+// Returns alerts queued for the URL which aren't delivered yet sorted by rule name and series and clears the queue.
+func (w *webhook) takePending(url string) []Alert {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	alerts := []Alert{}
+	for key, a := range w.pending[url] {
+		if w.sent[url][key] == a.State {
+			continue
+		}
+		alerts = append(alerts, a)
+	}
+	w.pending[url] = make(map[string]Alert)
+
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].key() < alerts[j].key()
+	})
+	return alerts
+}
+
+// Posts the body retrying on network errors, 5xx and 429.
+func (w *webhook) post(url string, body []byte) error {
+	var err error
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		var retryable bool
+		retryable, err = w.tryPost(url, body)
+		if err == nil || !retryable || attempt == webhookMaxAttempts {
+			break
+		}
+		if ctxErr := retry.Sleep(w.ctx, webhookBackoff.Delay(attempt)); ctxErr != nil {
+			return fmt.Errorf("%w, last error: %v", ctxErr, err)
+		}
+	}
+	return err
+}
+
+func (w *webhook) tryPost(url string, body []byte) (retryable bool, err error) {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.key) > 0 {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(w.key, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return !errors.Is(err, context.Canceled), err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	return retry.IsRetryableStatus(resp.StatusCode), fmt.Errorf("receiver responded with status %d", resp.StatusCode)
+}
@@ -0,0 +1,215 @@
+package alerting_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/alerting"
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+)
+
+// Keeps notifications received by the test webhook.
+type receiver struct {
+	mx            sync.Mutex
+	notifications []alerting.Notification
+	failures      int // the first requests are answered with `failStatus`
+	failStatus    int // 503 by default
+}
+
+func (rc *receiver) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+
+	if rc.failures > 0 {
+		rc.failures--
+		if rc.failStatus == 0 {
+			rc.failStatus = http.StatusServiceUnavailable
+		}
+		rw.WriteHeader(rc.failStatus)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get(alerting.SignatureHeader) != "sha256="+alerting.Sign([]byte("secret"), body) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	n := alerting.Notification{}
+	if err := json.Unmarshal(body, &n); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rc.notifications = append(rc.notifications, n)
+}
+
+func (rc *receiver) received() []alerting.Notification {
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+	return rc.notifications
+}
+
+func alert(state alerting.State) alerting.Alert {
+	return alerting.Alert{
+		Rule:     alerting.Rule{Name: "HighAlloc", MetricType: "gauge", MetricName: "Alloc"},
+		State:    state,
+		Value:    150,
+		ActiveAt: time.Now(),
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	logger.Run("error")
+
+	tests := []struct {
+		name     string
+		key      string
+		failures int
+		windows  [][]alerting.State // states notified during every window
+		want     []alerting.State   // statuses of received notifications
+	}{
+		{
+			name:    "test firing and resolved",
+			key:     "secret",
+			windows: [][]alerting.State{{alerting.StateFiring}, {alerting.StateResolved}},
+			want:    []alerting.State{alerting.StateFiring, alerting.StateResolved},
+		},
+		{
+			name: "test flapping rule is sent once",
+			key:  "secret",
+			windows: [][]alerting.State{
+				{alerting.StateFiring},
+				{alerting.StateResolved, alerting.StateFiring},
+				{alerting.StateResolved, alerting.StateFiring, alerting.StateResolved},
+			},
+			want: []alerting.State{alerting.StateFiring, alerting.StateResolved},
+		},
+		{
+			name:     "test retry",
+			key:      "secret",
+			failures: 2,
+			windows:  [][]alerting.State{{alerting.StateFiring}},
+			want:     []alerting.State{alerting.StateFiring},
+		},
+		{
+			name:    "test bad signature",
+			key:     "wrong",
+			windows: [][]alerting.State{{alerting.StateFiring}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &receiver{failures: tt.failures}
+			srv := httptest.NewServer(rc)
+			defer srv.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			webhook := alerting.NewWebhook(ctx, alerting.WebhookOptions{
+				URLs:   []string{srv.URL},
+				Key:    tt.key,
+				Window: time.Minute, // flushed manually
+			})
+			for _, states := range tt.windows {
+				for _, s := range states {
+					webhook.Notify([]alerting.Alert{alert(s)})
+				}
+				webhook.Flush()
+			}
+
+			got := rc.received()
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected %d notifications, got %d", len(tt.want), len(got))
+			}
+			for i, n := range got {
+				if n.Status != tt.want[i] {
+					t.Errorf("Expected status `%s`, got `%s`", tt.want[i], n.Status)
+				}
+				if len(n.Alerts) != 1 || n.Alerts[0].Rule.Name != "HighAlloc" || n.Alerts[0].Value != 150 {
+					t.Errorf("Unexpected alerts %+v", n.Alerts)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookDeliveryPerURL(t *testing.T) {
+	logger.Run("error")
+
+	healthy := &receiver{}
+	failing := &receiver{failures: 1, failStatus: http.StatusBadRequest} // not retried within the window
+	healthySrv, failingSrv := httptest.NewServer(healthy), httptest.NewServer(failing)
+	defer healthySrv.Close()
+	defer failingSrv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	webhook := alerting.NewWebhook(ctx, alerting.WebhookOptions{
+		URLs:   []string{healthySrv.URL, failingSrv.URL},
+		Key:    "secret",
+		Window: time.Minute, // flushed manually
+	})
+	webhook.Notify([]alerting.Alert{alert(alerting.StateFiring)})
+	webhook.Flush()
+	webhook.Flush() // the failed delivery is repeated for its URL only
+
+	if got := len(healthy.received()); got != 1 {
+		t.Errorf("Expected 1 notification for the healthy receiver, got %d", got)
+	}
+	if got := len(failing.received()); got != 1 {
+		t.Errorf("Expected 1 notification for the recovered receiver, got %d", got)
+	}
+}
+
+func TestWebhookWithoutWindow(t *testing.T) {
+	logger.Run("error")
+
+	rc := &receiver{}
+	blocked := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-blocked // a slow receiver
+		rc.ServeHTTP(rw, r)
+	}))
+	defer srv.Close()
+	defer close(blocked)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	webhook := alerting.NewWebhook(ctx, alerting.WebhookOptions{
+		URLs: []string{srv.URL},
+		Key:  "secret",
+	})
+	go webhook.Run()
+
+	notified := make(chan struct{})
+	go func() {
+		webhook.Notify([]alerting.Alert{alert(alerting.StateFiring)})
+		close(notified)
+	}()
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify is blocked by the receiver")
+	}
+
+	blocked <- struct{}{}
+	for deadline := time.Now().Add(5 * time.Second); len(rc.received()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the notification sent by `Run`")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
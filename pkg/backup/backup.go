@@ -1,8 +1,9 @@
-// Package `backup` can dump metrics intervally from `sourcer` to `storer`.
+// Package `backup` can dump metrics intervally from `Sourcer` to `Storer`.
 package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -13,13 +14,14 @@ import (
 
 type (
 	// `worker` is responsible for interval saving and graceful termination.
-	// It dumps metrics intervally from a `sourcer` to a `storer`.
+	// It dumps metrics intervally from a `Sourcer` to a `Storer`.
 	worker struct {
 		ctx        context.Context
 		terminated chan<- bool
-		ticker     time.Ticker
+		ticker     *time.Ticker // nil if metrics are dumped on termination only
 		source     Sourcer
-		storage    storer
+		storage    Storer
+		wal        *WAL // updates since the latest dump, nil if not used
 	}
 
 	// Source of data to dump and destination to restore
@@ -29,33 +31,64 @@ type (
 	}
 
 	// Persistent storage: destination to dump and source to restore
-	storer interface {
+	Storer interface {
 		ReadAll() ([]models.Metrics, error)
 		SaveAll([]models.Metrics) error
 	}
+
+	// Source which reads with the given context, so it can be dumped after the worker context is done
+	contextSourcer interface {
+		GetAllContext(ctx context.Context) ([]models.Metrics, error)
+	}
+
+	// Storage keeping older snapshots to restore from
+	generationStorer interface {
+		ReadAt(at time.Time) ([]models.Metrics, error)
+	}
+
+	// Storage keeping the sequence number of the latest logged update in the snapshot,
+	// so updates which are in the snapshot aren't replayed
+	seqStorer interface {
+		ReadAllWithSeq() ([]models.Metrics, uint64, error)
+		SaveAllWithSeq(metrics []models.Metrics, walSeq uint64) error
+	}
 )
 
-func New(ctx context.Context, terminated chan<- bool, source Sourcer, storage storer) *worker {
+// Time to read metrics for the final dump, the worker context is done by then.
+const terminationDumpTimeout = 30 * time.Second
+
+// `wal` is optional, it is replayed after restoring, truncated after every dump
+// and closed on termination. `terminated` isn't used if the worker isn't run.
+func New(ctx context.Context, terminated chan<- bool, source Sourcer, storage Storer, wal *WAL) *worker {
 	return &worker{
 		ctx:        ctx,
 		terminated: terminated,
 		source:     source,
 		storage:    storage,
+		wal:        wal,
 	}
 }
 
-func (w worker) Run(shouldRestore bool, storeInterval time.Duration) {
+// Restores the latest snapshot or, if `restoreAt` is set, the one taken at or before that time.
+// Restoring and replaying are done before returning, so updates should be accepted after that.
+// Dumps are made in the background until the context is done.
+func (w worker) Run(shouldRestore bool, restoreAt time.Time, storeInterval time.Duration) {
+	var dumped uint64 // sequence number of the latest logged update in the snapshot
 	if shouldRestore {
-		err := w.restore()
+		seq, err := w.restore(restoreAt)
 		if err != nil {
 			log.Println("can't restore from a file", err)
 		}
+		dumped = seq
 		log.Println("restored from file.")
 	}
+	if w.wal != nil {
+		w.replay(shouldRestore && restoreAt.IsZero(), dumped)
+	}
 
 	// Interval saving & restoring from a file
 	if storeInterval > 0 {
-		w.ticker = *time.NewTicker(storeInterval)
+		w.ticker = time.NewTicker(storeInterval)
 		go w.dumpPeriodically()
 	}
 
@@ -64,11 +97,16 @@ func (w worker) Run(shouldRestore bool, storeInterval time.Duration) {
 
 // Runs interval timer for saving metrics to persistent storage.
 func (w worker) dumpPeriodically() {
-	defer w.ticker.Stop()
-	for range w.ticker.C {
-		if err := w.dump(); err != nil {
-			logger.Log(w.ctx).Errorf("failed saved to file on termination: %v", err)
+	for {
+		select {
+		case <-w.ctx.Done():
 			return
+		case <-w.ticker.C:
+		}
+		if err := w.Dump(); err != nil {
+			// the next tick tries again
+			logger.Log(w.ctx).Errorf("failed saving to persistent storage: %v", err)
+			continue
 		}
 		log.Println("Successfully saved to file.")
 	}
@@ -77,40 +115,122 @@ func (w worker) dumpPeriodically() {
 // Handles program termination: stops interval saving and dumps the latest metrics snapshot.
 func (w worker) handleTermination() {
 	<-w.ctx.Done()
-	w.ticker.Stop()
-	log.Println("Saving timer stopped.")
-	if err := w.dump(); err != nil {
+	if w.ticker != nil {
+		w.ticker.Stop()
+		log.Println("Saving timer stopped.")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), terminationDumpTimeout)
+	defer cancel()
+	if err := w.dump(ctx); err != nil {
 		logger.Log(w.ctx).Errorf("failed saved to file on termination: %v", err)
-		w.terminated <- true
-		return
+	} else {
+		log.Println("Successfully saved to file. Terminating.")
+	}
+	if w.wal != nil {
+		if err := w.wal.Close(); err != nil {
+			logger.Log(w.ctx).Errorf("backup: %v", err)
+		}
 	}
-	log.Println("Successfully saved to file. Terminating.")
 	w.terminated <- true
 }
 
-// Reads metrics from persistent `storer` and loads into `sourcer`.
-func (w worker) restore() error {
-	restoredMetrics, err := w.storage.ReadAll()
-	if err != nil {
-		return fmt.Errorf("can't restore data from storage: %w", err)
-	}
-
-	errR := w.source.BulkUpdate(restoredMetrics)
-	if errR != nil {
-		return fmt.Errorf("can't restore data from storage: %w", err)
-	}
+// Reads metrics from persistent `Storer` and loads into `Sourcer`, the latest ones if `at` is zero.
+// Counters are added to the ones in `sourcer`.
+func (w worker) Restore(at time.Time) error {
+	_, err := w.restore(at)
+	return err
+}
 
-	return nil
+// Saves all data from source to storage, then drops the logged updates which are saved.
+func (w worker) Dump() error {
+	return w.dump(w.ctx)
 }
 
-// Saves all data from source to storage
-func (w worker) dump() error {
-	metrics, err := w.source.GetAll()
+// ============ Not exported
+
+// Same as `Dump`, the source is read with `ctx` if it supports that.
+func (w worker) dump(ctx context.Context) error {
+	getAll := w.source.GetAll
+	if cs, ok := w.source.(contextSourcer); ok {
+		getAll = func() ([]models.Metrics, error) {
+			return cs.GetAllContext(ctx)
+		}
+	}
+
+	var metrics []models.Metrics
+	var logged int64
+	var seq uint64
+	var err error
+	if w.wal != nil {
+		metrics, logged, seq, err = w.wal.checkpoint(getAll)
+	} else {
+		metrics, err = getAll()
+	}
 	if err != nil {
 		return fmt.Errorf("backup: failed getting metrics: %w", err)
 	}
-	if err := w.storage.SaveAll(metrics); err != nil {
+	if ss, ok := w.storage.(seqStorer); ok && w.wal != nil {
+		err = ss.SaveAllWithSeq(metrics, seq)
+	} else {
+		err = w.storage.SaveAll(metrics)
+	}
+	if err != nil {
 		return fmt.Errorf("backup: failed saving to persistent storage: %w", err)
 	}
+	if w.wal != nil {
+		if err := w.wal.truncate(logged); err != nil {
+			return fmt.Errorf("backup: %w", err)
+		}
+	}
 	return nil
 }
+
+// Returns the sequence number of the latest logged update in the restored snapshot, 0 for older generations.
+func (w worker) restore(at time.Time) (uint64, error) {
+	var restoredMetrics []models.Metrics
+	var seq uint64
+	var err error
+	if at.IsZero() {
+		restoredMetrics, seq, err = w.read()
+	} else if gs, ok := w.storage.(generationStorer); ok {
+		restoredMetrics, err = gs.ReadAt(at)
+	} else {
+		err = errors.New("storage doesn't keep generations")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("can't restore data from storage: %w", err)
+	}
+
+	if err := w.source.BulkUpdate(restoredMetrics); err != nil {
+		return 0, fmt.Errorf("can't restore data from storage: %w", err)
+	}
+	return seq, nil
+}
+
+// Reads the latest snapshot with the sequence number of the latest logged update in it if the storage keeps it.
+func (w worker) read() ([]models.Metrics, uint64, error) {
+	if ss, ok := w.storage.(seqStorer); ok {
+		return ss.ReadAllWithSeq()
+	}
+	metrics, err := w.storage.ReadAll()
+	return metrics, 0, err
+}
+
+// Applies updates logged after the latest dump. Without restoring they are dropped
+// as well as on restoring an older generation which they don't follow.
+// `dumped` is the sequence number of the restored snapshot.
+func (w worker) replay(apply bool, dumped uint64) {
+	if !apply {
+		// the next snapshot replaces the latest one, so records follow it
+		if _, seq, err := w.read(); err == nil {
+			dumped = seq
+		}
+		if err := w.wal.reset(dumped); err != nil {
+			logger.Log(w.ctx).Errorf("backup: failed dropping WAL: %v", err)
+		}
+		return
+	}
+	if err := w.wal.replay(w.source.BulkUpdate, dumped); err != nil {
+		logger.Log(w.ctx).Errorf("backup: failed replaying WAL: %v", err)
+	}
+}
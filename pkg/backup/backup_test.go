@@ -0,0 +1,120 @@
+package backup_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/backup"
+	"github.com/amiskov/metrics-and-alerting/pkg/backup/filestore"
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/inmem"
+)
+
+func TestTerminationDump(t *testing.T) {
+	logger.Run("error")
+	store, _, err := filestore.New(filepath.Join(t.TempDir(), "db.json"), filestore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	source := &contextSource{DB: inmem.New(ctx, nil), ctx: ctx}
+	if err := source.BulkUpdate([]models.Metrics{counter("PollCount", 2)}); err != nil {
+		t.Fatal(err)
+	}
+	terminated := make(chan bool, 1)
+	backup.New(ctx, terminated, source, store, nil).Run(false, time.Time{}, 0)
+
+	cancel()
+	select {
+	case <-terminated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Backup worker didn't terminate")
+	}
+
+	metrics, err := store.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 || *metrics[0].Delta != 2 {
+		t.Errorf("Expected `PollCount` dumped on termination, got %+v", metrics)
+	}
+}
+
+func TestDumpAfterError(t *testing.T) {
+	logger.Run("error")
+	store, _, err := filestore.New(filepath.Join(t.TempDir(), "db.json"), filestore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky := &flakyStore{fileStore: store, failures: 2, saved: make(chan bool, 1)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mem := inmem.New(ctx, nil)
+	if err := mem.BulkUpdate([]models.Metrics{counter("PollCount", 2)}); err != nil {
+		t.Fatal(err)
+	}
+	terminated := make(chan bool, 1)
+	backup.New(ctx, terminated, mem, flaky, nil).Run(false, time.Time{}, 10*time.Millisecond)
+
+	select {
+	case <-flaky.saved:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected dumping to go on after failures")
+	}
+	cancel()
+	<-terminated
+}
+
+type fileStore interface {
+	ReadAll() ([]models.Metrics, error)
+	SaveAll([]models.Metrics) error
+}
+
+// Fails the first saves.
+type flakyStore struct {
+	fileStore
+	mx       sync.Mutex
+	failures int
+	saved    chan bool
+}
+
+func (s *flakyStore) SaveAll(metrics []models.Metrics) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("unavailable")
+	}
+	if err := s.fileStore.SaveAll(metrics); err != nil {
+		return err
+	}
+	select {
+	case s.saved <- true:
+	default:
+	}
+	return nil
+}
+
+// Fails reading with the done context like Postgres does.
+type contextSource struct {
+	*inmem.DB
+	ctx context.Context
+}
+
+func (s *contextSource) GetAll() ([]models.Metrics, error) {
+	return s.GetAllContext(s.ctx)
+}
+
+func (s *contextSource) GetAllContext(ctx context.Context) ([]models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.DB.GetAll()
+}
@@ -1,76 +1,369 @@
 package filestore
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/amiskov/metrics-and-alerting/pkg/alerting"
 	"github.com/amiskov/metrics-and-alerting/pkg/models"
 )
 
 type fileStorage struct {
-	mx   *sync.RWMutex
-	file *os.File
+	mx       *sync.RWMutex
+	path     string
+	opts     Options
+	loaded   bool
+	valid    bool     // the file at `path` is readable, so it's kept as the previous one on write
+	snapshot snapshot // the latest file contents
+}
+
+// File contents. Files written by older versions contain only the array of metrics.
+type snapshot struct {
+	Metrics  []models.Metrics   `json:"metrics"`
+	Rules    []alerting.Rule    `json:"rules"`
+	Silences []alerting.Silence `json:"silences"`
+	WALSeq   uint64             `json:"wal_seq,omitempty"` // the latest write-ahead log record in the snapshot
 }
 
 type closer func() error
 
-func New(filePath string) (*fileStorage, closer, error) {
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0o777)
+type Options struct {
+	Checksum    bool          // the file starts with a `#sha256:<hex>` line over the JSON below it
+	Generations int           // timestamped copies of snapshots to keep, none if 0
+	MaxAge      time.Duration // generations older than that are removed, kept forever if 0
+	Gzip        bool          // compress generations
+}
+
+// Snapshots are written to a temporary file and renamed over `filePath`,
+// the replaced file is kept as `<filePath>.prev` to fall back to if the latest one is broken.
+// If both files are broken, nothing is written until they are fixed or removed.
+func New(filePath string, opts Options) (*fileStorage, closer, error) {
+	dir, err := os.Stat(filepath.Dir(filePath))
 	if err != nil {
 		return nil, nil, err
 	}
+	if !dir.IsDir() {
+		return nil, nil, fmt.Errorf("`%s` is not a directory", filepath.Dir(filePath))
+	}
 	s := fileStorage{
-		mx:   new(sync.RWMutex),
-		file: file,
+		mx:       new(sync.RWMutex),
+		path:     filePath,
+		opts:     opts,
+		snapshot: snapshot{Metrics: []models.Metrics{}, Rules: []alerting.Rule{}, Silences: []alerting.Silence{}},
 	}
-	log.Printf("Using `%s` as a storage.\n", file.Name())
-	return &s, file.Close, err
+	log.Printf("Using `%s` as a storage.\n", filePath)
+	// files are opened for every read and write, nothing to close
+	return &s, func() error { return nil }, nil
 }
 
 // Decodes JSON from the file
 func (fs *fileStorage) ReadAll() ([]models.Metrics, error) {
-	fs.mx.RLock()
-	defer fs.mx.RUnlock()
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
 
-	storedMetrics := []models.Metrics{}
-	dec := json.NewDecoder(fs.file)
-	err := dec.Decode(&storedMetrics)
-	if err != nil && !errors.Is(err, io.EOF) {
-		return nil, fmt.Errorf("failed restoring metrics from file `%s`: %w", fs.file.Name(), err)
+	if err := fs.load(); err != nil {
+		return nil, err
 	}
-	return storedMetrics, nil
+	return fs.snapshot.Metrics, nil
+}
+
+// Also returns the sequence number of the latest write-ahead log record in the snapshot.
+func (fs *fileStorage) ReadAllWithSeq() ([]models.Metrics, uint64, error) {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+
+	if err := fs.load(); err != nil {
+		return nil, 0, err
+	}
+	return fs.snapshot.Metrics, fs.snapshot.WALSeq, nil
 }
 
 func (fs *fileStorage) SaveAll(metrics []models.Metrics) error {
+	return fs.SaveAllWithSeq(metrics, 0)
+}
+
+// Saves metrics with the sequence number of the latest write-ahead log record in them.
+func (fs *fileStorage) SaveAllWithSeq(metrics []models.Metrics, walSeq uint64) error {
 	fs.mx.Lock()
 	defer fs.mx.Unlock()
 
-	if _, err := fs.file.Stat(); err != nil {
-		log.Println("Can't save to file:", err)
+	// rules are stored in the file too, it isn't overwritten if they can't be read
+	if err := fs.load(); err != nil {
+		return fmt.Errorf("can't read file before saving: %w", err)
+	}
+
+	fs.snapshot.Metrics, fs.snapshot.WALSeq = metrics, walSeq
+	content, err := fs.write()
+	if err != nil {
 		return err
 	}
+	// generations are taken on dumps only, rule and silence edits don't push dumps out
+	if fs.opts.Generations > 0 {
+		if err := fs.writeGeneration(content, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Metrics dumped into file `%s`.\n", fs.path)
+
+	return nil
+}
 
-	if err := fs.file.Truncate(0); err != nil {
-		log.Println("Can't truncate file contents:", err)
+// Returns alert rules stored in the file, implements `alerting.RuleStore`.
+func (fs *fileStorage) LoadRules() ([]alerting.Rule, error) {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+	return fs.snapshot.Rules, nil
+}
+
+func (fs *fileStorage) SaveRule(r alerting.Rule) error {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+
+	if err := fs.load(); err != nil {
 		return err
 	}
 
-	if _, err := fs.file.Seek(0, 0); err != nil {
-		log.Println("Can't set the file offset:", err)
+	rules := make([]alerting.Rule, 0, len(fs.snapshot.Rules)+1)
+	for _, stored := range fs.snapshot.Rules {
+		if stored.Name != r.Name {
+			rules = append(rules, stored)
+		}
+	}
+	fs.snapshot.Rules = append(rules, r)
+
+	_, err := fs.write()
+	return err
+}
+
+func (fs *fileStorage) DeleteRule(name string) error {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+
+	if err := fs.load(); err != nil {
+		return err
+	}
+
+	rules := make([]alerting.Rule, 0, len(fs.snapshot.Rules))
+	for _, stored := range fs.snapshot.Rules {
+		if stored.Name != name {
+			rules = append(rules, stored)
+		}
+	}
+	fs.snapshot.Rules = rules
+
+	_, err := fs.write()
+	return err
+}
+
+// Returns alert silences stored in the file, implements `alerting.RuleStore`.
+func (fs *fileStorage) LoadSilences() ([]alerting.Silence, error) {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+	return fs.snapshot.Silences, nil
+}
+
+func (fs *fileStorage) SaveSilence(sl alerting.Silence) error {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+
+	if err := fs.load(); err != nil {
+		return err
+	}
+
+	silences := make([]alerting.Silence, 0, len(fs.snapshot.Silences)+1)
+	for _, stored := range fs.snapshot.Silences {
+		if stored.ID != sl.ID {
+			silences = append(silences, stored)
+		}
+	}
+	fs.snapshot.Silences = append(silences, sl)
+
+	_, err := fs.write()
+	return err
+}
+
+func (fs *fileStorage) DeleteSilence(id string) error {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+
+	if err := fs.load(); err != nil {
 		return err
 	}
 
-	if err := json.NewEncoder(fs.file).Encode(metrics); err != nil {
-		log.Printf("Can't store to file `%s`: %s.\n", fs.file.Name(), err)
+	silences := make([]alerting.Silence, 0, len(fs.snapshot.Silences))
+	for _, stored := range fs.snapshot.Silences {
+		if stored.ID != id {
+			silences = append(silences, stored)
+		}
+	}
+	fs.snapshot.Silences = silences
+
+	_, err := fs.write()
+	return err
+}
+
+// ============ Not exported
+
+const checksumPrefix = "#sha256:"
+
+// Reads the file once, the snapshot is kept up to date by writes then.
+// Falls back to the previous file if the latest one is corrupted or partially written.
+// Files which can't be read are read again next time, so they are never overwritten.
+func (fs *fileStorage) load() error {
+	if fs.loaded {
+		return nil
+	}
+
+	s, err := readSnapshot(fs.path)
+	if err == nil {
+		fs.snapshot, fs.loaded, fs.valid = s, true, true
+		return nil
+	}
+
+	prev, prevErr := readSnapshot(prevPath(fs.path))
+	if prevErr != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if errors.Is(prevErr, os.ErrNotExist) {
+			fs.loaded = true // nothing stored yet
+			return nil
+		}
+		return prevErr
+	}
+	log.Printf("Can't read file `%s`, restored from the previous one: %s.\n", fs.path, err)
+	fs.snapshot, fs.loaded = prev, true
+	return nil
+}
+
+// Writes the snapshot to a temporary file and renames it over the current one.
+// Returns the written contents.
+func (fs *fileStorage) write() ([]byte, error) {
+	content, err := json.Marshal(fs.snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding snapshot: %w", err)
+	}
+	if fs.opts.Checksum {
+		sum := sha256.Sum256(content)
+		content = append([]byte(checksumPrefix+hex.EncodeToString(sum[:])+"\n"), content...)
+	}
+
+	tmpPath := fs.path + ".tmp"
+	if err := writeSynced(tmpPath, content); err != nil {
+		log.Printf("Can't store to file `%s`: %s.\n", tmpPath, err)
+		return nil, err
+	}
+
+	// the file stays in place until it's replaced, the broken one isn't kept over the good previous one
+	if fs.valid {
+		if err := linkOrCopy(fs.path, prevPath(fs.path)); err != nil {
+			return nil, fmt.Errorf("failed keeping previous file: %w", err)
+		}
+	}
+	if err := os.Rename(tmpPath, fs.path); err != nil {
+		return nil, fmt.Errorf("failed replacing file `%s`: %w", fs.path, err)
+	}
+	fs.valid = true
+	return content, syncDir(filepath.Dir(fs.path))
+}
+
+func prevPath(path string) string {
+	return path + ".prev"
+}
+
+// Reads the file with or without the checksum header, the header is verified if present.
+func readSnapshot(path string) (snapshot, error) {
+	s := snapshot{Metrics: []models.Metrics{}, Rules: []alerting.Rule{}, Silences: []alerting.Silence{}}
+	content, err := readFile(path)
+	if err != nil {
+		return s, fmt.Errorf("failed reading file `%s`: %w", path, err)
+	}
+
+	if bytes.HasPrefix(content, []byte(checksumPrefix)) {
+		header, body, ok := bytes.Cut(content, []byte("\n"))
+		if !ok {
+			return s, fmt.Errorf("file `%s` is truncated", path)
+		}
+		sum := sha256.Sum256(body)
+		if string(header[len(checksumPrefix):]) != hex.EncodeToString(sum[:]) {
+			return s, fmt.Errorf("file `%s` checksum mismatch", path)
+		}
+		content = body
+	}
+
+	content = bytes.TrimSpace(content)
+	switch {
+	case len(content) == 0:
+		return s, nil
+	case content[0] == '[':
+		err = json.Unmarshal(content, &s.Metrics)
+	default:
+		err = json.Unmarshal(content, &s)
+	}
+	if err != nil {
+		return s, fmt.Errorf("failed restoring metrics from file `%s`: %w", path, err)
+	}
+	return s, nil
+}
+
+// Makes `dst` a hard link to `src`, or its copy if the file system has no links.
+func linkOrCopy(src, dst string) error {
+	if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeSynced(dst, content)
+}
 
-	log.Printf("Metrics dumped into file `%s`.\n", fs.file.Name())
+func writeSynced(path string, content []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
 
+// Makes renames in the directory durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("failed syncing directory `%s`: %w", path, err)
+	}
 	return nil
 }
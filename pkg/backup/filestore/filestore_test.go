@@ -0,0 +1,244 @@
+package filestore_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/alerting"
+	"github.com/amiskov/metrics-and-alerting/pkg/backup/filestore"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+func TestRulesAndSilencesSurviveDumps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	// file of the older version with metrics only
+	if err := os.WriteFile(path, []byte(`[{"id":"Alloc","type":"gauge","value":1.5}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, closeFile, err := filestore.New(path, filestore.Options{Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := fs.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 || metrics[0].ID != "Alloc" {
+		t.Fatalf("Expected metrics from the array file, got %+v", metrics)
+	}
+
+	rule := alerting.Rule{Name: "HighAlloc", MetricType: models.MGauge, MetricName: "Alloc", Comparison: ">"}
+	if err := fs.SaveRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SaveRule(alerting.Rule{Name: "Temporary"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteRule("Temporary"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SaveSilence(alerting.Silence{ID: "s1", MetricName: "Alloc"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SaveSilence(alerting.Silence{ID: "s2", MetricName: "Temporary"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteSilence("s2"); err != nil {
+		t.Fatal(err)
+	}
+	delta := int64(3)
+	if err := fs.SaveAll([]models.Metrics{{ID: "PollCount", MType: models.MCounter, Delta: &delta}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, closeReopened, err := filestore.New(path, filestore.Options{Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeReopened()
+
+	rules, err := reopened.LoadRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Name != "HighAlloc" {
+		t.Errorf("Expected the saved rule, got %+v", rules)
+	}
+
+	silences, err := reopened.LoadSilences()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(silences) != 1 || silences[0].ID != "s1" {
+		t.Errorf("Expected the saved silence, got %+v", silences)
+	}
+
+	metrics, err = reopened.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 || metrics[0].ID != "PollCount" {
+		t.Errorf("Expected the dumped metrics, got %+v", metrics)
+	}
+}
+
+func TestFallbackToPreviousFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum bool
+		corrupt  func(content []byte) []byte
+	}{
+		{
+			name:     "test partially written file",
+			checksum: true,
+			corrupt:  func(content []byte) []byte { return content[:len(content)-10] },
+		},
+		{
+			name:     "test changed file",
+			checksum: true,
+			corrupt: func(content []byte) []byte {
+				return bytes.Replace(content, []byte("PollCount"), []byte("PollCounT"), 1)
+			},
+		},
+		{
+			name:    "test partially written file without checksum",
+			corrupt: func(content []byte) []byte { return content[:len(content)-10] },
+		},
+		{
+			name:     "test removed file",
+			checksum: true,
+			corrupt:  func(content []byte) []byte { return nil },
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db.json")
+			fs, _, err := filestore.New(path, filestore.Options{Checksum: tt.checksum})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, delta := range []int64{1, 2} {
+				delta := delta
+				if err := fs.SaveAll([]models.Metrics{{ID: "PollCount", MType: models.MCounter, Delta: &delta}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.checksum != bytes.HasPrefix(content, []byte("#sha256:")) {
+				t.Fatalf("Expected checksum header %v, got file %s", tt.checksum, content)
+			}
+			if corrupted := tt.corrupt(content); corrupted == nil {
+				err = os.Remove(path)
+			} else {
+				err = os.WriteFile(path, corrupted, 0o600)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reopened, _, err := filestore.New(path, filestore.Options{Checksum: tt.checksum})
+			if err != nil {
+				t.Fatal(err)
+			}
+			metrics, err := reopened.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(metrics) != 1 || metrics[0].Delta == nil || *metrics[0].Delta != 1 {
+				t.Errorf("Expected metrics from the previous file, got %+v", metrics)
+			}
+		})
+	}
+}
+
+func TestBrokenFilesAreKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	fs, _, err := filestore.New(path, filestore.Options{Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	save := func(fs interface {
+		SaveAll([]models.Metrics) error
+	}, delta int64) error {
+		return fs.SaveAll([]models.Metrics{{ID: "PollCount", MType: models.MCounter, Delta: &delta}})
+	}
+	for _, delta := range []int64{1, 2} {
+		if err := save(fs, delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the broken latest file isn't kept over the previous one
+	if err := os.WriteFile(path, []byte("#sha256:broken\n{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reopened, _, err := filestore.New(path, filestore.Options{Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := save(reopened, 3); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]int64{path: 3, path + ".prev": 1} {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(content, []byte(fmt.Sprintf(`"delta":%d`, want))) {
+			t.Errorf("Expected delta %d in `%s`, got %s", want, filepath.Base(file), content)
+		}
+	}
+
+	// nothing is written over both broken files
+	for _, file := range []string{path, path + ".prev"} {
+		if err := os.WriteFile(file, []byte("#sha256:broken\n{}"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopened, _, err = filestore.New(path, filestore.Options{Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := save(reopened, 4); err == nil {
+		t.Error("Expected error saving over broken files")
+	}
+	if err := reopened.SaveRule(alerting.Rule{Name: "HighAlloc"}); err == nil {
+		t.Error("Expected error saving the rule over broken files")
+	}
+	for _, file := range []string{path, path + ".prev"} {
+		if content, err := os.ReadFile(file); err != nil || string(content) != "#sha256:broken\n{}" {
+			t.Errorf("Expected `%s` kept, got %s, %v", filepath.Base(file), content, err)
+		}
+	}
+}
+
+func TestNoFiles(t *testing.T) {
+	fs, _, err := filestore.New(filepath.Join(t.TempDir(), "db.json"), filestore.Options{Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := fs.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 0 {
+		t.Errorf("Expected no metrics, got %+v", metrics)
+	}
+
+	if _, _, err := filestore.New(filepath.Join(t.TempDir(), "missing", "db.json"), filestore.Options{Checksum: true}); err == nil {
+		t.Error("Expected error for a missing directory")
+	}
+}
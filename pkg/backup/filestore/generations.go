@@ -0,0 +1,135 @@
+package filestore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+// Generations are named `<file>.<time>` or `<file>.<time>.gz`, the time is UTC.
+const generationLayout = "20060102T150405.000000000Z"
+
+type generation struct {
+	path string
+	time time.Time
+}
+
+// Returns metrics of the latest generation written at or before `at`.
+// Broken generations are skipped in favour of older ones.
+func (fs *fileStorage) ReadAt(at time.Time) ([]models.Metrics, error) {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+
+	gens, err := fs.generations()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range gens {
+		if g.time.After(at) {
+			continue
+		}
+		s, err := readSnapshot(g.path)
+		if err != nil {
+			log.Printf("Skipping generation `%s`: %s.\n", g.path, err)
+			continue
+		}
+		log.Printf("Restoring generation of %s.\n", g.time.Format(time.RFC3339))
+		return s.Metrics, nil
+	}
+	return nil, fmt.Errorf("no generation of `%s` at or before %s", fs.path, at.Format(time.RFC3339))
+}
+
+// ============ Not exported
+
+// Writes a new generation and removes ones beyond the retention count and age.
+func (fs *fileStorage) writeGeneration(content []byte, now time.Time) error {
+	path := fs.path + "." + now.UTC().Format(generationLayout)
+	if fs.opts.Gzip {
+		path += ".gz"
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(content); err != nil {
+			return fmt.Errorf("failed compressing generation: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed compressing generation: %w", err)
+		}
+		content = buf.Bytes()
+	}
+
+	tmpPath := path + ".tmp"
+	if err := writeSynced(tmpPath, content); err != nil {
+		return fmt.Errorf("failed writing generation `%s`: %w", path, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed writing generation `%s`: %w", path, err)
+	}
+
+	gens, err := fs.generations()
+	if err != nil {
+		return err
+	}
+	for i, g := range gens {
+		tooOld := fs.opts.MaxAge > 0 && now.Sub(g.time) > fs.opts.MaxAge
+		if i < fs.opts.Generations && !tooOld || g.path == path {
+			continue
+		}
+		if err := os.Remove(g.path); err != nil {
+			log.Printf("Can't remove generation `%s`: %s.\n", g.path, err)
+		}
+	}
+	return syncDir(filepath.Dir(fs.path))
+}
+
+// Returns generations of the file, the newest first.
+func (fs *fileStorage) generations() ([]generation, error) {
+	entries, err := os.ReadDir(filepath.Dir(fs.path))
+	if err != nil {
+		return nil, fmt.Errorf("failed listing generations: %w", err)
+	}
+
+	prefix := filepath.Base(fs.path) + "."
+	gens := []generation{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		t, err := time.Parse(generationLayout, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"))
+		if err != nil {
+			continue // `.prev`, `.tmp` and other files
+		}
+		gens = append(gens, generation{path: filepath.Join(filepath.Dir(fs.path), name), time: t})
+	}
+	sort.Slice(gens, func(i, j int) bool {
+		return gens[i].time.After(gens[j].time)
+	})
+	return gens, nil
+}
+
+// Reads the file decompressing `.gz` ones.
+func readFile(path string) ([]byte, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		return os.ReadFile(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
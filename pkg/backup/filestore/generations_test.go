@@ -0,0 +1,137 @@
+package filestore_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/alerting"
+	"github.com/amiskov/metrics-and-alerting/pkg/backup/filestore"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+func TestGenerations(t *testing.T) {
+	tests := []struct {
+		name string
+		opts filestore.Options
+	}{
+		{name: "test plain generations", opts: filestore.Options{Checksum: true, Generations: 2}},
+		{name: "test gzipped generations", opts: filestore.Options{Generations: 2, Gzip: true}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "db.json")
+			fs, _, err := filestore.New(path, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			times := []time.Time{}
+			for _, delta := range []int64{1, 2, 3} {
+				delta := delta
+				if err := fs.SaveAll([]models.Metrics{{ID: "PollCount", MType: models.MCounter, Delta: &delta}}); err != nil {
+					t.Fatal(err)
+				}
+				times = append(times, time.Now())
+			}
+
+			gens := generationFiles(t, dir)
+			if len(gens) != 2 {
+				t.Fatalf("Expected 2 generations, got %v", gens)
+			}
+			for _, g := range gens {
+				if tt.opts.Gzip != strings.HasSuffix(g, ".gz") {
+					t.Errorf("Expected gzip %v, got generation `%s`", tt.opts.Gzip, g)
+				}
+			}
+
+			for i, want := range []int64{2, 3} {
+				metrics, err := fs.ReadAt(times[i+1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(metrics) != 1 || *metrics[0].Delta != want {
+					t.Errorf("Expected delta %d at %s, got %+v", want, times[i+1], metrics)
+				}
+			}
+			// the first generation is removed
+			if _, err := fs.ReadAt(times[0]); err == nil {
+				t.Error("Expected no generation before the retained ones")
+			}
+		})
+	}
+}
+
+func TestGenerationsMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.json")
+	old := path + "." + time.Now().Add(-2*time.Hour).UTC().Format("20060102T150405.000000000Z")
+	if err := os.WriteFile(old, []byte(`{"metrics":[]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, _, err := filestore.New(path, filestore.Options{Generations: 10, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SaveAll([]models.Metrics{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Expected the old generation removed, got %v", err)
+	}
+	if gens := generationFiles(t, dir); len(gens) != 1 {
+		t.Errorf("Expected the new generation only, got %v", gens)
+	}
+}
+
+func TestRuleEditsKeepGenerations(t *testing.T) {
+	dir := t.TempDir()
+	fs, _, err := filestore.New(filepath.Join(dir, "db.json"), filestore.Options{Generations: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SaveAll([]models.Metrics{}); err != nil {
+		t.Fatal(err)
+	}
+	dumped := generationFiles(t, dir)
+
+	edits := []func() error{
+		func() error {
+			return fs.SaveRule(alerting.Rule{Name: "HighAlloc", MetricType: models.MGauge, MetricName: "Alloc", Comparison: ">", Threshold: 1})
+		},
+		func() error { return fs.DeleteRule("HighAlloc") },
+		func() error { return fs.SaveSilence(alerting.Silence{ID: "s1", MetricName: "Alloc"}) },
+		func() error { return fs.DeleteSilence("s1") },
+	}
+	for _, edit := range edits {
+		if err := edit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if gens := generationFiles(t, dir); !reflect.DeepEqual(gens, dumped) {
+		t.Errorf("Expected generations %v of the dump only, got %v", dumped, gens)
+	}
+}
+
+func generationFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gens := []string{}
+	for _, e := range entries {
+		if name := e.Name(); name != "db.json" && name != "db.json.prev" {
+			gens = append(gens, name)
+		}
+	}
+	return gens
+}
@@ -0,0 +1,270 @@
+// Package `s3store` keeps metrics snapshots in a bucket of S3-compatible object storage.
+// Every snapshot is a new object named by its UTC time, so the newest one has the greatest key.
+package s3store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+const (
+	keyLayout      = "20060102T150405.000000000Z"
+	keySuffix      = ".json"
+	requestTimeout = 30 * time.Second
+)
+
+type objectStorage struct {
+	client   *http.Client // requests aren't bound to the app context, so the final dump is uploaded
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	creds    Credentials
+	keep     int           // the newest snapshots to keep, all if 0
+	maxAge   time.Duration // older snapshots are deleted, kept forever if 0
+}
+
+// Same as the file snapshot, so objects can be restored with `filestore` too.
+type snapshot struct {
+	Metrics []models.Metrics `json:"metrics"`
+	WALSeq  uint64           `json:"wal_seq,omitempty"` // the latest write-ahead log record in the snapshot
+}
+
+// Options of the object storage.
+type Options struct {
+	Endpoint string // like `http://localhost:9000`
+	Bucket   string
+	Prefix   string // prepended to object keys, like `metrics/`
+	Credentials
+	Generations int           // the newest snapshots to keep, all if 0
+	MaxAge      time.Duration // older snapshots are deleted, kept forever if 0
+}
+
+// Objects are addressed path-style: `<endpoint>/<bucket>/<prefix><time>.json`.
+func New(opts Options) (*objectStorage, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: bad endpoint `%s`", opts.Endpoint)
+	}
+	if opts.Bucket == "" {
+		return nil, errors.New("s3: bucket is not set")
+	}
+	log.Printf("Using bucket `%s` at %s as a storage.\n", opts.Bucket, endpoint)
+	return &objectStorage{
+		client:   &http.Client{Timeout: requestTimeout},
+		endpoint: endpoint,
+		bucket:   opts.Bucket,
+		prefix:   opts.Prefix,
+		creds:    opts.Credentials,
+		keep:     opts.Generations,
+		maxAge:   opts.MaxAge,
+	}, nil
+}
+
+// Uploads the snapshot as a new object.
+func (s *objectStorage) SaveAll(metrics []models.Metrics) error {
+	return s.SaveAllWithSeq(metrics, 0)
+}
+
+// Uploads the snapshot with the sequence number of the latest write-ahead log record in it.
+func (s *objectStorage) SaveAllWithSeq(metrics []models.Metrics, walSeq uint64) error {
+	body, err := json.Marshal(snapshot{Metrics: metrics, WALSeq: walSeq})
+	if err != nil {
+		return fmt.Errorf("s3: failed encoding snapshot: %w", err)
+	}
+	key := s.prefix + time.Now().UTC().Format(keyLayout) + keySuffix
+	resp, err := s.do(http.MethodPut, key, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	log.Printf("Metrics dumped into object `%s`.\n", key)
+
+	// the snapshot is uploaded, failing to delete old ones only leaves them for the next dump
+	if err := s.prune(key, time.Now()); err != nil {
+		log.Printf("Can't delete old snapshots: %s.\n", err)
+	}
+	return nil
+}
+
+// Downloads the newest snapshot, no metrics if the bucket has none.
+func (s *objectStorage) ReadAll() ([]models.Metrics, error) {
+	metrics, _, err := s.ReadAllWithSeq()
+	return metrics, err
+}
+
+// Also returns the sequence number of the latest write-ahead log record in the snapshot.
+func (s *objectStorage) ReadAllWithSeq() ([]models.Metrics, uint64, error) {
+	keys, err := s.list()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(keys) == 0 {
+		return []models.Metrics{}, 0, nil
+	}
+	snap, err := s.read(keys[len(keys)-1])
+	return snap.Metrics, snap.WALSeq, err
+}
+
+// Downloads the newest snapshot taken at or before `at`.
+func (s *objectStorage) ReadAt(at time.Time) ([]models.Metrics, error) {
+	keys, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		if !s.keyTime(keys[i]).After(at) {
+			snap, err := s.read(keys[i])
+			return snap.Metrics, err
+		}
+	}
+	return nil, fmt.Errorf("s3: no snapshot at or before %s", at.Format(time.RFC3339))
+}
+
+// ============ Not exported
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Returns keys of snapshots sorted by time, other objects under the prefix are skipped.
+func (s *objectStorage) list() ([]string, error) {
+	keys := []string{}
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		result := listBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: failed decoding objects list: %w", err)
+		}
+
+		for _, c := range result.Contents {
+			if !s.keyTime(c.Key).IsZero() {
+				keys = append(keys, c.Key)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	// not relying on the listing order of the server
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Deletes snapshots beyond the retention count and age, `latest` is always kept.
+func (s *objectStorage) prune(latest string, now time.Time) error {
+	if s.keep <= 0 && s.maxAge <= 0 {
+		return nil
+	}
+	keys, err := s.list()
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		key := keys[len(keys)-1-i] // the newest first
+		tooOld := s.maxAge > 0 && now.Sub(s.keyTime(key)) > s.maxAge
+		if (s.keep <= 0 || i < s.keep) && !tooOld || key == latest {
+			continue
+		}
+		resp, err := s.do(http.MethodDelete, key, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (s *objectStorage) read(key string) (snapshot, error) {
+	snap := snapshot{Metrics: []models.Metrics{}}
+	resp, err := s.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return snap, err
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return snap, fmt.Errorf("s3: failed reading `%s`: %w", key, err)
+	}
+	if err := json.Unmarshal(content, &snap); err != nil {
+		return snap, fmt.Errorf("s3: failed decoding `%s`: %w", key, err)
+	}
+	log.Printf("Restoring metrics from object `%s`.\n", key)
+	return snap, nil
+}
+
+// Returns the time of the snapshot key, zero if it isn't a snapshot.
+func (s *objectStorage) keyTime(key string) time.Time {
+	name := strings.TrimSuffix(strings.TrimPrefix(key, s.prefix), keySuffix)
+	t, err := time.Parse(keyLayout, name)
+	if err != nil || !strings.HasPrefix(key, s.prefix) || !strings.HasSuffix(key, keySuffix) {
+		return time.Time{}
+	}
+	return t
+}
+
+// Sends the signed request to the object or, with the empty key, to the bucket.
+// Responses other than 2xx are errors.
+func (s *objectStorage) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + s.bucket + "/" + key
+	if key == "" {
+		path = "/" + s.bucket
+	}
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = encodePath(u.Path)
+
+	// limited by the client timeout
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("s3: failed creating request: %w", err)
+	}
+	if query != nil {
+		req.URL.RawQuery = query.Encode()
+		req.URL.RawQuery = canonicalQuery(req) // sent exactly as signed
+	}
+
+	hash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		hash = hex.EncodeToString(sum[:])
+		req.Header.Set("Content-Type", "application/json")
+	}
+	Sign(req, hash, s.creds, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %s `%s` failed: %w", method, path, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s `%s` failed with %s: %s", method, path, resp.Status, msg)
+	}
+	return resp, nil
+}
@@ -0,0 +1,287 @@
+package s3store_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/backup/s3store"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+func TestSnapshots(t *testing.T) {
+	s3 := newFakeS3("metrics", "us-east-1", map[string]string{"key": "secret"})
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	opts := s3store.Options{
+		Endpoint:    srv.URL,
+		Bucket:      "metrics",
+		Prefix:      "prod/",
+		Credentials: s3store.Credentials{AccessKey: "key", SecretKey: "secret", Region: "us-east-1"},
+	}
+	store, err := s3store.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := store.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 0 {
+		t.Fatalf("Expected no metrics in the empty bucket, got %+v", metrics)
+	}
+
+	times := []time.Time{}
+	for _, delta := range []int64{1, 2, 3} {
+		delta := delta
+		if err := store.SaveAll([]models.Metrics{{ID: "PollCount", MType: models.MCounter, Delta: &delta}}); err != nil {
+			t.Fatal(err)
+		}
+		times = append(times, time.Now())
+	}
+	// other objects are skipped
+	s3.objects["prod/notes.txt"] = []byte("not a snapshot")
+	s3.objects["dev/20991231T000000.000000000Z.json"] = []byte(`{"metrics":[]}`)
+
+	metrics, err = store.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 || *metrics[0].Delta != 3 {
+		t.Errorf("Expected the newest snapshot, got %+v", metrics)
+	}
+
+	metrics, err = store.ReadAt(times[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 || *metrics[0].Delta != 2 {
+		t.Errorf("Expected the snapshot at %s, got %+v", times[1], metrics)
+	}
+	if _, err := store.ReadAt(times[0].Add(-time.Hour)); err == nil {
+		t.Error("Expected no snapshot before the first one")
+	}
+
+	for _, creds := range []s3store.Credentials{
+		{AccessKey: "wrong", SecretKey: "secret", Region: "us-east-1"},
+		{AccessKey: "key", SecretKey: "wrong", Region: "us-east-1"},
+		{AccessKey: "key", SecretKey: "secret", Region: "eu-west-1"},
+	} {
+		wrong := opts
+		wrong.Credentials = creds
+		wrongStore, err := s3store.New(wrong)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wrongStore.ReadAll(); err == nil {
+			t.Errorf("Expected the request signed with %+v rejected", creds)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	old := "prod/" + time.Now().Add(-2*time.Hour).UTC().Format("20060102T150405.000000000Z") + ".json"
+
+	tests := []struct {
+		name      string
+		opts      s3store.Options
+		wantSaved int // the newest snapshots left
+		wantOld   bool
+	}{
+		{name: "test all kept", opts: s3store.Options{}, wantSaved: 3, wantOld: true},
+		{name: "test generations", opts: s3store.Options{Generations: 2}, wantSaved: 2},
+		{name: "test max age", opts: s3store.Options{MaxAge: time.Hour}, wantSaved: 3},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := newFakeS3("metrics", "us-east-1", map[string]string{"key": "secret"})
+			srv := httptest.NewServer(s3)
+			defer srv.Close()
+			s3.objects[old] = []byte(`{"metrics":[]}`)
+			s3.objects["prod/notes.txt"] = []byte("not a snapshot")
+
+			opts := tt.opts
+			opts.Endpoint, opts.Bucket, opts.Prefix = srv.URL, "metrics", "prod/"
+			opts.Credentials = s3store.Credentials{AccessKey: "key", SecretKey: "secret", Region: "us-east-1"}
+			store, err := s3store.New(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := store.SaveAll([]models.Metrics{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s3.mx.Lock()
+			defer s3.mx.Unlock()
+			if _, ok := s3.objects[old]; ok != tt.wantOld {
+				t.Errorf("Expected the old snapshot kept %v, got %v", tt.wantOld, ok)
+			}
+			if _, ok := s3.objects["prod/notes.txt"]; !ok {
+				t.Error("Expected other objects kept")
+			}
+			saved := len(s3.objects) - 1 // notes
+			if tt.wantOld {
+				saved--
+			}
+			if saved != tt.wantSaved {
+				t.Errorf("Expected %d snapshots, got %d", tt.wantSaved, saved)
+			}
+		})
+	}
+}
+
+func TestBadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		opts s3store.Options
+	}{
+		{name: "test missing endpoint", opts: s3store.Options{Bucket: "metrics"}},
+		{name: "test relative endpoint", opts: s3store.Options{Endpoint: "localhost:9000", Bucket: "metrics"}},
+		{name: "test missing bucket", opts: s3store.Options{Endpoint: "http://localhost:9000"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s3store.New(tt.opts); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+// Keeps objects of the single bucket in memory, lists them by 2 to page through.
+// Requests must be signed with one of the keys.
+type fakeS3 struct {
+	mx      sync.Mutex
+	bucket  string
+	region  string
+	keys    map[string]string // secret keys by access keys
+	objects map[string][]byte
+}
+
+func newFakeS3(bucket, region string, keys map[string]string) *fakeS3 {
+	return &fakeS3{bucket: bucket, region: region, keys: keys, objects: map[string][]byte{}}
+}
+
+func (s *fakeS3) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.signed(r, body) {
+		http.Error(rw, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		http.Error(rw, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPut && key != "":
+		s.objects[key] = body
+	case r.Method == http.MethodDelete && key != "":
+		delete(s.objects, key)
+		rw.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && key != "":
+		content, ok := s.objects[key]
+		if !ok {
+			http.Error(rw, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		rw.Write(content)
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		s.list(rw, r.URL.Query().Get("prefix"), r.URL.Query().Get("continuation-token"))
+	default:
+		http.Error(rw, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+// Signs the request as received with the secret key of its access key and compares signatures.
+func (s *fakeS3) signed(r *http.Request, body []byte) bool {
+	auth := r.Header.Get("Authorization")
+	credential, _, _ := strings.Cut(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 Credential="), ",")
+	accessKey, _, _ := strings.Cut(credential, "/")
+	secretKey, ok := s.keys[accessKey]
+	if !ok {
+		return false
+	}
+	signedAt, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	if r.Header.Get("X-Amz-Content-Sha256") != payloadHash {
+		return false
+	}
+
+	received, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return false
+	}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			received.Header[name] = values
+		}
+	}
+	s3store.Sign(received, payloadHash, s3store.Credentials{
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Region:    s.region,
+	}, signedAt)
+	return hmac.Equal([]byte(received.Header.Get("Authorization")), []byte(auth))
+}
+
+func (s *fakeS3) list(rw http.ResponseWriter, prefix, after string) {
+	keys := []string{}
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	for i, k := range keys {
+		if i == 2 {
+			result.IsTruncated = true
+			result.NextContinuationToken = keys[i-1]
+			break
+		}
+		result.Contents = append(result.Contents, content{Key: k})
+	}
+
+	rw.Header().Set("Content-Type", "application/xml")
+	if err := xml.NewEncoder(rw).Encode(result); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
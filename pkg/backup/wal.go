@@ -0,0 +1,297 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	"github.com/amiskov/metrics-and-alerting/pkg/server/repo"
+)
+
+// Write-ahead log of accepted updates, a JSON record with the sequence number and metrics per line.
+// It keeps updates made after the latest dump, so they are replayed on top of the restored snapshot.
+// The snapshot keeps the sequence number of the latest dumped record, so records which are
+// still in the log after a crash between the dump and the truncation aren't replayed twice.
+type WAL struct {
+	ctx  context.Context
+	path string
+
+	// Updates hold it for reading, checkpoints and truncation for writing,
+	// so the dumped snapshot contains exactly the updates logged before the checkpoint.
+	mx sync.RWMutex
+
+	fileMx  sync.Mutex // guards writes to `file`
+	file    *os.File
+	size    int64  // bytes in the file
+	written uint64 // sequence number of the latest record, never decreases
+
+	syncMx sync.Mutex // only one fsync at a time, others wait and usually find their records synced
+	synced uint64     // records known to be on disk
+}
+
+func NewWAL(ctx context.Context, path string) (*WAL, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("wal: failed opening `%s`: %w", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("wal: failed opening `%s`: %w", path, err)
+	}
+	log.Printf("Using `%s` as a write-ahead log.\n", path)
+	return &WAL{ctx: ctx, path: path, file: file, size: info.Size()}, nil
+}
+
+// Returns the storage which logs its accepted updates.
+func (l *WAL) Storage(s repo.Storage) repo.Storage {
+	return &loggedStorage{Storage: s, wal: l}
+}
+
+// Closes the log file, updates fail after that.
+func (l *WAL) Close() error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.fileMx.Lock()
+	defer l.fileMx.Unlock()
+
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("wal: failed closing: %w", err)
+	}
+	return nil
+}
+
+// ============ Not exported
+
+// Line of the log. Lines of older versions are arrays of metrics without the sequence number.
+type walRecord struct {
+	Seq      uint64           `json:"seq"`
+	Metrics  []models.Metrics `json:"metrics"`
+	Rejected uint64           `json:"rejected,omitempty"` // the logged update with this number failed, it isn't replayed
+}
+
+type loggedStorage struct {
+	repo.Storage
+	wal *WAL
+}
+
+func (s *loggedStorage) Update(m models.Metrics) error {
+	return s.wal.record([]models.Metrics{m}, func() error {
+		return s.Storage.Update(m)
+	})
+}
+
+func (s *loggedStorage) BulkUpdate(metrics []models.Metrics) error {
+	return s.wal.record(metrics, func() error {
+		return s.Storage.BulkUpdate(metrics)
+	})
+}
+
+// Logs the update and applies it once the record is on disk, so no applied update is lost.
+// If the update fails, the record is followed by the one rejecting it.
+func (l *WAL) record(metrics []models.Metrics, apply func() error) error {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+
+	seq, err := l.write(walRecord{Metrics: metrics})
+	if err != nil {
+		return err
+	}
+	if err := l.sync(seq); err != nil {
+		return err
+	}
+
+	if err := apply(); err != nil {
+		// a crash before the rejection is on disk replays the update, as if it had succeeded
+		if _, wErr := l.write(walRecord{Rejected: seq}); wErr != nil {
+			logger.Log(l.ctx).Errorf("wal: failed rejecting record %d: %v", seq, wErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Appends the record with the next sequence number and returns the number.
+func (l *WAL) write(r walRecord) (uint64, error) {
+	l.fileMx.Lock()
+	defer l.fileMx.Unlock()
+
+	r.Seq = l.written + 1
+	line, err := json.Marshal(r)
+	if err != nil {
+		return 0, fmt.Errorf("wal: failed encoding record: %w", err)
+	}
+	line = append(line, '\n')
+	if _, err := l.file.Write(line); err != nil {
+		logger.Log(l.ctx).Errorf("wal: failed writing record: %v", err)
+		return 0, fmt.Errorf("wal: failed writing record: %w", err)
+	}
+	l.size += int64(len(line))
+	l.written = r.Seq
+	return r.Seq, nil
+}
+
+// Group commit: a single fsync covers all records written before it started.
+func (l *WAL) sync(seq uint64) error {
+	l.syncMx.Lock()
+	defer l.syncMx.Unlock()
+
+	if l.synced >= seq {
+		return nil
+	}
+
+	l.fileMx.Lock()
+	target := l.written
+	l.fileMx.Unlock()
+
+	if err := l.file.Sync(); err != nil {
+		logger.Log(l.ctx).Errorf("wal: failed syncing: %v", err)
+		return fmt.Errorf("wal: failed syncing: %w", err)
+	}
+	l.synced = target
+	return nil
+}
+
+// Takes the snapshot consistent with the log. Returns the log size and the sequence number
+// of the latest record at the moment of the snapshot.
+func (l *WAL) checkpoint(snapshot func() ([]models.Metrics, error)) ([]models.Metrics, int64, uint64, error) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	metrics, err := snapshot()
+	return metrics, l.size, l.written, err
+}
+
+// Drops the first `offset` bytes of records which are in the dumped snapshot.
+func (l *WAL) truncate(offset int64) error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	tail := make([]byte, l.size-offset)
+	if _, err := l.file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return fmt.Errorf("wal: failed reading records: %w", err)
+	}
+	return l.replaceFile(tail)
+}
+
+// Drops all records. Next records follow `dumped`, the sequence number of the latest snapshot.
+func (l *WAL) reset(dumped uint64) error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.written = dumped
+	return l.replaceFile(nil)
+}
+
+// Applies logged records following `dumped`, the sequence number of the restored snapshot,
+// with `apply`. A partially written record at the end is dropped.
+func (l *WAL) replay(apply func([]models.Metrics) error, dumped uint64) error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	content := make([]byte, l.size)
+	if _, err := l.file.ReadAt(content, 0); err != nil && err != io.EOF {
+		return fmt.Errorf("wal: failed reading records: %w", err)
+	}
+
+	valid := 0
+	logged := []walRecord{}
+	rejected := make(map[uint64]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		r, err := decodeRecord(scanner.Bytes())
+		if err != nil {
+			log.Printf("WAL record at byte %d is broken, dropping the rest: %s.\n", valid, err)
+			break
+		}
+		valid += len(scanner.Bytes()) + 1
+		logged = append(logged, r)
+		if r.Rejected != 0 {
+			rejected[r.Rejected] = true
+		}
+	}
+
+	records, skipped := 0, 0
+	l.written = dumped
+	for _, r := range logged {
+		if r.Seq > l.written {
+			l.written = r.Seq
+		}
+		if r.Rejected != 0 || rejected[r.Seq] {
+			continue
+		}
+		// records of older versions have no sequence number, they are always applied
+		if r.Seq != 0 && r.Seq <= dumped {
+			skipped++
+			continue
+		}
+		if err := apply(r.Metrics); err != nil {
+			return fmt.Errorf("wal: failed applying record: %w", err)
+		}
+		records++
+	}
+	l.synced = l.written
+	log.Printf("Replayed %d records from the write-ahead log, %d are already in the snapshot.\n", records, skipped)
+
+	if valid < len(content) {
+		return l.replaceFile(content[:valid])
+	}
+	return nil
+}
+
+func decodeRecord(line []byte) (walRecord, error) {
+	r := walRecord{}
+	if bytes.HasPrefix(line, []byte("[")) {
+		return r, json.Unmarshal(line, &r.Metrics)
+	}
+	return r, json.Unmarshal(line, &r)
+}
+
+// Atomically replaces the log with `content`. Must be called holding `mx` for writing.
+func (l *WAL) replaceFile(content []byte) error {
+	tmpPath := l.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("wal: failed truncating: %w", err)
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("wal: failed truncating: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("wal: failed truncating: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("wal: failed truncating: %w", err)
+	}
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		return fmt.Errorf("wal: failed truncating: %w", err)
+	}
+	if dir, err := os.Open(filepath.Dir(l.path)); err == nil {
+		if err := dir.Sync(); err != nil {
+			log.Println("Can't sync WAL directory:", err)
+		}
+		dir.Close()
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("wal: failed reopening: %w", err)
+	}
+	l.file.Close()
+	l.file = file
+	l.size = int64(len(content))
+	l.synced = l.written // everything left is on disk
+	return nil
+}
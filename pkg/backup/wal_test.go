@@ -0,0 +1,290 @@
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/backup"
+	"github.com/amiskov/metrics-and-alerting/pkg/backup/filestore"
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/inmem"
+)
+
+func TestWALReplayAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	store, _, err := filestore.New(filepath.Join(dir, "db.json"), filestore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first run dumps and crashes after more updates
+	db := start(t, store, walPath, true)
+	update(t, db, counter("PollCount", 2), gauge("Alloc", 1))
+	db.stop(t) // dumps and truncates the log
+	if info, err := os.Stat(walPath); err != nil || info.Size() != 0 {
+		t.Fatalf("Expected the empty log after the dump, got %v %v", info, err)
+	}
+
+	db = start(t, store, walPath, true)
+	update(t, db, counter("PollCount", 3), gauge("Alloc", 2))
+	db.crash(t)
+
+	// a partially written record at the end is dropped
+	f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`[{"id":"PollCount","type":"counter","del`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// restored snapshot and replayed log, twice since replaying doesn't change the log
+	for i := 0; i < 2; i++ {
+		db = start(t, store, walPath, true)
+		assertDelta(t, db, "PollCount", 5)
+		assertValue(t, db, "Alloc", 2)
+		db.crash(t)
+	}
+
+	// the log is dropped without restoring
+	db = start(t, store, walPath, false)
+	if _, err := db.mem.Get(models.MCounter, "PollCount", nil); err == nil {
+		t.Error("Expected no metrics without restoring")
+	}
+	db.crash(t)
+	db = start(t, store, walPath, true)
+	assertDelta(t, db, "PollCount", 2)
+	db.crash(t)
+}
+
+func TestWALConcurrentUpdates(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	store, _, err := filestore.New(filepath.Join(dir, "db.json"), filestore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := start(t, store, walPath, true)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := db.logged.BulkUpdate([]models.Metrics{counter("PollCount", 1)}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	db.crash(t)
+
+	db = start(t, store, walPath, true)
+	assertDelta(t, db, "PollCount", 200)
+	db.crash(t)
+}
+
+func TestWALCrashAfterDump(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	store, _, err := filestore.New(filepath.Join(dir, "db.json"), filestore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := start(t, store, walPath, true)
+	update(t, db, counter("PollCount", 2))
+	db.stop(t)
+
+	// the log isn't truncated after the dump as if the process crashed in between
+	db = start(t, store, walPath, true)
+	update(t, db, counter("PollCount", 3), gauge("Alloc", 1))
+	logged, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.stop(t)
+	if err := os.WriteFile(walPath, logged, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db = start(t, store, walPath, true)
+	assertDelta(t, db, "PollCount", 5)
+	assertValue(t, db, "Alloc", 1)
+	update(t, db, counter("PollCount", 1))
+	db.crash(t)
+
+	// records following the dumped ones are still replayed
+	db = start(t, store, walPath, true)
+	assertDelta(t, db, "PollCount", 6)
+	db.crash(t)
+}
+
+func TestWALRejectedUpdates(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	store, _, err := filestore.New(filepath.Join(dir, "db.json"), filestore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := start(t, store, walPath, true)
+	logged := db.wal.Storage(&rejectingStorage{DB: db.mem, walPath: walPath, reject: "Broken"})
+	if err := logged.BulkUpdate([]models.Metrics{counter("PollCount", 2)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := logged.BulkUpdate([]models.Metrics{gauge("Broken", 1)}); err == nil {
+		t.Fatal("Expected the update rejected")
+	}
+	db.crash(t)
+
+	// rejected updates aren't replayed
+	db = start(t, store, walPath, true)
+	assertDelta(t, db, "PollCount", 2)
+	if _, err := db.mem.Get(models.MGauge, "Broken", nil); err == nil {
+		t.Error("Expected the rejected update not replayed")
+	}
+	db.crash(t)
+}
+
+// Rejects updates of the metric, fails if updates are applied before they are logged.
+type rejectingStorage struct {
+	*inmem.DB
+	walPath string
+	reject  string
+}
+
+func (s *rejectingStorage) BulkUpdate(metrics []models.Metrics) error {
+	logged, err := os.ReadFile(s.walPath)
+	if err != nil {
+		return err
+	}
+	for _, m := range metrics {
+		if !bytes.Contains(logged, []byte(`"id":"`+m.ID+`"`)) {
+			return fmt.Errorf("`%s` is applied before it's logged", m.ID)
+		}
+		if m.ID == s.reject {
+			return errors.New("rejected")
+		}
+	}
+	return s.DB.BulkUpdate(metrics)
+}
+
+type server struct {
+	mem        *inmem.DB
+	wal        *backup.WAL
+	logged     interface{ BulkUpdate([]models.Metrics) error }
+	store      *crashingStore
+	cancel     context.CancelFunc
+	terminated chan bool
+}
+
+type snapshotStore interface {
+	ReadAll() ([]models.Metrics, error)
+	SaveAll([]models.Metrics) error
+	ReadAllWithSeq() ([]models.Metrics, uint64, error)
+	SaveAllWithSeq([]models.Metrics, uint64) error
+}
+
+// Fails saving after the crash, so the crashed worker leaves the snapshot as it is.
+type crashingStore struct {
+	snapshotStore
+	crashed int32
+}
+
+func (s *crashingStore) SaveAll(metrics []models.Metrics) error {
+	return s.SaveAllWithSeq(metrics, 0)
+}
+
+func (s *crashingStore) SaveAllWithSeq(metrics []models.Metrics, walSeq uint64) error {
+	if atomic.LoadInt32(&s.crashed) != 0 {
+		return errors.New("crashed")
+	}
+	return s.snapshotStore.SaveAllWithSeq(metrics, walSeq)
+}
+
+// Starts the backup worker with the log, restores and replays synchronously.
+func start(t *testing.T, store snapshotStore, walPath string, restore bool) *server {
+	t.Helper()
+	logger.Run("error")
+	ctx, cancel := context.WithCancel(context.Background())
+	mem := inmem.New(ctx, nil)
+	wal, err := backup.NewWAL(ctx, walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashing := &crashingStore{snapshotStore: store}
+	terminated := make(chan bool, 1)
+	backup.New(ctx, terminated, mem, crashing, wal).Run(restore, time.Time{}, time.Hour)
+	return &server{mem: mem, wal: wal, logged: wal.Storage(mem), store: crashing, cancel: cancel, terminated: terminated}
+}
+
+// Terminates gracefully with the final dump.
+func (s *server) stop(t *testing.T) {
+	t.Helper()
+	s.cancel()
+	select {
+	case <-s.terminated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Backup worker didn't terminate")
+	}
+}
+
+// Stops like a crashed process: the final dump fails, so the log is kept as it is.
+func (s *server) crash(t *testing.T) {
+	t.Helper()
+	atomic.StoreInt32(&s.store.crashed, 1)
+	s.stop(t)
+}
+
+func update(t *testing.T, s *server, metrics ...models.Metrics) {
+	t.Helper()
+	for _, m := range metrics {
+		if err := s.logged.BulkUpdate([]models.Metrics{m}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func counter(name string, d int64) models.Metrics {
+	return models.Metrics{ID: name, MType: models.MCounter, Delta: &d}
+}
+
+func gauge(name string, v float64) models.Metrics {
+	return models.Metrics{ID: name, MType: models.MGauge, Value: &v}
+}
+
+func assertDelta(t *testing.T, s *server, name string, want int64) {
+	t.Helper()
+	m, err := s.mem.Get(models.MCounter, name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *m.Delta != want {
+		t.Errorf("Expected `%s` %d, got %d", name, want, *m.Delta)
+	}
+}
+
+func assertValue(t *testing.T, s *server, name string, want float64) {
+	t.Helper()
+	m, err := s.mem.Get(models.MGauge, name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *m.Value != want {
+		t.Errorf("Expected `%s` %v, got %v", name, want, *m.Value)
+	}
+}
@@ -0,0 +1,179 @@
+// Package `encryption` implements hybrid encryption of request bodies.
+//
+// Every payload is encrypted with a random AES-256-GCM key, the key itself is
+// encrypted with the RSA public key using OAEP (SHA-256), so payloads of any size
+// can be encrypted. Layout of the encrypted payload:
+//
+//	RSA-OAEP(AES key) | GCM nonce | AES-GCM(payload)
+//
+// The length of the encrypted key equals the RSA modulus size.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	// Request header telling the payload is encrypted, its value is the scheme.
+	Header = "X-Encryption"
+	Scheme = "rsa-oaep-aes-gcm"
+)
+
+const aesKeySize = 32
+
+var ErrorMalformedPayload = errors.New("malformed encrypted payload")
+
+// Encrypts the payload with a random symmetric key protected by the public key.
+func Encrypt(pub *rsa.PublicKey, payload []byte) ([]byte, error) {
+	key := make([]byte, aesKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("encryption: failed generating key: %w", err)
+	}
+
+	encKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed encrypting key: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("encryption: failed generating nonce: %w", err)
+	}
+
+	out := make([]byte, 0, len(encKey)+len(nonce)+len(payload)+gcm.Overhead())
+	out = append(out, encKey...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, payload, nil), nil
+}
+
+// Decrypts the payload produced by `Encrypt` with the matching private key.
+func Decrypt(priv *rsa.PrivateKey, encrypted []byte) ([]byte, error) {
+	keySize := priv.Size()
+	if len(encrypted) < keySize {
+		return nil, ErrorMalformedPayload
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, encrypted[:keySize], nil)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed decrypting key: %v. %w", err, ErrorMalformedPayload)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	rest := encrypted[keySize:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, ErrorMalformedPayload
+	}
+
+	payload, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed decrypting payload: %v. %w", err, ErrorMalformedPayload)
+	}
+	return payload, nil
+}
+
+// Reads the PEM encoded public key, PKIX ("PUBLIC KEY") and PKCS #1 ("RSA PUBLIC KEY") are supported.
+func ReadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed parsing public key `%s`: %w", path, err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("encryption: `%s` is not an RSA public key", path)
+	}
+	return pub, nil
+}
+
+// Reads the PEM encoded private key, PKCS #8 ("PRIVATE KEY") and PKCS #1 ("RSA PRIVATE KEY") are supported.
+func ReadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed parsing private key `%s`: %w", path, err)
+	}
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("encryption: `%s` is not an RSA private key", path)
+	}
+	return priv, nil
+}
+
+// Generates the key pair and returns PEM encoded private (PKCS #8) and public (PKIX) keys.
+func GenerateKeys(bits int) (privPEM []byte, pubPEM []byte, err error) {
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encryption: failed generating key: %w", err)
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encryption: failed encoding private key: %w", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encryption: failed encoding public key: %w", err)
+	}
+
+	privPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	pubPEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	return privPEM, pubPEM, nil
+}
+
+// ============ Not exported
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed creating cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed creating GCM: %w", err)
+	}
+	return gcm, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed reading key `%s`: %w", path, err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("encryption: no PEM data found in `%s`", path)
+	}
+	return block, nil
+}
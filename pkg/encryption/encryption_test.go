@@ -0,0 +1,59 @@
+package encryption_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/encryption"
+)
+
+func TestEncryption(t *testing.T) {
+	privPEM, pubPEM, err := encryption.GenerateKeys(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	privPath, pubPath := filepath.Join(dir, "private.pem"), filepath.Join(dir, "public.pem")
+	if err := os.WriteFile(privPath, privPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pubPath, pubPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	priv, err := encryption.ReadPrivateKey(privPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := encryption.ReadPublicKey(pubPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := bytes.Repeat([]byte(`{"id":"Alloc","type":"gauge","value":1.5}`), 1000) // bigger than RSA block
+	encrypted, err := encryption.Encrypt(pub, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("test decrypt", func(t *testing.T) {
+		decrypted, err := encryption.Decrypt(priv, encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, decrypted) {
+			t.Error("Decrypted payload doesn't match the original one")
+		}
+	})
+
+	t.Run("test tampered payload", func(t *testing.T) {
+		tampered := append([]byte{}, encrypted...)
+		tampered[len(tampered)-1] ^= 0xff
+		if _, err := encryption.Decrypt(priv, tampered); !errors.Is(err, encryption.ErrorMalformedPayload) {
+			t.Errorf("Expected %v, got %v", encryption.ErrorMalformedPayload, err)
+		}
+	})
+}
@@ -69,6 +69,23 @@ func (l *loggingMiddleware) AccessLog(next http.Handler) http.Handler {
 	})
 }
 
+// Adds the request ID and the logger tagging records with it to the context,
+// like `SetupTracing` and `SetupLogging` do for HTTP. A new ID is generated if empty.
+func (l *Logger) WithRequestID(ctx context.Context, requestID string) context.Context {
+	if requestID == "" {
+		requestID = randBytesHex(16)
+	}
+	ctxlogger := l.With(
+		zap.String("trace-id", requestID),
+	).WithOptions(
+		zap.AddCaller(),
+		zap.AddStacktrace(zap.ErrorLevel),
+	).Sugar()
+
+	ctx = context.WithValue(ctx, requestIDKey, requestID)
+	return context.WithValue(ctx, LoggerKey, ctxlogger)
+}
+
 func randBytesHex(n int) string {
 	randBytes := make([]byte, n)
 	rand.Read(randBytes)
@@ -1,6 +1,10 @@
 package models
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
 	ErrorMetricNotFound    = errors.New("metric not found")
@@ -8,3 +12,16 @@ var (
 	ErrorPartialUpdate     = errors.New("partial update")
 	ErrorUnknownMetricType = errors.New("unknown metric type")
 )
+
+// Keeps IDs of metrics rejected during a bulk update. Matches `ErrorPartialUpdate` with `errors.Is`.
+type PartialUpdateError struct {
+	IDs []string
+}
+
+func (e *PartialUpdateError) Error() string {
+	return fmt.Sprintf("some metrics are invalid: %s. %s", strings.Join(e.IDs, ", "), ErrorPartialUpdate)
+}
+
+func (e *PartialUpdateError) Unwrap() error {
+	return ErrorPartialUpdate
+}
@@ -0,0 +1,63 @@
+package models
+
+import "time"
+
+// Metric value at the moment of an update. Counters keep the accumulated total.
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Delta     *int64    `json:"delta,omitempty"`
+	Value     *float64  `json:"value,omitempty"`
+}
+
+// Samples of a metric aggregated over the interval of a retention tier starting at `Start`.
+// Gauges use `Min`, `Max`, `Avg` and `Last`. Counters use `Sum` (increase over the interval),
+// `Rate` (increase per second) and `Total` (accumulated value at the end of the interval).
+type Aggregate struct {
+	Start time.Time `json:"start"`
+	Count int64     `json:"count"` // number of raw samples
+
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+	Avg  *float64 `json:"avg,omitempty"`
+	Last *float64 `json:"last,omitempty"`
+
+	Sum   *int64   `json:"sum,omitempty"`
+	Rate  *float64 `json:"rate,omitempty"`
+	Total *int64   `json:"total,omitempty"`
+}
+
+// Samples of a single metric within a time range.
+// Aggregates are returned instead of raw samples if `Resolution` is set.
+type History struct {
+	ID         string            `json:"id"`
+	MType      string            `json:"type"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Resolution string            `json:"resolution,omitempty"`
+	Samples    []Sample          `json:"samples"`
+	Aggregates []Aggregate       `json:"aggregates,omitempty"`
+}
+
+// Time range of the history. Raw samples are downsampled to `Step` if it's set.
+// Aggregates of the tier with `Resolution` are returned if it's set.
+// `Labels` select the series of the metric, the series without labels by default.
+type HistoryQuery struct {
+	From       time.Time
+	To         time.Time
+	Step       time.Duration
+	Resolution time.Duration
+	Labels     map[string]string
+}
+
+// Creates a sample of the metric, values are copied.
+func NewSample(m Metrics, ts time.Time) Sample {
+	s := Sample{Timestamp: ts}
+	if m.Delta != nil {
+		delta := *m.Delta
+		s.Delta = &delta
+	}
+	if m.Value != nil {
+		value := *m.Value
+		s.Value = &value
+	}
+	return s
+}
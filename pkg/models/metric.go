@@ -5,7 +5,11 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -19,11 +23,73 @@ type (
 )
 
 type Metrics struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
-	Hash  string   `json:"hash,omitempty"`  // значение хеш-функции
+	ID        string     `json:"id"`                   // имя метрики
+	MType     string     `json:"type"`                 // параметр, принимающий значение gauge или counter
+	Delta     *int64     `json:"delta,omitempty"`      // значение метрики в случае передачи counter
+	Value     *float64   `json:"value,omitempty"`      // значение метрики в случае передачи gauge
+	Hash      string     `json:"hash,omitempty"`       // значение хеш-функции
+	UpdatedAt *time.Time `json:"updated_at,omitempty"` // время последнего обновления, задаётся сервером
+
+	Labels map[string]string `json:"labels,omitempty"` // метки серии, например хост агента
+}
+
+// Label names are like Prometheus ones, so series names can be exposed as is.
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Metrics with the same name and type but different labels are different series.
+// Returns the name of the series like `Alloc{agent_id="a1",host="web1"}`, sorted by label names.
+// The series of a metric without labels is named by the metric name.
+func SeriesName(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := strings.Builder{}
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (m Metrics) SeriesName() string {
+	return SeriesName(m.ID, m.Labels)
+}
+
+// Checks label names and values.
+func ValidateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !labelNameRe.MatchString(k) {
+			return fmt.Errorf("bad label name `%s`. %w", k, ErrorBadMetricFormat)
+		}
+		if v == "" {
+			return fmt.Errorf("empty value of label `%s`. %w", k, ErrorBadMetricFormat)
+		}
+	}
+	return nil
+}
+
+// Returns `true` if the metric has all the labels with the same values.
+func (m Metrics) HasLabels(labels map[string]string) bool {
+	for k, v := range labels {
+		if m.Labels[k] != v {
+			return false
+		}
+	}
+	return true
 }
 
 func (m Metrics) GetStrVal() (string, error) {
@@ -50,11 +116,18 @@ func (m Metrics) GetHash(key []byte) (string, error) {
 		return src, errors.New("empty delta and value")
 	}
 
+	// Metrics without labels are hashed in the first version of the format, so older
+	// agents and servers still agree. The second one adds labels to the series name.
+	name := m.ID
+	if len(m.Labels) > 0 {
+		name = "v2:" + m.SeriesName()
+	}
+
 	switch m.MType {
 	case MCounter:
-		src = fmt.Sprintf("%s:%s:%d", m.ID, m.MType, *m.Delta)
+		src = fmt.Sprintf("%s:%s:%d", name, m.MType, *m.Delta)
 	case MGauge:
-		src = fmt.Sprintf("%s:%s:%f", m.ID, m.MType, *m.Value)
+		src = fmt.Sprintf("%s:%s:%f", name, m.MType, *m.Value)
 	default:
 		return src, ErrorUnknownMetricType
 	}
@@ -23,4 +23,39 @@ func TestMetricHash(t *testing.T) {
 			t.Errorf("Expected: %s, got %s", expected, actual)
 		}
 	})
+
+	t.Run("test labels change hash", func(t *testing.T) {
+		labeled := m
+		labeled.Labels = map[string]string{"host": "web1"}
+		unlabeled, _ := m.GetHash([]byte(key))
+		actual, _ := labeled.GetHash([]byte(key))
+		if actual == unlabeled {
+			t.Errorf("Expected hash of labeled metric to differ from %s", unlabeled)
+		}
+
+		labeled.Labels = map[string]string{"host": "web2"}
+		other, _ := labeled.GetHash([]byte(key))
+		if other == actual {
+			t.Errorf("Expected hash to depend on label values, got %s twice", actual)
+		}
+	})
+}
+
+func TestSeriesName(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "test no labels", want: "Alloc"},
+		{name: "test sorted labels", labels: map[string]string{"host": "web1", "agent_id": "a1"}, want: `Alloc{agent_id="a1",host="web1"}`},
+		{name: "test quoted value", labels: map[string]string{"host": `we"b`}, want: `Alloc{host="we\"b"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := models.SeriesName("Alloc", tt.labels); got != tt.want {
+				t.Errorf("Expected `%s`, got `%s`", tt.want, got)
+			}
+		})
+	}
 }
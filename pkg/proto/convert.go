@@ -0,0 +1,41 @@
+package proto
+
+import "github.com/amiskov/metrics-and-alerting/pkg/models"
+
+func FromModel(m models.Metrics) *Metric {
+	return &Metric{
+		Id:     m.ID,
+		Type:   m.MType,
+		Delta:  m.Delta,
+		Value:  m.Value,
+		Hash:   m.Hash,
+		Labels: m.Labels,
+	}
+}
+
+func FromModels(metrics []models.Metrics) []*Metric {
+	converted := make([]*Metric, 0, len(metrics))
+	for _, m := range metrics {
+		converted = append(converted, FromModel(m))
+	}
+	return converted
+}
+
+func (x *Metric) ToModel() models.Metrics {
+	return models.Metrics{
+		ID:     x.GetId(),
+		MType:  x.GetType(),
+		Delta:  x.Delta,
+		Value:  x.Value,
+		Hash:   x.GetHash(),
+		Labels: x.GetLabels(),
+	}
+}
+
+func ToModels(metrics []*Metric) []models.Metrics {
+	converted := make([]models.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		converted = append(converted, m.ToModel())
+	}
+	return converted
+}
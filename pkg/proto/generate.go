@@ -0,0 +1,4 @@
+// Package proto contains the gRPC API for metrics ingestion generated from `metrics.proto`.
+package proto
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative metrics.proto
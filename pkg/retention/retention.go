@@ -0,0 +1,306 @@
+// Package `retention` keeps the history of metrics bounded: raw samples are compacted
+// into aggregates of coarser tiers, data older than the tier's TTL is deleted.
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+// Tier keeps data of the `Resolution` for `TTL`. Zero `Resolution` is raw samples.
+type Tier struct {
+	Resolution time.Duration
+	TTL        time.Duration
+}
+
+// Storage of raw samples and aggregates of every series, see `models.SeriesName`.
+type Store interface {
+	GetAll() ([]models.Metrics, error)
+	History(metricType string, metricName string, from, to time.Time) ([]models.Sample, error)
+	Aggregates(metricType string, metricName string, resolution time.Duration, from, to time.Time) ([]models.Aggregate, error)
+	LastAggregate(metricType string, metricName string, resolution time.Duration) (models.Aggregate, bool, error)
+	SaveAggregates(metricType string, metricName string, resolution time.Duration, aggs []models.Aggregate) error
+	DeleteHistory(before time.Time) error
+	DeleteAggregates(resolution time.Duration, before time.Time) error
+}
+
+// Parses tiers like `raw:24h,1m:720h,1h:8760h`. The first tier must be `raw`,
+// each next resolution must be a multiple of the previous one, and the previous tier
+// must live at least as long as the next resolution, otherwise there is nothing to compact.
+func ParseTiers(s string) ([]Tier, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	tiers := []Tier{}
+	for i, part := range strings.Split(s, ",") {
+		resStr, ttlStr, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("retention: bad tier `%s`, want `resolution:ttl`", part)
+		}
+
+		t := Tier{}
+		if i == 0 {
+			if resStr != "raw" {
+				return nil, errors.New("retention: the first tier must be `raw`")
+			}
+		} else {
+			res, err := time.ParseDuration(resStr)
+			if err != nil {
+				return nil, fmt.Errorf("retention: bad resolution of tier `%s`: %w", part, err)
+			}
+			if res%time.Second != 0 {
+				return nil, fmt.Errorf("retention: resolution of tier `%s` must be in whole seconds", part)
+			}
+			t.Resolution = res
+		}
+
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil {
+			return nil, fmt.Errorf("retention: bad TTL of tier `%s`: %w", part, err)
+		}
+		t.TTL = ttl
+
+		if i > 0 {
+			prev := tiers[i-1]
+			if t.Resolution <= prev.Resolution || (prev.Resolution > 0 && t.Resolution%prev.Resolution != 0) {
+				return nil, fmt.Errorf("retention: resolution of tier `%s` must be a multiple of %s", part, prev.Resolution)
+			}
+			if prev.TTL < t.Resolution {
+				return nil, fmt.Errorf("retention: TTL %s of the previous tier is shorter than resolution of `%s`", prev.TTL, part)
+			}
+		}
+		tiers = append(tiers, t)
+	}
+	return tiers, nil
+}
+
+// Aggregates raw samples into `resolution` intervals. Samples must be sorted by time.
+// `prevTotal` is the counter value before the first sample, it's needed to get the increase.
+func AggregateSamples(metricType string, samples []models.Sample, resolution time.Duration, prevTotal int64) []models.Aggregate {
+	aggs := make([]models.Aggregate, 0, len(samples))
+	for _, s := range samples {
+		a := models.Aggregate{Start: s.Timestamp, Count: 1}
+		switch {
+		case metricType == models.MGauge && s.Value != nil:
+			v := *s.Value
+			a.Min, a.Max, a.Avg, a.Last = &v, &v, &v, &v
+		case metricType == models.MCounter && s.Delta != nil:
+			total := *s.Delta
+			increase := total - prevTotal
+			if increase < 0 {
+				// counter was reset, e.g. after the restart without restoring
+				increase = total
+			}
+			a.Sum, a.Total = &increase, &total
+			prevTotal = total
+		default:
+			continue
+		}
+		aggs = append(aggs, a)
+	}
+	return MergeAggregates(metricType, aggs, resolution)
+}
+
+// Merges aggregates into coarser `resolution` intervals. Aggregates must be sorted by time.
+func MergeAggregates(metricType string, aggs []models.Aggregate, resolution time.Duration) []models.Aggregate {
+	merged := []models.Aggregate{}
+	for _, a := range aggs {
+		start := a.Start.Truncate(resolution)
+		if len(merged) == 0 || !merged[len(merged)-1].Start.Equal(start) {
+			a.Start = start
+			merged = append(merged, copyAggregate(a))
+			continue
+		}
+		mergeInto(&merged[len(merged)-1], a)
+	}
+
+	if metricType == models.MCounter {
+		for i := range merged {
+			if merged[i].Sum != nil {
+				rate := float64(*merged[i].Sum) / resolution.Seconds()
+				merged[i].Rate = &rate
+			}
+		}
+	}
+	return merged
+}
+
+type compactor struct {
+	ctx   context.Context
+	store Store
+	tiers []Tier
+}
+
+func New(ctx context.Context, store Store, tiers []Tier) *compactor {
+	return &compactor{
+		ctx:   ctx,
+		store: store,
+		tiers: tiers,
+	}
+}
+
+// Compacts and cleans up the store every `interval` until the context is done.
+func (c *compactor) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			log.Println("Compactor stopped.")
+			return
+		case <-ticker.C:
+			if err := c.Compact(time.Now()); err != nil {
+				logger.Log(c.ctx).Errorf("retention: compaction failed: %v", err)
+			}
+		}
+	}
+}
+
+// Aggregates all complete intervals up to `now` and deletes data older than TTL of its tier.
+func (c *compactor) Compact(now time.Time) error {
+	metrics, err := c.store.GetAll()
+	if err != nil {
+		return fmt.Errorf("failed getting metrics: %w", err)
+	}
+
+	for i := 1; i < len(c.tiers); i++ {
+		for _, m := range metrics {
+			if c.ctx.Err() != nil {
+				return c.ctx.Err()
+			}
+			if err := c.compactSeries(m, c.tiers[i-1], c.tiers[i], now); err != nil {
+				return fmt.Errorf("failed compacting `%s` `%s` to %s: %w", m.MType, m.SeriesName(), c.tiers[i].Resolution, err)
+			}
+		}
+	}
+
+	for _, t := range c.tiers {
+		before := now.Add(-t.TTL)
+		if t.Resolution == 0 {
+			err = c.store.DeleteHistory(before)
+		} else {
+			err = c.store.DeleteAggregates(t.Resolution, before)
+		}
+		if err != nil {
+			return fmt.Errorf("failed deleting expired data of %s tier: %w", t.Resolution, err)
+		}
+	}
+
+	return nil
+}
+
+// ============ Not exported
+
+// Aggregates data of the `source` tier which isn't aggregated to the `target` tier yet.
+func (c *compactor) compactSeries(m models.Metrics, source, target Tier, now time.Time) error {
+	series := m.SeriesName()
+	from := time.Time{}
+	prevTotal := int64(0)
+
+	last, ok, err := c.store.LastAggregate(m.MType, series, target.Resolution)
+	if err != nil {
+		return err
+	}
+	if ok {
+		from = last.Start.Add(target.Resolution)
+		if last.Total != nil {
+			prevTotal = *last.Total
+		}
+	}
+
+	// only complete intervals
+	to := now.Truncate(target.Resolution).Add(-time.Microsecond)
+	if !to.After(from) {
+		return nil
+	}
+
+	var aggs []models.Aggregate
+	if source.Resolution == 0 {
+		samples, err := c.store.History(m.MType, series, from, to)
+		if err != nil {
+			return err
+		}
+		aggs = AggregateSamples(m.MType, samples, target.Resolution, prevTotal)
+	} else {
+		sourceAggs, err := c.store.Aggregates(m.MType, series, source.Resolution, from, to)
+		if err != nil {
+			return err
+		}
+		aggs = MergeAggregates(m.MType, sourceAggs, target.Resolution)
+	}
+
+	if len(aggs) == 0 {
+		return nil
+	}
+	return c.store.SaveAggregates(m.MType, series, target.Resolution, aggs)
+}
+
+func mergeInto(dst *models.Aggregate, a models.Aggregate) {
+	count := dst.Count + a.Count
+
+	if dst.Avg != nil && a.Avg != nil {
+		avg := (*dst.Avg*float64(dst.Count) + *a.Avg*float64(a.Count)) / float64(count)
+		dst.Avg = &avg
+	}
+	if dst.Min != nil && a.Min != nil {
+		min := math.Min(*dst.Min, *a.Min)
+		dst.Min = &min
+	}
+	if dst.Max != nil && a.Max != nil {
+		max := math.Max(*dst.Max, *a.Max)
+		dst.Max = &max
+	}
+	if a.Last != nil {
+		dst.Last = copyFloat(a.Last)
+	}
+
+	if dst.Sum != nil && a.Sum != nil {
+		sum := *dst.Sum + *a.Sum
+		dst.Sum = &sum
+	}
+	if a.Total != nil {
+		dst.Total = copyInt(a.Total)
+	}
+
+	dst.Count = count
+}
+
+// Copies values, so merging doesn't change the source aggregate.
+func copyAggregate(a models.Aggregate) models.Aggregate {
+	return models.Aggregate{
+		Start: a.Start,
+		Count: a.Count,
+		Min:   copyFloat(a.Min),
+		Max:   copyFloat(a.Max),
+		Avg:   copyFloat(a.Avg),
+		Last:  copyFloat(a.Last),
+		Sum:   copyInt(a.Sum),
+		Total: copyInt(a.Total),
+	}
+}
+
+func copyFloat(v *float64) *float64 {
+	if v == nil {
+		return nil
+	}
+	c := *v
+	return &c
+}
+
+func copyInt(v *int64) *int64 {
+	if v == nil {
+		return nil
+	}
+	c := *v
+	return &c
+}
@@ -0,0 +1,184 @@
+package retention_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	"github.com/amiskov/metrics-and-alerting/pkg/retention"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/inmem"
+)
+
+func TestParseTiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		tiers   string
+		want    []retention.Tier
+		wantErr bool
+	}{
+		{
+			name:  "test empty",
+			tiers: "",
+		},
+		{
+			name:  "test valid tiers",
+			tiers: "raw:24h, 1m:720h,1h:8760h",
+			want: []retention.Tier{
+				{Resolution: 0, TTL: 24 * time.Hour},
+				{Resolution: time.Minute, TTL: 720 * time.Hour},
+				{Resolution: time.Hour, TTL: 8760 * time.Hour},
+			},
+		},
+		{
+			name:    "test first tier is not raw",
+			tiers:   "1m:720h",
+			wantErr: true,
+		},
+		{
+			name:    "test resolution is not a multiple",
+			tiers:   "raw:24h,1m:720h,90s:8760h",
+			wantErr: true,
+		},
+		{
+			name:    "test previous tier TTL is too short",
+			tiers:   "raw:30s,1m:720h",
+			wantErr: true,
+		},
+		{
+			name:    "test bad format",
+			tiers:   "raw",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := retention.ParseTiers(tt.tiers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tt.wantErr, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected %d tiers, got %d", len(tt.want), len(got))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Expected tier %+v, got %+v", tt.want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAggregateSamples(t *testing.T) {
+	start := time.Date(2022, 11, 1, 10, 0, 0, 0, time.UTC)
+	gauge := func(sec int, v float64) models.Sample {
+		return models.Sample{Timestamp: start.Add(time.Duration(sec) * time.Second), Value: &v}
+	}
+	counter := func(sec int, total int64) models.Sample {
+		return models.Sample{Timestamp: start.Add(time.Duration(sec) * time.Second), Delta: &total}
+	}
+
+	t.Run("test gauge", func(t *testing.T) {
+		aggs := retention.AggregateSamples(models.MGauge,
+			[]models.Sample{gauge(0, 3), gauge(20, 1), gauge(40, 5), gauge(70, 2)}, time.Minute, 0)
+		if len(aggs) != 2 {
+			t.Fatalf("Expected 2 aggregates, got %d", len(aggs))
+		}
+		a := aggs[0]
+		if a.Count != 3 || *a.Min != 1 || *a.Max != 5 || *a.Avg != 3 || *a.Last != 5 {
+			t.Errorf("Unexpected aggregate: count %d, min %v, max %v, avg %v, last %v",
+				a.Count, *a.Min, *a.Max, *a.Avg, *a.Last)
+		}
+		if !aggs[1].Start.Equal(start.Add(time.Minute)) {
+			t.Errorf("Expected the second interval to start at %v, got %v", start.Add(time.Minute), aggs[1].Start)
+		}
+	})
+
+	t.Run("test counter with reset", func(t *testing.T) {
+		aggs := retention.AggregateSamples(models.MCounter,
+			[]models.Sample{counter(0, 12), counter(30, 30), counter(50, 6)}, time.Minute, 10)
+		if len(aggs) != 1 {
+			t.Fatalf("Expected 1 aggregate, got %d", len(aggs))
+		}
+		a := aggs[0]
+		// 12-10 + 30-12 + 6 after the reset
+		if *a.Sum != 26 || *a.Total != 6 || *a.Rate != 26.0/60 {
+			t.Errorf("Unexpected aggregate: sum %d, total %d, rate %v", *a.Sum, *a.Total, *a.Rate)
+		}
+	})
+
+	t.Run("test merge", func(t *testing.T) {
+		minutes := retention.AggregateSamples(models.MGauge,
+			[]models.Sample{gauge(0, 1), gauge(10, 2), gauge(20, 3), gauge(70, 6)}, time.Minute, 0)
+		hours := retention.MergeAggregates(models.MGauge, minutes, time.Hour)
+		if len(hours) != 1 {
+			t.Fatalf("Expected 1 aggregate, got %d", len(hours))
+		}
+		a := hours[0]
+		if a.Count != 4 || *a.Min != 1 || *a.Max != 6 || *a.Avg != 3 || *a.Last != 6 {
+			t.Errorf("Unexpected aggregate: count %d, min %v, max %v, avg %v, last %v",
+				a.Count, *a.Min, *a.Max, *a.Avg, *a.Last)
+		}
+		if *minutes[0].Max != 3 {
+			t.Errorf("Merging changed the source aggregate")
+		}
+	})
+}
+
+func TestCompact(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := inmem.NewWithHistory(ctx, nil, 100)
+	for _, v := range []int64{1, 2, 3} {
+		v := v
+		if err := db.Update(models.Metrics{ID: "PollCount", MType: models.MCounter, Delta: &v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tiers, err := retention.ParseTiers("raw:1h,1m:24h,1h:720h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all samples are in the past and older than the raw TTL
+	now := time.Now().Add(2 * time.Hour)
+	if err := retention.New(ctx, db, tiers).Compact(now); err != nil {
+		t.Fatal(err)
+	}
+
+	samples, err := db.History(models.MCounter, "PollCount", time.Time{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 0 {
+		t.Errorf("Expected expired samples to be deleted, got %d", len(samples))
+	}
+
+	for _, res := range []time.Duration{time.Minute, time.Hour} {
+		aggs, err := db.Aggregates(models.MCounter, "PollCount", res, time.Time{}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sum int64
+		for _, a := range aggs {
+			sum += *a.Sum
+		}
+		if sum != 6 {
+			t.Errorf("Expected the sum of %s aggregates 6, got %d", res, sum)
+		}
+	}
+
+	// nothing new to compact, aggregates don't change
+	if err := retention.New(ctx, db, tiers).Compact(now); err != nil {
+		t.Fatal(err)
+	}
+	last, ok, err := db.LastAggregate(models.MCounter, "PollCount", time.Hour)
+	if err != nil || !ok {
+		t.Fatalf("Expected the latest aggregate, got error %v", err)
+	}
+	if *last.Total != 6 {
+		t.Errorf("Expected the total 6, got %d", *last.Total)
+	}
+}
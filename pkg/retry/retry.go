@@ -0,0 +1,63 @@
+// Package `retry` computes delays between attempts of failed requests.
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Exponential backoff: the interval doubles after every failed attempt.
+type Backoff struct {
+	InitialInterval time.Duration // delay before the first retry
+	MaxInterval     time.Duration // upper bound for a single delay, unbounded if 0
+}
+
+// Returns the delay before the retry number `retry` (starting from 1): the interval capped
+// by `MaxInterval` with the random jitter in its upper half, so servers recovering after
+// an outage aren't hit by all clients at once.
+func (b Backoff) Delay(retry int) time.Duration {
+	delay := b.InitialInterval
+	for i := 1; i < retry && (b.MaxInterval <= 0 || delay < b.MaxInterval); i++ {
+		delay *= 2
+	}
+	if b.MaxInterval > 0 && delay > b.MaxInterval {
+		delay = b.MaxInterval
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	jitterMx.Lock()
+	defer jitterMx.Unlock()
+	half := delay / 2
+	return half + time.Duration(jitterRnd.Int63n(int64(delay-half)+1))
+}
+
+// Waits for the delay. Returns the context error if it's done first.
+func Sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Server errors and throttling are worth retrying.
+func IsRetryableStatus(code int) bool {
+	return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+}
+
+// ============ Not exported
+
+// Own source to avoid the same jitter sequence on every process.
+var (
+	jitterMx  sync.Mutex
+	jitterRnd = rand.New(rand.NewSource(time.Now().UnixNano())) // nolint: gosec
+)
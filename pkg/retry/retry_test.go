@@ -0,0 +1,47 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/retry"
+)
+
+func TestDelay(t *testing.T) {
+	backoff := retry.Backoff{InitialInterval: 100 * time.Millisecond, MaxInterval: time.Second}
+
+	tests := []struct {
+		name    string
+		backoff retry.Backoff
+		retry   int
+		wantMax time.Duration
+	}{
+		{name: "test first retry", backoff: backoff, retry: 1, wantMax: 100 * time.Millisecond},
+		{name: "test doubled interval", backoff: backoff, retry: 3, wantMax: 400 * time.Millisecond},
+		{name: "test capped interval", backoff: backoff, retry: 10, wantMax: time.Second},
+		{name: "test unbounded interval", backoff: retry.Backoff{InitialInterval: time.Second}, retry: 4, wantMax: 8 * time.Second},
+		{name: "test no interval", backoff: retry.Backoff{}, retry: 2, wantMax: 0},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := tt.backoff.Delay(tt.retry)
+				if delay < tt.wantMax/2 || delay > tt.wantMax {
+					t.Fatalf("Expected delay in [%s, %s], got %s", tt.wantMax/2, tt.wantMax, delay)
+				}
+			}
+		})
+	}
+}
+
+func TestSleepCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := retry.Sleep(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the context error, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/alerting"
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+)
+
+// Returns firing alerts as JSON. Other states are requested with `?state=pending|resolved|all`.
+func (api *metricsAPI) getAlerts(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	var states []alerting.State
+	switch state := alerting.State(r.URL.Query().Get("state")); state {
+	case "":
+		states = []alerting.State{alerting.StateFiring}
+	case "all":
+	case alerting.StatePending, alerting.StateFiring, alerting.StateResolved:
+		states = []alerting.State{state}
+	default:
+		rw.WriteHeader(http.StatusBadRequest)
+		writeJSONError(r, rw, fmt.Errorf("unknown alert state `%s`", state))
+		return
+	}
+
+	writeJSON(rw, r, http.StatusOK, api.alerter.Alerts(states...))
+}
+
+func (api *metricsAPI) getRules(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, r, http.StatusOK, api.alerter.Rules())
+}
+
+func (api *metricsAPI) getRule(rw http.ResponseWriter, r *http.Request) {
+	rule, err := api.alerter.Rule(chi.URLParam(r, "name"))
+	if err != nil {
+		writeRuleError(rw, r, err)
+		return
+	}
+	writeJSON(rw, r, http.StatusOK, rule)
+}
+
+func (api *metricsAPI) createRule(rw http.ResponseWriter, r *http.Request) {
+	rule := alerting.Rule{}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeRuleError(rw, r, fmt.Errorf("can't parse rule: %v. %w", err, alerting.ErrorBadRule))
+		return
+	}
+
+	created, err := api.alerter.AddRule(rule)
+	if err != nil {
+		writeRuleError(rw, r, err)
+		return
+	}
+	writeJSON(rw, r, http.StatusCreated, created)
+}
+
+func (api *metricsAPI) updateRule(rw http.ResponseWriter, r *http.Request) {
+	rule := alerting.Rule{}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeRuleError(rw, r, fmt.Errorf("can't parse rule: %v. %w", err, alerting.ErrorBadRule))
+		return
+	}
+
+	updated, err := api.alerter.UpdateRule(chi.URLParam(r, "name"), rule)
+	if err != nil {
+		writeRuleError(rw, r, err)
+		return
+	}
+	writeJSON(rw, r, http.StatusOK, updated)
+}
+
+func (api *metricsAPI) deleteRule(rw http.ResponseWriter, r *http.Request) {
+	if err := api.alerter.DeleteRule(chi.URLParam(r, "name")); err != nil {
+		writeRuleError(rw, r, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (api *metricsAPI) getSilences(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, r, http.StatusOK, api.alerter.Silences())
+}
+
+func (api *metricsAPI) createSilence(rw http.ResponseWriter, r *http.Request) {
+	silence := alerting.Silence{}
+	if err := json.NewDecoder(r.Body).Decode(&silence); err != nil {
+		writeRuleError(rw, r, fmt.Errorf("can't parse silence: %v. %w", err, alerting.ErrorBadSilence))
+		return
+	}
+
+	created, err := api.alerter.AddSilence(silence)
+	if err != nil {
+		writeRuleError(rw, r, err)
+		return
+	}
+	writeJSON(rw, r, http.StatusCreated, created)
+}
+
+func (api *metricsAPI) deleteSilence(rw http.ResponseWriter, r *http.Request) {
+	if err := api.alerter.DeleteSilence(chi.URLParam(r, "id")); err != nil {
+		writeRuleError(rw, r, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Writes errors of rules and silences API.
+func writeRuleError(rw http.ResponseWriter, r *http.Request, err error) {
+	rw.Header().Set("Content-Type", "application/json")
+	switch {
+	case errors.Is(err, alerting.ErrorBadRule), errors.Is(err, alerting.ErrorBadSilence):
+		rw.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, alerting.ErrorRuleNotFound), errors.Is(err, alerting.ErrorSilenceNotFound):
+		rw.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, alerting.ErrorRuleExists):
+		rw.WriteHeader(http.StatusConflict)
+	default:
+		logger.Log(r.Context()).Errorf("alerting API failed: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+	writeJSONError(r, rw, err)
+}
+
+func writeJSON(rw http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	jbz, err := json.Marshal(v)
+	if err != nil {
+		logger.Log(r.Context()).Errorf("failed marshaling response: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	writeBody(r.Context(), rw, jbz)
+}
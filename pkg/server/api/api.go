@@ -2,26 +2,46 @@ package api
 
 import (
 	"context"
+	"crypto/rsa"
 	"log"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/go-chi/chi"
 
+	"github.com/amiskov/metrics-and-alerting/pkg/alerting"
+	"github.com/amiskov/metrics-and-alerting/pkg/encryption"
 	"github.com/amiskov/metrics-and-alerting/pkg/models"
 )
 
 type Repo interface {
 	Ping(context.Context) error
-	Get(metricType string, metricName string) (models.Metrics, error)
+	Get(metricType string, metricName string, labels map[string]string) (models.Metrics, error)
 	GetAll() ([]models.Metrics, error)
 	Update(models.Metrics) error
 	BulkUpdate([]models.Metrics) (int, error)
+	History(metricType string, metricName string, q models.HistoryQuery) (models.History, error)
+}
+
+type Alerter interface {
+	Alerts(states ...alerting.State) []alerting.Alert
+	Rules() []alerting.Rule
+	Rule(name string) (alerting.Rule, error)
+	AddRule(alerting.Rule) (alerting.Rule, error)
+	UpdateRule(name string, r alerting.Rule) (alerting.Rule, error)
+	DeleteRule(name string) error
+	Silences() []alerting.Silence
+	AddSilence(alerting.Silence) (alerting.Silence, error)
+	DeleteSilence(id string) error
 }
 
 type metricsAPI struct {
-	Router *chi.Mux
-	repo   Repo
+	Router        *chi.Mux
+	repo          Repo
+	alerter       Alerter         // alerting routes are mounted only if set
+	privateKey    *rsa.PrivateKey // decrypts agent payloads if set
+	trustedSubnet *net.IPNet      // only agents from the subnet can write metrics if set
 }
 
 type LoggerMiddleware interface {
@@ -30,11 +50,35 @@ type LoggerMiddleware interface {
 	AccessLog(http.Handler) http.Handler
 }
 
-func New(s Repo, l LoggerMiddleware) *metricsAPI {
+// Options of the API. Empty values disable the features.
+type Options struct {
+	CryptoKey     string // path to the private key, metric writes must come encrypted if set
+	TrustedSubnet string // CIDR, write requests from other addresses are rejected if set
+}
+
+func New(s Repo, a Alerter, l LoggerMiddleware, opts Options) *metricsAPI {
 	api := &metricsAPI{
-		Router: chi.NewRouter(),
-		repo:   s,
+		Router:  chi.NewRouter(),
+		repo:    s,
+		alerter: a,
 	}
+
+	if opts.CryptoKey != "" {
+		privateKey, err := encryption.ReadPrivateKey(opts.CryptoKey)
+		if err != nil {
+			log.Fatalf("api: can't read private key: %v", err)
+		}
+		api.privateKey = privateKey
+	}
+
+	if opts.TrustedSubnet != "" {
+		_, subnet, err := net.ParseCIDR(opts.TrustedSubnet)
+		if err != nil {
+			log.Fatalf("api: bad trusted subnet `%s`: %v", opts.TrustedSubnet, err)
+		}
+		api.trustedSubnet = subnet
+	}
+
 	api.mountHandlers(l)
 	return api
 }
@@ -9,6 +9,7 @@ import (
 
 	"github.com/go-chi/chi"
 
+	"github.com/amiskov/metrics-and-alerting/pkg/alerting"
 	"github.com/amiskov/metrics-and-alerting/pkg/logger"
 	"github.com/amiskov/metrics-and-alerting/pkg/models"
 )
@@ -18,7 +19,7 @@ var indexTmpl = template.Must(
 		<table>
 		{{range $m := .Metrics}}
 			 <tr>
-			 <td>{{$m.ID}}</td>
+			 <td>{{$m.SeriesName}}</td>
 			 	<td>{{$m.MType}}</td>
 
 			 {{if (eq $m.MType "gauge")}}
@@ -31,7 +32,27 @@ var indexTmpl = template.Must(
 			 	<td>{{$m.Hash}}</td>
 			 </tr>
 		{{end}}
-		</table>`))
+		</table>
+		{{if .Silences}}
+		<h2>Silences</h2>
+		<table>
+			<tr>
+				<th>ID</th><th>Metric</th><th>Labels</th><th>Agent</th>
+				<th>Starts</th><th>Ends</th><th>Comment</th>
+			</tr>
+		{{range $s := .Silences}}
+			<tr>
+				<td>{{$s.ID}}</td>
+				<td>{{$s.MetricName}}</td>
+				<td>{{range $k, $v := $s.Labels}}{{$k}}={{$v}} {{end}}</td>
+				<td>{{$s.AgentID}}</td>
+				<td>{{$s.StartsAt.Format "2006-01-02 15:04:05 MST"}}</td>
+				<td>{{$s.EndsAt.Format "2006-01-02 15:04:05 MST"}}</td>
+				<td>{{$s.Comment}}</td>
+			</tr>
+		{{end}}
+		</table>
+		{{end}}`))
 
 func (api *metricsAPI) getMetricsList(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Set("Content-Type", "text/html")
@@ -43,11 +64,18 @@ func (api *metricsAPI) getMetricsList(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var silences []alerting.Silence
+	if api.alerter != nil {
+		silences = api.alerter.Silences()
+	}
+
 	err = indexTmpl.Execute(rw,
 		struct {
-			Metrics []models.Metrics
+			Metrics  []models.Metrics
+			Silences []alerting.Silence
 		}{
-			Metrics: metrics,
+			Metrics:  metrics,
+			Silences: silences,
 		})
 
 	if err != nil {
@@ -61,7 +89,7 @@ func (api *metricsAPI) getMetric(rw http.ResponseWriter, r *http.Request) {
 	metricType := chi.URLParam(r, "metricType")
 	metricName := chi.URLParam(r, "metricName")
 
-	m, err := api.repo.Get(metricType, metricName)
+	m, err := api.repo.Get(metricType, metricName, nil)
 	if err != nil {
 		logger.Log(r.Context()).Errorf("Metric not found. Body: %s. Error: %v.", err)
 		rw.WriteHeader(http.StatusNotFound)
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+// Time range of the history if `from` isn't set.
+const defaultHistoryRange = time.Hour
+
+// Returns samples of the metric as JSON. Query params (all optional):
+// `from` and `to` as RFC 3339 or Unix seconds, `step` and `resolution` as a duration (`1m`) or seconds.
+// If `resolution` is set, aggregates of the retention tier with this resolution are returned.
+// Series of the metric is selected by `label` params like on `/j`.
+func (api *metricsAPI) getMetricHistory(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	metricType := chi.URLParam(r, "metricType")
+	metricName := chi.URLParam(r, "metricName")
+
+	q, err := parseHistoryQuery(r)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		writeJSONError(r, rw, err)
+		return
+	}
+
+	h, err := api.repo.History(metricType, metricName, q)
+	switch {
+	case errors.Is(err, models.ErrorUnknownMetricType):
+		rw.WriteHeader(http.StatusNotImplemented)
+		writeJSONError(r, rw, err)
+		return
+	case err != nil:
+		logger.Log(r.Context()).Errorf("failed getting history: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		writeJSONError(r, rw, err)
+		return
+	}
+
+	jbz, err := json.Marshal(h)
+	if err != nil {
+		logger.Log(r.Context()).Errorf("failed marshaling history: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	writeBody(r.Context(), rw, jbz)
+}
+
+func parseHistoryQuery(r *http.Request) (models.HistoryQuery, error) {
+	params := r.URL.Query()
+	q := models.HistoryQuery{To: time.Now()}
+
+	var err error
+	if v := params.Get("to"); v != "" {
+		if q.To, err = parseTimeParam(v); err != nil {
+			return q, fmt.Errorf("bad `to`: %w", err)
+		}
+	}
+
+	q.From = q.To.Add(-defaultHistoryRange)
+	if v := params.Get("from"); v != "" {
+		if q.From, err = parseTimeParam(v); err != nil {
+			return q, fmt.Errorf("bad `from`: %w", err)
+		}
+	}
+
+	if q.From.After(q.To) {
+		return q, errors.New("`from` is after `to`")
+	}
+
+	if v := params.Get("step"); v != "" {
+		if q.Step, err = parseDurationParam(v); err != nil {
+			return q, fmt.Errorf("bad `step`: %w", err)
+		}
+		if q.Step < 0 {
+			return q, errors.New("`step` is negative")
+		}
+	}
+
+	if v := params.Get("resolution"); v != "" {
+		if q.Resolution, err = parseDurationParam(v); err != nil {
+			return q, fmt.Errorf("bad `resolution`: %w", err)
+		}
+		if q.Resolution < 0 {
+			return q, errors.New("`resolution` is negative")
+		}
+	}
+
+	if q.Labels, err = parseLabels(params["label"]); err != nil {
+		return q, err
+	}
+
+	return q, nil
+}
+
+func parseTimeParam(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func parseDurationParam(v string) (time.Duration, error) {
+	if sec, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(sec * float64(time.Second)), nil
+	}
+	return time.ParseDuration(v)
+}
+
+func writeJSONError(r *http.Request, rw http.ResponseWriter, err error) {
+	jbz, jErr := json.Marshal(struct {
+		Error string `json:"error"`
+	}{Error: err.Error()})
+	if jErr != nil {
+		logger.Log(r.Context()).Errorf("failed marshaling error: %v", jErr)
+		return
+	}
+	writeBody(r.Context(), rw, jbz)
+}
@@ -3,22 +3,46 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/amiskov/metrics-and-alerting/pkg/logger"
 	"github.com/amiskov/metrics-and-alerting/pkg/models"
 )
 
+// Response body for partially applied `/updates/`, `Rejected` lists IDs of invalid metrics.
+type bulkUpdateResponse struct {
+	Error    string   `json:"error"`
+	Rejected []string `json:"rejected,omitempty"`
+}
+
+// Returns all metrics as JSON. Metrics can be filtered by labels: `?label=host:web1&label=agent_id:a1`.
 func (api *metricsAPI) getMetricsListJSON(rw http.ResponseWriter, r *http.Request) {
-	metrics, err := api.repo.GetAll()
+	filter, err := parseLabels(r.URL.Query()["label"])
+	if err != nil {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusBadRequest)
+		writeJSONError(r, rw, err)
+		return
+	}
+
+	all, err := api.repo.GetAll()
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		logger.Log(r.Context()).Errorf("failed getting metrics: %v", err)
 		return
 	}
 
+	metrics := make([]models.Metrics, 0, len(all))
+	for _, m := range all {
+		if m.HasLabels(filter) {
+			metrics = append(metrics, m)
+		}
+	}
+
 	jbz, err := json.Marshal(metrics)
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
@@ -49,7 +73,7 @@ func (api *metricsAPI) getMetricJSON(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	foundMetric, err := api.repo.Get(reqMetric.MType, reqMetric.ID)
+	foundMetric, err := api.repo.Get(reqMetric.MType, reqMetric.ID, reqMetric.Labels)
 	if err != nil {
 		logger.Log(r.Context()).Errorf("Metric not found. Body: %s. Error: %v.", body, err)
 		rw.WriteHeader(http.StatusNotFound)
@@ -89,8 +113,17 @@ func (api *metricsAPI) bulkUpdateMetrics(rw http.ResponseWriter, r *http.Request
 	if errors.Is(err, models.ErrorPartialUpdate) {
 		logger.Log(r.Context()).Errorf("partial update; updated %d metrics but some metrics are invalid `%v`",
 			updatedQty, err)
+		resp := bulkUpdateResponse{Error: err.Error()}
+		var partialErr *models.PartialUpdateError
+		if errors.As(err, &partialErr) {
+			resp.Rejected = partialErr.IDs
+		}
+		jbz, jErr := json.Marshal(resp)
+		if jErr != nil {
+			logger.Log(r.Context()).Errorf("failed marshaling partial update response: %v", jErr)
+		}
 		rw.WriteHeader(http.StatusPartialContent)
-		writeBody(r.Context(), rw, []byte(`{"error":"`+err.Error()+`"}`))
+		writeBody(r.Context(), rw, jbz)
 		return
 	}
 	if err != nil {
@@ -141,3 +174,22 @@ func (api *metricsAPI) upsertMetricJSON(rw http.ResponseWriter, r *http.Request)
 	rw.WriteHeader(http.StatusOK)
 	writeBody(r.Context(), rw, []byte(`{}`))
 }
+
+// Parses label matchers like `host:web1`.
+func parseLabels(params []string) (map[string]string, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(params))
+	for _, p := range params {
+		name, value, ok := strings.Cut(p, ":")
+		if !ok {
+			return nil, fmt.Errorf("bad label `%s`, expected `name:value`. %w", p, models.ErrorBadMetricFormat)
+		}
+		labels[name] = value
+	}
+	if err := models.ValidateLabels(labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rsa"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/encryption"
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+)
+
+// Protects from zip bombs: bigger decompressed request bodies are rejected.
+const maxDecompressedBodySize = 10 << 20
+
+type ctxKey string
+
+// Marks requests which came encrypted, see `requireEncryption`.
+const decryptedKey ctxKey = "decrypted"
+
+// Decrypts request bodies marked with the `encryption.Header`, other requests pass as is.
+// Responds with 400 if the payload can't be decrypted or there is no private key.
+func decrypt(privateKey *rsa.PrivateKey, maxSize int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			scheme := r.Header.Get(encryption.Header)
+			if scheme == "" {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			if privateKey == nil || scheme != encryption.Scheme {
+				logger.Log(r.Context()).Errorf("can't decrypt payload encrypted with `%s`", scheme)
+				http.Error(rw, "unsupported encryption", http.StatusBadRequest)
+				return
+			}
+
+			encrypted, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, maxSize))
+			if err != nil {
+				logger.Log(r.Context()).Errorf("failed reading encrypted body: %v", err)
+				http.Error(rw, "can't read body", http.StatusBadRequest)
+				return
+			}
+			body, err := encryption.Decrypt(privateKey, encrypted)
+			if err != nil {
+				logger.Log(r.Context()).Errorf("failed decrypting body: %v", err)
+				http.Error(rw, "can't decrypt body", http.StatusBadRequest)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Del(encryption.Header)
+			r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+			next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), decryptedKey, true)))
+		})
+	}
+}
+
+// Rejects requests with 400 unless they came encrypted, so clients can't downgrade to plaintext.
+// Does nothing if there is no private key.
+func requireEncryption(privateKey *rsa.PrivateKey) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if privateKey == nil {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			if decrypted, _ := r.Context().Value(decryptedKey).(bool); !decrypted {
+				logger.Log(r.Context()).Errorf("rejected unencrypted request to `%s`", r.URL.Path)
+				http.Error(rw, "encryption required", http.StatusBadRequest)
+				return
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// Transparently decompresses gzipped request bodies.
+// Responds with 400 for malformed gzip and with 413 if the decompressed body is too big.
+func decompress(maxSize int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				logger.Log(r.Context()).Errorf("malformed gzip request body: %v", err)
+				http.Error(rw, "malformed gzip body", http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+
+			// One extra byte tells us the limit is exceeded
+			body, err := io.ReadAll(io.LimitReader(gz, maxSize+1))
+			if err != nil {
+				logger.Log(r.Context()).Errorf("failed decompressing request body: %v", err)
+				http.Error(rw, "malformed gzip body", http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > maxSize {
+				logger.Log(r.Context()).Errorf("decompressed request body exceeds %d bytes", maxSize)
+				http.Error(rw, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Del("Content-Encoding")
+			r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// Rejects requests with 403 unless the `X-Real-IP` set by the agent belongs to the subnet.
+// Does nothing if the subnet isn't set.
+func trustedSubnet(subnet *net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if subnet == nil {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			realIP := r.Header.Get("X-Real-IP")
+			ip := net.ParseIP(strings.TrimSpace(realIP))
+			if ip == nil || !subnet.Contains(ip) {
+				logger.Log(r.Context()).Errorf("rejected request from untrusted address `%s`", realIP)
+				http.Error(rw, "forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+const (
+	promTextType        = "text/plain; version=0.0.4; charset=utf-8"
+	promOpenMetricsType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Renders all metrics in the Prometheus text format, or in OpenMetrics if the scraper asks for it.
+func (api *metricsAPI) getMetricsPrometheus(rw http.ResponseWriter, r *http.Request) {
+	metrics, err := api.repo.GetAll()
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		logger.Log(r.Context()).Errorf("failed getting metrics: %v", err)
+		return
+	}
+
+	openMetrics := prefersOpenMetrics(r.Header.Get("Accept"))
+	if openMetrics {
+		rw.Header().Set("Content-Type", promOpenMetricsType)
+	} else {
+		rw.Header().Set("Content-Type", promTextType)
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	writeBody(r.Context(), rw, renderPrometheus(r.Context(), metrics, openMetrics))
+}
+
+// Metric family: all samples sharing the name and the type.
+type promFamily struct {
+	name    string
+	mType   string
+	samples []string
+	seen    map[string]bool // sample names with labels, to skip duplicates
+}
+
+type promSeries struct {
+	m       models.Metrics
+	name    string // family name
+	value   string
+	renamed bool
+}
+
+// Names must be unique in the exposition, but different metrics may end up with the same one:
+//   - a gauge and a counter with the same ID: both families get the type suffix, like `Load_gauge`;
+//   - IDs sanitized to the same name (`a.b` and `a_b`): the first ID in order wins, others are skipped.
+//
+// Families which still collide (`Load_gauge` may exist on its own) are skipped too, unchanged names win.
+func renderPrometheus(ctx context.Context, metrics []models.Metrics, openMetrics bool) []byte {
+	series := make([]promSeries, 0, len(metrics))
+	types := map[string]map[string]bool{} // family name to its metric types
+	for _, m := range metrics {
+		name, value, ok := promSample(m, openMetrics)
+		if !ok {
+			continue
+		}
+		series = append(series, promSeries{m: m, name: name, value: value})
+		if types[name] == nil {
+			types[name] = map[string]bool{}
+		}
+		types[name][m.MType] = true
+	}
+	for k, s := range series {
+		if len(types[s.name]) > 1 {
+			series[k].name += "_" + s.m.MType
+			series[k].renamed = true
+		}
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		if series[i].renamed != series[j].renamed {
+			return !series[i].renamed
+		}
+		return series[i].m.ID < series[j].m.ID
+	})
+
+	families := map[string]*promFamily{}
+	for _, s := range series {
+		f, ok := families[s.name]
+		if !ok {
+			f = &promFamily{name: s.name, mType: s.m.MType, seen: map[string]bool{}}
+			families[s.name] = f
+		}
+		if f.mType != s.m.MType {
+			logger.Log(ctx).Warnf("prometheus: %s `%s` skipped, %s `%s` has the same name",
+				s.m.MType, s.m.ID, f.mType, s.name)
+			continue
+		}
+
+		sampleName := s.name
+		if openMetrics && s.m.MType == models.MCounter {
+			sampleName += "_total"
+		}
+		sample := sampleName + promLabels(s.m.Labels)
+		if f.seen[sample] {
+			logger.Log(ctx).Warnf("prometheus: %s `%s` skipped, another metric is exposed as `%s`",
+				s.m.MType, s.m.ID, sample)
+			continue
+		}
+		f.seen[sample] = true
+		f.samples = append(f.samples, sample+" "+s.value)
+	}
+
+	sorted := make([]*promFamily, 0, len(families))
+	for _, f := range families {
+		sorted = append(sorted, f)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].name < sorted[j].name
+	})
+
+	var buf bytes.Buffer
+	for _, f := range sorted {
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", f.name, f.mType)
+		for _, s := range f.samples {
+			buf.WriteString(s + "\n")
+		}
+	}
+	if openMetrics {
+		buf.WriteString("# EOF\n")
+	}
+	return buf.Bytes()
+}
+
+// Returns the family name and the value of the metric, `false` if there is no value.
+func promSample(m models.Metrics, openMetrics bool) (string, string, bool) {
+	name := sanitizePromName(m.ID)
+	switch {
+	case m.MType == models.MGauge && m.Value != nil:
+		return name, formatPromFloat(*m.Value), true
+	case m.MType == models.MCounter && m.Delta != nil:
+		if openMetrics {
+			// OpenMetrics adds the suffix to samples, the family name goes without it
+			name = strings.TrimSuffix(name, "_total")
+		}
+		return name, strconv.FormatInt(*m.Delta, 10), true
+	default:
+		return "", "", false
+	}
+}
+
+// Replaces characters which are not allowed in Prometheus metric names with `_`.
+func sanitizePromName(id string) string {
+	var b strings.Builder
+	for i, c := range id {
+		switch {
+		case c == '_' || c == ':' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z'):
+			b.WriteRune(c)
+		case '0' <= c && c <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(c)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+var promLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Returns labels like `{agent_id="a1",host="web1"}` sorted by name, empty string if there are none.
+// Label names are validated on update, so they need no sanitizing.
+func promLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, k := range names {
+		pairs[i] = k + `="` + promLabelValueEscaper.Replace(labels[k]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatPromFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// Checks the `Accept` header: OpenMetrics is used if its quality isn't lower than the plain text one.
+func prefersOpenMetrics(accept string) bool {
+	openMetricsQ, textQ := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qParam, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(qParam, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch mediaType {
+		case "application/openmetrics-text":
+			openMetricsQ = math.Max(openMetricsQ, q)
+		case "text/plain", "text/*", "*/*":
+			textQ = math.Max(textQ, q)
+		}
+	}
+	return openMetricsQ > 0 && openMetricsQ >= textQ
+}
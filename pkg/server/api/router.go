@@ -25,13 +25,21 @@ func (api *metricsAPI) mountHandlers(l LoggerMiddleware) {
 		"text/xml",
 	}
 	api.Router.Use(middleware.Compress(3, respTypes...))
+	// decrypt first: agents compress payloads before encrypting
+	api.Router.Use(decrypt(api.privateKey, maxDecompressedBodySize))
+	api.Router.Use(decompress(maxDecompressedBodySize))
 
 	api.Router.Route("/value", func(r chi.Router) {
 		r.Post("/", api.getMetricJSON)
 		r.Get("/{metricType}/{metricName}", api.getMetric)
 	})
 
+	// only metrics writes are restricted, reading is open for everyone
+	onlyTrusted := trustedSubnet(api.trustedSubnet)
+	onlyEncrypted := requireEncryption(api.privateKey)
+
 	api.Router.Route("/update", func(r chi.Router) {
+		r.Use(onlyTrusted, onlyEncrypted)
 		r.Post("/", api.upsertMetricJSON)
 		r.Post("/{metricType}/", handleNotFound)
 		r.Post("/{metricType}/{metricName}/", handleNotImplemented)
@@ -40,9 +48,27 @@ func (api *metricsAPI) mountHandlers(l LoggerMiddleware) {
 
 	api.Router.Route("/", func(r chi.Router) {
 		r.Get("/", api.getMetricsList)
-		r.Post("/updates/", api.bulkUpdateMetrics)
+		r.With(onlyTrusted, onlyEncrypted).Post("/updates/", api.bulkUpdateMetrics)
 		r.Get("/ping", api.ping)
 		r.Get("/j", api.getMetricsListJSON)
+		r.Get("/metrics", api.getMetricsPrometheus)
+		r.Get("/history/{metricType}/{metricName}", api.getMetricHistory)
 		r.Post("/*", handleNotFound)
 	})
+
+	if api.alerter != nil {
+		api.Router.Get("/alerts", api.getAlerts)
+		api.Router.Route("/api/rules", func(r chi.Router) {
+			r.Get("/", api.getRules)
+			r.Post("/", api.createRule)
+			r.Get("/{name}", api.getRule)
+			r.Put("/{name}", api.updateRule)
+			r.Delete("/{name}", api.deleteRule)
+		})
+		api.Router.Route("/api/silences", func(r chi.Router) {
+			r.Get("/", api.getSilences)
+			r.Post("/", api.createSilence)
+			r.Delete("/{id}", api.deleteSilence)
+		})
+	}
 }
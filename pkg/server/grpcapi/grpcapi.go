@@ -0,0 +1,168 @@
+// Package `grpcapi` serves metrics ingestion over gRPC next to the HTTP API.
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	pb "github.com/amiskov/metrics-and-alerting/pkg/proto"
+)
+
+type Repo interface {
+	Get(metricType string, metricName string, labels map[string]string) (models.Metrics, error)
+	Update(models.Metrics) error
+	BulkUpdate([]models.Metrics) (int, error)
+}
+
+type metricsServer struct {
+	pb.UnimplementedMetricsServer
+	repo Repo
+}
+
+type grpcAPI struct {
+	Server *grpc.Server
+}
+
+// In-flight calls are given this long to finish when the server stops.
+const stopTimeout = 5 * time.Second
+
+// Options of the gRPC API. Empty values disable the checks.
+type Options struct {
+	HashingKey    string
+	TrustedSubnet string // CIDR, write calls from other addresses are rejected if set
+}
+
+func New(r Repo, l *logger.Logger, opts Options) *grpcAPI {
+	var subnet *net.IPNet
+	if opts.TrustedSubnet != "" {
+		var err error
+		_, subnet, err = net.ParseCIDR(opts.TrustedSubnet)
+		if err != nil {
+			log.Fatalf("grpc: bad trusted subnet `%s`: %v", opts.TrustedSubnet, err)
+		}
+	}
+
+	hashingKey := []byte(opts.HashingKey)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			unaryLogging(l),
+			unaryTrustedSubnet(subnet),
+			unaryHashCheck(hashingKey),
+		),
+		grpc.ChainStreamInterceptor(
+			streamLogging(l),
+			streamTrustedSubnet(subnet),
+			streamHashCheck(hashingKey),
+		),
+	)
+	pb.RegisterMetricsServer(server, &metricsServer{repo: r})
+	return &grpcAPI{Server: server}
+}
+
+func (api *grpcAPI) Run(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := api.Server.Serve(listener); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Stops accepting calls and waits for in-flight ones, cancels them after `stopTimeout`.
+func (api *grpcAPI) Stop() {
+	stopped := make(chan struct{})
+	go func() {
+		api.Server.GracefulStop()
+		close(stopped)
+	}()
+
+	timer := time.NewTimer(stopTimeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C:
+		api.Server.Stop()
+	}
+	log.Println("gRPC server stopped.")
+}
+
+func (s *metricsServer) Update(ctx context.Context, req *pb.UpdateRequest) (*pb.UpdateResponse, error) {
+	if req.GetMetric() == nil {
+		return nil, status.Error(codes.InvalidArgument, "metric is required")
+	}
+
+	err := s.repo.Update(req.GetMetric().ToModel())
+	switch {
+	case errors.Is(err, models.ErrorBadMetricFormat):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, models.ErrorUnknownMetricType):
+		return nil, status.Error(codes.Unimplemented, err.Error())
+	case err != nil:
+		logger.Log(ctx).Errorf("grpc: update failed: %v", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.UpdateResponse{}, nil
+}
+
+func (s *metricsServer) BatchUpdate(ctx context.Context, req *pb.BatchUpdateRequest) (*pb.BatchUpdateResponse, error) {
+	return s.bulkUpdate(ctx, pb.ToModels(req.GetMetrics()))
+}
+
+func (s *metricsServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	m, err := s.repo.Get(req.GetType(), req.GetId(), req.GetLabels())
+	if err != nil {
+		logger.Log(ctx).Errorf("grpc: metric not found: %v", err)
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &pb.GetResponse{Metric: pb.FromModel(m)}, nil
+}
+
+func (s *metricsServer) Push(stream pb.Metrics_PushServer) error {
+	metrics := []models.Metrics{}
+	for {
+		m, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, m.ToModel())
+	}
+
+	resp, err := s.bulkUpdate(stream.Context(), metrics)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(resp)
+}
+
+// Updates valid metrics, IDs of invalid ones are returned in `Rejected`.
+func (s *metricsServer) bulkUpdate(ctx context.Context, metrics []models.Metrics) (*pb.BatchUpdateResponse, error) {
+	updatedQty, err := s.repo.BulkUpdate(metrics)
+
+	var partialErr *models.PartialUpdateError
+	if errors.As(err, &partialErr) {
+		logger.Log(ctx).Errorf("grpc: partial update; updated %d metrics but some metrics are invalid `%v`",
+			updatedQty, err)
+		return &pb.BatchUpdateResponse{Updated: int32(updatedQty), Rejected: partialErr.IDs}, nil
+	}
+	if err != nil {
+		logger.Log(ctx).Errorf("grpc: bulk update failed: %v", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.BatchUpdateResponse{Updated: int32(updatedQty)}, nil
+}
@@ -0,0 +1,189 @@
+package grpcapi_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	pb "github.com/amiskov/metrics-and-alerting/pkg/proto"
+	"github.com/amiskov/metrics-and-alerting/pkg/server/grpcapi"
+	"github.com/amiskov/metrics-and-alerting/pkg/server/repo"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/inmem"
+)
+
+func newClient(t *testing.T, ctx context.Context, opts grpcapi.Options) pb.MetricsClient {
+	t.Helper()
+
+	hashingKey := []byte(opts.HashingKey)
+	storage := inmem.New(ctx, hashingKey)
+	api := grpcapi.New(repo.New(ctx, hashingKey, storage), logger.Run("debug"), opts)
+
+	listener := bufconn.Listen(1 << 20)
+	go func() { _ = api.Server.Serve(listener) }()
+	t.Cleanup(api.Server.Stop)
+
+	conn, err := grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewMetricsClient(conn)
+}
+
+func TestMetricsService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := []byte("secret")
+	client := newClient(t, ctx, grpcapi.Options{HashingKey: string(key)})
+
+	t.Run("test push and get counter", func(t *testing.T) {
+		stream, err := client.Push(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			delta := int64(2)
+			m := models.Metrics{ID: "PollCount", MType: models.MCounter, Delta: &delta}
+			if m.Hash, err = m.GetHash(key); err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.Send(pb.FromModel(m)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := stream.CloseAndRecv(); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Get(ctx, &pb.GetRequest{Id: "PollCount", Type: models.MCounter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetMetric().GetDelta() != 6 {
+			t.Errorf("Expected PollCount 6, got %d", resp.GetMetric().GetDelta())
+		}
+	})
+
+	t.Run("test batch with invalid metric", func(t *testing.T) {
+		val := 1.5
+		resp, err := client.BatchUpdate(ctx, &pb.BatchUpdateRequest{Metrics: []*pb.Metric{
+			{Id: "Alloc", Type: models.MGauge, Value: &val},
+			{Id: "Bogus", Type: "unknown", Value: &val},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.GetRejected()) != 1 || resp.GetRejected()[0] != "Bogus" {
+			t.Errorf("Expected rejected [Bogus], got %v", resp.GetRejected())
+		}
+	})
+
+	t.Run("test bad hash rejected", func(t *testing.T) {
+		val := 1.5
+		_, err := client.Update(ctx, &pb.UpdateRequest{
+			Metric: &pb.Metric{Id: "Alloc", Type: models.MGauge, Value: &val, Hash: "deadbeef"},
+		})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("Expected %s, got %v", codes.Unauthenticated, err)
+		}
+	})
+
+	t.Run("test unknown metric", func(t *testing.T) {
+		_, err := client.Get(ctx, &pb.GetRequest{Id: "Missing", Type: models.MGauge})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Expected %s, got %v", codes.NotFound, err)
+		}
+	})
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := newClient(t, ctx, grpcapi.Options{TrustedSubnet: "10.0.0.0/24"})
+	val := 1.5
+	metric := &pb.Metric{Id: "Alloc", Type: models.MGauge, Value: &val}
+
+	tests := []struct {
+		name   string
+		realIP string
+		call   func(ctx context.Context) error
+		code   codes.Code
+	}{
+		{
+			name:   "test update from trusted address",
+			realIP: "10.0.0.5",
+			call: func(ctx context.Context) error {
+				_, err := client.Update(ctx, &pb.UpdateRequest{Metric: metric})
+				return err
+			},
+			code: codes.OK,
+		},
+		{
+			name:   "test update from untrusted address",
+			realIP: "192.168.1.7",
+			call: func(ctx context.Context) error {
+				_, err := client.Update(ctx, &pb.UpdateRequest{Metric: metric})
+				return err
+			},
+			code: codes.PermissionDenied,
+		},
+		{
+			name: "test batch update without address",
+			call: func(ctx context.Context) error {
+				_, err := client.BatchUpdate(ctx, &pb.BatchUpdateRequest{Metrics: []*pb.Metric{metric}})
+				return err
+			},
+			code: codes.PermissionDenied,
+		},
+		{
+			name:   "test push from untrusted address",
+			realIP: "192.168.1.7",
+			call: func(ctx context.Context) error {
+				stream, err := client.Push(ctx)
+				if err != nil {
+					return err
+				}
+				_ = stream.Send(metric) // the real error is returned by `CloseAndRecv`
+				_, err = stream.CloseAndRecv()
+				return err
+			},
+			code: codes.PermissionDenied,
+		},
+		{
+			name:   "test read from untrusted address",
+			realIP: "192.168.1.7",
+			call: func(ctx context.Context) error {
+				_, err := client.Get(ctx, &pb.GetRequest{Id: "Alloc", Type: models.MGauge})
+				return err
+			},
+			code: codes.OK,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			callCtx := ctx
+			if tt.realIP != "" {
+				callCtx = metadata.AppendToOutgoingContext(ctx, "x-real-ip", tt.realIP)
+			}
+			if err := tt.call(callCtx); status.Code(err) != tt.code {
+				t.Errorf("Expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/logger"
+	pb "github.com/amiskov/metrics-and-alerting/pkg/proto"
+)
+
+// Adds tracing-aware logger to the context and logs the call, like HTTP `AccessLog` does.
+func unaryLogging(l *logger.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		start := time.Now()
+		ctx = l.WithRequestID(ctx, requestID(ctx))
+		resp, err := handler(ctx, req)
+		accessLog(ctx, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+func streamLogging(l *logger.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		start := time.Now()
+		ctx := l.WithRequestID(ss.Context(), requestID(ss.Context()))
+		err := handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+		accessLog(ctx, info.FullMethod, start, err)
+		return err
+	}
+}
+
+// Rejects updates with metrics whose hashes don't match the server's key.
+// Metrics without hashes pass, as they do over HTTP.
+func unaryHashCheck(key []byte) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		var err error
+		switch r := req.(type) {
+		case *pb.UpdateRequest:
+			err = checkHashes(ctx, key, r.GetMetric())
+		case *pb.BatchUpdateRequest:
+			err = checkHashes(ctx, key, r.GetMetrics()...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func streamHashCheck(key []byte) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ss.Context(), hashingKey: key})
+	}
+}
+
+// Rejects writes with `PermissionDenied` unless the `x-real-ip` metadata set by the agent
+// belongs to the subnet, like HTTP `trustedSubnet` does. Does nothing if the subnet isn't set.
+func unaryTrustedSubnet(subnet *net.IPNet) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if err := checkRealIP(ctx, subnet, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func streamTrustedSubnet(subnet *net.IPNet) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if err := checkRealIP(ss.Context(), subnet, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// ============ Not exported
+
+// Overrides the context and checks hashes of received metrics.
+type serverStream struct {
+	grpc.ServerStream
+	ctx        context.Context
+	hashingKey []byte
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if metric, ok := m.(*pb.Metric); ok {
+		return checkHashes(s.ctx, s.hashingKey, metric)
+	}
+	return nil
+}
+
+func checkHashes(ctx context.Context, key []byte, metrics ...*pb.Metric) error {
+	if len(key) == 0 {
+		return nil // nothing to check
+	}
+
+	badIDs := []string{}
+	for _, m := range metrics {
+		if m == nil || m.GetHash() == "" {
+			continue
+		}
+		agentHash, err := hex.DecodeString(m.GetHash())
+		if err != nil {
+			badIDs = append(badIDs, m.GetId())
+			continue
+		}
+		serverHex, err := m.ToModel().GetHash(key)
+		if err != nil {
+			badIDs = append(badIDs, m.GetId())
+			continue
+		}
+		serverHash, err := hex.DecodeString(serverHex)
+		if err != nil || !hmac.Equal(agentHash, serverHash) {
+			badIDs = append(badIDs, m.GetId())
+		}
+	}
+
+	if len(badIDs) > 0 {
+		logger.Log(ctx).Errorf("grpc: agent and server hashes are not equal for %v", badIDs)
+		return status.Errorf(codes.Unauthenticated, "bad hash for metrics: %s", strings.Join(badIDs, ", "))
+	}
+	return nil
+}
+
+// Only metrics writes are restricted, reading is open for everyone.
+func checkRealIP(ctx context.Context, subnet *net.IPNet, method string) error {
+	if subnet == nil || method == pb.Metrics_Get_FullMethodName {
+		return nil
+	}
+
+	realIP := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ips := md.Get("x-real-ip"); len(ips) > 0 {
+			realIP = ips[0]
+		}
+	}
+	ip := net.ParseIP(strings.TrimSpace(realIP))
+	if ip == nil || !subnet.Contains(ip) {
+		logger.Log(ctx).Errorf("grpc: rejected %s from untrusted address `%s`", method, realIP)
+		return status.Error(codes.PermissionDenied, "forbidden")
+	}
+	return nil
+}
+
+func requestID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get("x-request-id"); len(ids) > 0 {
+			return ids[0]
+		}
+	}
+	return ""
+}
+
+func accessLog(ctx context.Context, method string, start time.Time, err error) {
+	remoteAddr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+	logger.Log(ctx).Infow(method,
+		"code", status.Code(err).String(),
+		"remote_addr", remoteAddr,
+		"work_time", time.Since(start),
+	)
+}
@@ -5,19 +5,23 @@ import (
 	"crypto/hmac"
 	"encoding/hex"
 	"fmt"
-	"strings"
+	"sort"
 	"time"
 
 	"github.com/amiskov/metrics-and-alerting/pkg/logger"
 	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	"github.com/amiskov/metrics-and-alerting/pkg/retention"
 )
 
 type Storage interface {
 	Ping(context.Context) error
-	Get(metricType string, metricName string) (models.Metrics, error)
+	Get(metricType string, metricName string, labels map[string]string) (models.Metrics, error)
 	GetAll() ([]models.Metrics, error)
 	Update(models.Metrics) error
 	BulkUpdate([]models.Metrics) error
+	// History is kept per series, `metricName` is the series name, see `models.SeriesName`.
+	History(metricType string, metricName string, from, to time.Time) ([]models.Sample, error)
+	Aggregates(metricType string, metricName string, resolution time.Duration, from, to time.Time) ([]models.Aggregate, error)
 }
 
 type Repo struct {
@@ -41,8 +45,9 @@ func (r Repo) Ping(ctx context.Context) error {
 	return r.db.Ping(ctx)
 }
 
-func (r Repo) Get(metricType string, metricName string) (models.Metrics, error) {
-	m, err := r.db.Get(metricType, metricName)
+// Returns the series of the metric with exactly the given labels, `nil` means no labels.
+func (r Repo) Get(metricType string, metricName string, labels map[string]string) (models.Metrics, error) {
+	m, err := r.db.Get(metricType, metricName, labels)
 	if err != nil {
 		return m, fmt.Errorf("can't get metric with type `%s` and name `%s`: %w", m.MType, m.ID, err)
 	}
@@ -55,6 +60,25 @@ func (r Repo) Get(metricType string, metricName string) (models.Metrics, error)
 	return m, nil
 }
 
+// Returns all series of the metric having the given labels sorted by labels:
+// `{agent_id: a1}` matches `{agent_id: a1, host: web1}`, `nil` matches every series.
+func (r Repo) Series(metricType string, metricName string, labels map[string]string) ([]models.Metrics, error) {
+	all, err := r.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("can't match metric with type `%s` and name `%s`: %w", metricType, metricName, err)
+	}
+	matched := []models.Metrics{}
+	for _, s := range all {
+		if s.MType == metricType && s.ID == metricName && s.HasLabels(labels) {
+			matched = append(matched, s)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return models.SeriesName(matched[i].ID, matched[i].Labels) < models.SeriesName(matched[j].ID, matched[j].Labels)
+	})
+	return matched, nil
+}
+
 // Get all metrics from inmemory storage
 func (r Repo) GetAll() ([]models.Metrics, error) {
 	metrics, err := r.db.GetAll()
@@ -73,12 +97,16 @@ func (r Repo) GetAll() ([]models.Metrics, error) {
 	return metrics, nil
 }
 
+// Stores the metric with the current time as the last update time.
 func (r *Repo) Update(m models.Metrics) error {
 	if err := r.validate(m); err != nil {
 		logger.Log(r.ctx).Error("repo: metric is invalid %v", err)
 		return err
 	}
 
+	now := time.Now()
+	m.UpdatedAt = &now
+
 	err := r.db.Update(m)
 	if err != nil {
 		logger.Log(r.ctx).Error("repo: update failed %v", err)
@@ -93,12 +121,14 @@ func (r *Repo) BulkUpdate(metrics []models.Metrics) (int, error) {
 	validMetrics := []models.Metrics{}
 	invalidMetricsIDs := []string{}
 
+	now := time.Now()
 	for _, m := range metrics {
 		err := r.validate(m)
 		if err != nil {
 			invalidMetricsIDs = append(invalidMetricsIDs, m.ID)
 			continue
 		}
+		m.UpdatedAt = &now
 		validMetrics = append(validMetrics, m)
 	}
 
@@ -107,15 +137,68 @@ func (r *Repo) BulkUpdate(metrics []models.Metrics) (int, error) {
 	}
 
 	if len(invalidMetricsIDs) > 0 {
-		ids := strings.Join(invalidMetricsIDs, ", ")
-		return len(validMetrics), fmt.Errorf("repo: some metrics are invalid: %s. %w", ids, models.ErrorPartialUpdate)
+		return len(validMetrics), fmt.Errorf("repo: %w", &models.PartialUpdateError{IDs: invalidMetricsIDs})
 	}
 
 	return len(validMetrics), nil
 }
 
+// Returns samples of the metric within the query range, or aggregates if the query has a resolution.
+// Raw samples are downsampled to the latest sample of every step, aggregates are merged.
+func (r Repo) History(metricType string, metricName string, q models.HistoryQuery) (models.History, error) {
+	h := models.History{ID: metricName, MType: metricType}
+
+	if metricType != models.MCounter && metricType != models.MGauge {
+		return h, models.ErrorUnknownMetricType
+	}
+
+	series := models.SeriesName(metricName, q.Labels)
+	h.Labels = q.Labels
+
+	if q.Resolution > 0 {
+		aggs, err := r.db.Aggregates(metricType, series, q.Resolution, q.From, q.To)
+		if err != nil {
+			return h, fmt.Errorf("repo: can't get aggregates of `%s` `%s`: %w", metricType, metricName, err)
+		}
+		if q.Step > q.Resolution {
+			aggs = retention.MergeAggregates(metricType, aggs, q.Step)
+		}
+		h.Resolution = q.Resolution.String()
+		h.Aggregates = aggs
+		return h, nil
+	}
+
+	samples, err := r.db.History(metricType, series, q.From, q.To)
+	if err != nil {
+		return h, fmt.Errorf("repo: can't get history of `%s` `%s`: %w", metricType, metricName, err)
+	}
+
+	h.Samples = downsample(samples, q.From, q.Step)
+	return h, nil
+}
+
 // ============ Not exported
 
+// Keeps the latest sample of every `step` interval starting at `from`. Samples must be sorted by time.
+func downsample(samples []models.Sample, from time.Time, step time.Duration) []models.Sample {
+	if step <= 0 || len(samples) == 0 {
+		return samples
+	}
+
+	res := []models.Sample{}
+	lastBucket := int64(-1)
+	for _, s := range samples {
+		bucket := int64(s.Timestamp.Sub(from) / step)
+		if bucket == lastBucket {
+			res[len(res)-1] = s
+			continue
+		}
+		res = append(res, s)
+		lastBucket = bucket
+	}
+	return res
+}
+
 func (r *Repo) updateHash(m *models.Metrics) error {
 	if len(r.hashingKey) == 0 {
 		return fmt.Errorf("no hashing key found")
@@ -166,6 +249,10 @@ func (r *Repo) validate(incomingMetric models.Metrics) error {
 		return models.ErrorUnknownMetricType
 	}
 
+	if err := models.ValidateLabels(incomingMetric.Labels); err != nil {
+		return err
+	}
+
 	// Check hash
 	if len(r.hashingKey) != 0 && incomingMetric.Hash != "" {
 		return r.checkHash(incomingMetric)
@@ -0,0 +1,161 @@
+package inmem
+
+import (
+	"sort"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+)
+
+// Returns samples of the series within `[from, to]`, oldest first.
+// Metric name with labels is the series name, see `models.SeriesName`.
+func (mdb DB) History(metricType string, metricName string, from, to time.Time) ([]models.Sample, error) {
+	mdb.mx.RLock()
+	defer mdb.mx.RUnlock()
+
+	series, ok := mdb.history[metricType+metricName]
+	if !ok {
+		return []models.Sample{}, nil
+	}
+	return series.between(from, to), nil
+}
+
+// Removes samples older than `before`.
+func (mdb *DB) DeleteHistory(before time.Time) error {
+	mdb.mx.Lock()
+	defer mdb.mx.Unlock()
+
+	for _, series := range mdb.history {
+		series.dropBefore(before)
+	}
+	return nil
+}
+
+// Returns aggregates of the metric for the `resolution` starting within `[from, to]`.
+func (mdb DB) Aggregates(metricType string, metricName string, resolution time.Duration,
+	from, to time.Time,
+) ([]models.Aggregate, error) {
+	mdb.mx.RLock()
+	defer mdb.mx.RUnlock()
+
+	res := []models.Aggregate{}
+	for _, a := range mdb.aggregates[metricType+metricName][resolution] {
+		if a.Start.Before(from) || a.Start.After(to) {
+			continue
+		}
+		res = append(res, a)
+	}
+	return res, nil
+}
+
+// Returns the latest aggregate of the metric for the `resolution`, `false` if there are none.
+func (mdb DB) LastAggregate(metricType string, metricName string, resolution time.Duration) (models.Aggregate, bool, error) {
+	mdb.mx.RLock()
+	defer mdb.mx.RUnlock()
+
+	aggs := mdb.aggregates[metricType+metricName][resolution]
+	if len(aggs) == 0 {
+		return models.Aggregate{}, false, nil
+	}
+	return aggs[len(aggs)-1], true, nil
+}
+
+// Saves aggregates of the metric, replaces the existing ones with the same start.
+func (mdb *DB) SaveAggregates(metricType string, metricName string, resolution time.Duration,
+	aggs []models.Aggregate,
+) error {
+	mdb.mx.Lock()
+	defer mdb.mx.Unlock()
+
+	byResolution, ok := mdb.aggregates[metricType+metricName]
+	if !ok {
+		byResolution = make(map[time.Duration][]models.Aggregate)
+		mdb.aggregates[metricType+metricName] = byResolution
+	}
+
+	byStart := make(map[time.Time]int, len(byResolution[resolution]))
+	for i, a := range byResolution[resolution] {
+		byStart[a.Start] = i
+	}
+
+	stored := byResolution[resolution]
+	for _, a := range aggs {
+		if i, ok := byStart[a.Start]; ok {
+			stored[i] = a
+			continue
+		}
+		stored = append(stored, a)
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].Start.Before(stored[j].Start)
+	})
+	byResolution[resolution] = stored
+
+	return nil
+}
+
+// Removes aggregates for the `resolution` started before `before`.
+func (mdb *DB) DeleteAggregates(resolution time.Duration, before time.Time) error {
+	mdb.mx.Lock()
+	defer mdb.mx.Unlock()
+
+	for _, byResolution := range mdb.aggregates {
+		aggs := byResolution[resolution]
+		i := sort.Search(len(aggs), func(i int) bool {
+			return !aggs[i].Start.Before(before)
+		})
+		if i > 0 {
+			byResolution[resolution] = append([]models.Aggregate{}, aggs[i:]...)
+		}
+	}
+	return nil
+}
+
+// Keeps the latest samples of a series, the oldest sample is overwritten first.
+type ring struct {
+	samples []models.Sample
+	next    int // position for the next sample
+	full    bool
+}
+
+func newRing(size int) *ring {
+	return &ring{samples: make([]models.Sample, size)}
+}
+
+func (r *ring) push(s models.Sample) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Returns samples within `[from, to]` in chronological order.
+func (r *ring) between(from, to time.Time) []models.Sample {
+	res := []models.Sample{}
+	for _, s := range r.ordered() {
+		if s.Timestamp.Before(from) || s.Timestamp.After(to) {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// Removes samples older than `before`.
+func (r *ring) dropBefore(before time.Time) {
+	ordered := r.ordered()
+	*r = ring{samples: make([]models.Sample, len(r.samples))}
+	for _, s := range ordered {
+		if !s.Timestamp.Before(before) {
+			r.push(s)
+		}
+	}
+}
+
+func (r *ring) ordered() []models.Sample {
+	if !r.full {
+		return r.samples[:r.next]
+	}
+	return append(append([]models.Sample{}, r.samples[r.next:]...), r.samples[:r.next]...)
+}
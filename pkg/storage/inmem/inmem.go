@@ -5,6 +5,7 @@ import (
 	"errors"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/amiskov/metrics-and-alerting/pkg/models"
 )
@@ -12,16 +13,28 @@ import (
 type DB struct {
 	ctx        context.Context
 	mx         *sync.RWMutex
-	data       map[string]models.Metrics // string is `type+name`
+	data       map[string]models.Metrics // string is `type+series`, see `models.SeriesName`
 	hashingKey []byte
+
+	history     map[string]*ring                                // string is `type+series`
+	historySize int                                             // samples kept per metric, history is off if 0
+	aggregates  map[string]map[time.Duration][]models.Aggregate // by `type+series` and resolution
 }
 
 func New(ctx context.Context, key []byte) *DB {
+	return NewWithHistory(ctx, key, 0)
+}
+
+// Creates the storage which keeps the latest `historySize` samples of every metric.
+func NewWithHistory(ctx context.Context, key []byte, historySize int) *DB {
 	return &DB{
-		ctx:        ctx,
-		mx:         new(sync.RWMutex),
-		data:       make(map[string]models.Metrics),
-		hashingKey: key,
+		ctx:         ctx,
+		mx:          new(sync.RWMutex),
+		data:        make(map[string]models.Metrics),
+		hashingKey:  key,
+		history:     make(map[string]*ring),
+		historySize: historySize,
+		aggregates:  make(map[string]map[time.Duration][]models.Aggregate),
 	}
 }
 
@@ -29,10 +42,10 @@ func (mdb DB) Ping(ctx context.Context) error {
 	return nil
 }
 
-func (mdb DB) Get(metricType string, metricName string) (models.Metrics, error) {
+func (mdb DB) Get(metricType string, metricName string, labels map[string]string) (models.Metrics, error) {
 	mdb.mx.RLock()
 	defer mdb.mx.RUnlock()
-	metric, ok := mdb.data[metricType+metricName]
+	metric, ok := mdb.data[metricType+models.SeriesName(metricName, labels)]
 
 	if !ok {
 		return metric, models.ErrorMetricNotFound
@@ -51,9 +64,7 @@ func (mdb DB) GetAll() ([]models.Metrics, error) {
 		metrics = append(metrics, m)
 	}
 
-	sort.Slice(metrics, func(i, j int) bool {
-		return metrics[i].ID < metrics[j].ID
-	})
+	sortMetrics(metrics)
 
 	return metrics, nil
 }
@@ -70,9 +81,15 @@ func (mdb *DB) BulkUpdate(metrics []models.Metrics) error {
 }
 
 func (mdb *DB) Update(m models.Metrics) error {
+	// Counter's read-modify-write must be atomic, otherwise concurrent updates
+	// (or `SnapshotAndReset`) may lose increments.
+	mdb.mx.Lock()
+	defer mdb.mx.Unlock()
+
+	key := m.MType + m.SeriesName()
 	if m.MType == models.MCounter {
-		existingMetric, err := mdb.Get(m.MType, m.ID)
-		if err == nil {
+		existingMetric, ok := mdb.data[key]
+		if ok {
 			if existingMetric.Delta == nil || m.Delta == nil {
 				return errors.New("empty Delta for counter metric")
 			}
@@ -83,9 +100,55 @@ func (mdb *DB) Update(m models.Metrics) error {
 		}
 	}
 
-	mdb.mx.Lock()
-	mdb.data[m.MType+m.ID] = m
-	mdb.mx.Unlock()
+	mdb.data[key] = m
+
+	if mdb.historySize > 0 {
+		series, ok := mdb.history[key]
+		if !ok {
+			series = newRing(mdb.historySize)
+			mdb.history[key] = series
+		}
+		ts := time.Now()
+		if m.UpdatedAt != nil {
+			ts = *m.UpdatedAt
+		}
+		series.push(models.NewSample(m, ts))
+	}
 
 	return nil
 }
+
+// Returns all metrics and resets counters to zero in one step, so counters in
+// the snapshot are increments since the previous snapshot. Used by the agent:
+// increments which weren't delivered should be given back with `BulkUpdate`.
+func (mdb *DB) SnapshotAndReset() ([]models.Metrics, error) {
+	mdb.mx.Lock()
+	defer mdb.mx.Unlock()
+
+	metrics := make([]models.Metrics, 0, len(mdb.data))
+	for key, m := range mdb.data {
+		metrics = append(metrics, m)
+
+		if m.MType == models.MCounter {
+			zero := int64(0)
+			m.Delta = &zero
+			mdb.data[key] = m
+		}
+	}
+
+	sortMetrics(metrics)
+
+	return metrics, nil
+}
+
+// ============ Not exported
+
+// Sorts by name, series of the same metric are sorted by labels.
+func sortMetrics(metrics []models.Metrics) {
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].ID != metrics[j].ID {
+			return metrics[i].ID < metrics[j].ID
+		}
+		return metrics[i].SeriesName() < metrics[j].SeriesName()
+	})
+}
@@ -0,0 +1,18 @@
+package inmem_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/server/repo"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/inmem"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) repo.Storage {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		return inmem.NewWithHistory(ctx, nil, 10)
+	})
+}
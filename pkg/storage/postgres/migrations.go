@@ -0,0 +1,286 @@
+package postgres
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Numbered schema changes like `0002_history.up.sql` with the `.down.sql` pair.
+// Applied versions are recorded in `schema_migrations` with their names, so an applied
+// migration must never be edited or renamed: add a new one instead. Migrating refuses
+// to run if a recorded name differs from the file.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Version 1 used to be the series key migration applied over `sql/schema.sql`,
+// databases which recorded it already have the schema of `0001_metrics.up.sql`.
+// They are migrated up, but version 1 isn't rolled back there: its down would drop
+// the table which the former migration didn't create.
+var formerNames = map[int]string{1: "metrics_series_key"}
+
+var ErrorDropsData = errors.New("rolling back drops data")
+
+// Down migrations matching it lose data, they are run only if confirmed.
+var dropsDataRe = regexp.MustCompile(`(?i)\bDROP\s+(TABLE|COLUMN)\b`)
+
+// Servers starting at the same time wait for each other, the number is arbitrary.
+const migrationsLockID = 7_325_001
+
+const createMigrationsQuery = `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		name VARCHAR(128) NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);`
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time // nil if the migration is pending
+}
+
+// Applies pending migrations on startup.
+func (d *db) Migrate() {
+	applied, err := d.MigrateUp()
+	if err != nil {
+		log.Fatalln("failed migrating DB schema:", err)
+	}
+	for _, m := range applied {
+		log.Printf("Migration %d `%s` has been applied.\n", m.Version, m.Name)
+	}
+}
+
+// Applies all pending migrations in a single transaction. Returns applied migrations.
+func (d *db) MigrateUp() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []MigrationStatus{}
+	err = d.inMigrationTx(func(tx pgx.Tx, done map[int]MigrationStatus) error {
+		if err := checkApplied(migrations, done); err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := done[m.version]; ok {
+				continue
+			}
+			if _, err := tx.Exec(d.ctx, m.up); err != nil {
+				return fmt.Errorf("failed applying migration %d `%s`: %w", m.version, m.name, err)
+			}
+			q := "insert into schema_migrations (version, name) values ($1, $2)"
+			if _, err := tx.Exec(d.ctx, q, m.version, m.name); err != nil {
+				return fmt.Errorf("failed recording migration %d: %w", m.version, err)
+			}
+			applied = append(applied, MigrationStatus{Version: m.version, Name: m.name})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// Rolls back the latest `steps` applied migrations in a single transaction. Returns rolled back migrations.
+// Migrations which drop tables or columns are rolled back only if `dropData` is set.
+func (d *db) MigrateDown(steps int, dropData bool) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	rolledBack := []MigrationStatus{}
+	err = d.inMigrationTx(func(tx pgx.Tx, done map[int]MigrationStatus) error {
+		if err := checkApplied(migrations, done); err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && len(rolledBack) < steps; i-- {
+			m := migrations[i]
+			applied, ok := done[m.version]
+			if !ok {
+				continue
+			}
+			if applied.Name != m.name {
+				return fmt.Errorf("migration %d was applied as `%s`, it can't be rolled back as `%s`",
+					m.version, applied.Name, m.name)
+			}
+			if m.dropsData() && !dropData {
+				return fmt.Errorf("migration %d `%s`: %w", m.version, m.name, ErrorDropsData)
+			}
+			if _, err := tx.Exec(d.ctx, m.down); err != nil {
+				return fmt.Errorf("failed rolling back migration %d `%s`: %w", m.version, m.name, err)
+			}
+			if _, err := tx.Exec(d.ctx, "delete from schema_migrations where version = $1", m.version); err != nil {
+				return fmt.Errorf("failed unrecording migration %d: %w", m.version, err)
+			}
+			rolledBack = append(rolledBack, MigrationStatus{Version: m.version, Name: m.name})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rolledBack, nil
+}
+
+// Returns all known migrations ordered by version.
+func (d *db) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	err = d.inMigrationTx(func(tx pgx.Tx, done map[int]MigrationStatus) error {
+		for _, m := range migrations {
+			s, ok := done[m.version]
+			if !ok {
+				s = MigrationStatus{Version: m.version, Name: m.name}
+			}
+			statuses = append(statuses, s)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// ============ Not exported
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+func (m migration) dropsData() bool {
+	return dropsDataRe.MatchString(m.down)
+}
+
+// Applied migrations must be recorded with the names of their files, or with the former names.
+func checkApplied(migrations []migration, done map[int]MigrationStatus) error {
+	for _, m := range migrations {
+		applied, ok := done[m.version]
+		if !ok || applied.Name == m.name || applied.Name == formerNames[m.version] {
+			continue
+		}
+		return fmt.Errorf("migration %d was applied as `%s`, but the file is `%s`: applied migrations must not be edited",
+			m.version, applied.Name, m.name)
+	}
+	return nil
+}
+
+// Runs `f` in a transaction holding the migrations lock. `done` are applied migrations by version.
+func (d *db) inMigrationTx(f func(tx pgx.Tx, done map[int]MigrationStatus) error) error {
+	tx, err := d.pool.Begin(d.ctx)
+	if err != nil {
+		return fmt.Errorf("pg: failed starting migration: %w", err)
+	}
+	defer tx.Rollback(d.ctx)
+
+	if _, err := tx.Exec(d.ctx, "select pg_advisory_xact_lock($1)", migrationsLockID); err != nil {
+		return fmt.Errorf("pg: failed locking migrations: %w", err)
+	}
+	if _, err := tx.Exec(d.ctx, createMigrationsQuery); err != nil {
+		return fmt.Errorf("pg: failed creating migrations table: %w", err)
+	}
+
+	done, err := d.appliedMigrations(tx)
+	if err != nil {
+		return fmt.Errorf("pg: failed getting applied migrations: %w", err)
+	}
+	if err := f(tx, done); err != nil {
+		return fmt.Errorf("pg: %w", err)
+	}
+	return tx.Commit(d.ctx)
+}
+
+func (d *db) appliedMigrations(tx pgx.Tx) (map[int]MigrationStatus, error) {
+	rows, err := tx.Query(d.ctx, "select version, name, applied_at from schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := map[int]MigrationStatus{}
+	for rows.Next() {
+		s := MigrationStatus{}
+		if err := rows.Scan(&s.Version, &s.Name, &s.AppliedAt); err != nil {
+			return nil, err
+		}
+		done[s.Version] = s
+	}
+	return done, rows.Err()
+}
+
+// Reads migrations from the `migrations` directory, every version must have both files.
+func loadMigrations(files fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(files, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("pg: failed reading migrations: %w", err)
+	}
+
+	byVersion := map[int]*migration{}
+	for _, e := range entries {
+		file := e.Name()
+		base, direction := strings.TrimSuffix(file, ".sql"), ""
+		switch {
+		case strings.HasSuffix(base, ".up"):
+			base, direction = strings.TrimSuffix(base, ".up"), "up"
+		case strings.HasSuffix(base, ".down"):
+			base, direction = strings.TrimSuffix(base, ".down"), "down"
+		default:
+			return nil, fmt.Errorf("pg: migration `%s` is neither up nor down", file)
+		}
+
+		number, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("pg: migration `%s` must be named like `0001_name.up.sql`", file)
+		}
+
+		content, err := fs.ReadFile(files, path.Join("migrations", file))
+		if err != nil {
+			return nil, fmt.Errorf("pg: failed reading migration `%s`: %w", file, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if m.name != name {
+			return nil, fmt.Errorf("pg: migrations `%s` and `%s` have the same version", m.name, name)
+		}
+		if direction == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("pg: migration %d `%s` must have both up and down files", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS metrics;
+DROP TYPE IF EXISTS metric_type;
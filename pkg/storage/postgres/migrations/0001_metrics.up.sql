@@ -0,0 +1,22 @@
+-- Creates the metrics table or upgrades the one created by the former `sql/schema.sql`.
+DO $$ BEGIN
+	CREATE TYPE metric_type AS ENUM ('gauge', 'counter');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
+
+CREATE TABLE IF NOT EXISTS metrics (
+	id SERIAL PRIMARY KEY,
+	type metric_type NOT NULL,
+	name VARCHAR(128) NOT NULL,
+	value DOUBLE PRECISION,
+	delta BIGINT,
+	-- make sure we store only 1 number (add more fields if necessary)
+	CHECK ((value IS NOT NULL)::INTEGER + (delta IS NOT NULL)::INTEGER = 1)
+);
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+
+-- `name` alone was unique, so a gauge and a counter with the same name overwrote each other
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_name_key;
+DROP INDEX IF EXISTS metrics_name_labels_key;
+CREATE UNIQUE INDEX IF NOT EXISTS metrics_series_key ON metrics (type, name, labels);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS metrics_aggregates;
+DROP TABLE IF EXISTS metrics_history;
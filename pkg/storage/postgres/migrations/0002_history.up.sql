@@ -0,0 +1,30 @@
+-- History and aggregates are kept by the series name, see `models.SeriesName`.
+CREATE TABLE IF NOT EXISTS metrics_history (
+	id BIGSERIAL PRIMARY KEY,
+	type metric_type NOT NULL,
+	name TEXT NOT NULL,
+	value DOUBLE PRECISION,
+	delta BIGINT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE metrics_history ALTER COLUMN name TYPE TEXT;
+CREATE INDEX IF NOT EXISTS metrics_history_series_idx ON metrics_history (type, name, created_at);
+CREATE INDEX IF NOT EXISTS metrics_history_created_at_idx ON metrics_history (created_at);
+
+-- Produced by `retention` compactor.
+CREATE TABLE IF NOT EXISTS metrics_aggregates (
+	type metric_type NOT NULL,
+	name TEXT NOT NULL,
+	resolution BIGINT NOT NULL, -- seconds
+	start TIMESTAMPTZ NOT NULL,
+	count BIGINT NOT NULL,
+	min DOUBLE PRECISION,
+	max DOUBLE PRECISION,
+	avg DOUBLE PRECISION,
+	last DOUBLE PRECISION,
+	sum BIGINT,
+	rate DOUBLE PRECISION,
+	total BIGINT,
+	PRIMARY KEY (type, name, resolution, start)
+);
+ALTER TABLE metrics_aggregates ALTER COLUMN name TYPE TEXT;
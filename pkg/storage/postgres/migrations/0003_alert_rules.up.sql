@@ -0,0 +1,5 @@
+-- Rules are stored as JSON, so new rule fields don't need migrations.
+CREATE TABLE IF NOT EXISTS alert_rules (
+	name VARCHAR(128) PRIMARY KEY,
+	rule JSONB NOT NULL
+);
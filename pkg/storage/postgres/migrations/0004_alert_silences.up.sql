@@ -0,0 +1,5 @@
+-- Silences are stored as JSON like rules.
+CREATE TABLE IF NOT EXISTS alert_silences (
+	id VARCHAR(32) PRIMARY KEY,
+	silence JSONB NOT NULL
+);
@@ -0,0 +1,136 @@
+package postgres
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+// Parsing doesn't need the database, so it's tested inside the package.
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Expected version %d, got %d `%s`", i+1, m.version, m.name)
+		}
+		if m.up == "" || m.down == "" {
+			t.Errorf("Expected both files of migration %d `%s`", m.version, m.name)
+		}
+	}
+	if len(migrations) == 0 || migrations[0].name != "metrics" {
+		t.Errorf("Expected the `metrics` migration first, got %+v", migrations)
+	}
+
+	file := &fstest.MapFile{Data: []byte("SELECT 1;")}
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    []string // names by version
+		wantErr bool
+	}{
+		{
+			name: "test sorted by version",
+			files: fstest.MapFS{
+				"migrations/0010_later.up.sql":   file,
+				"migrations/0010_later.down.sql": file,
+				"migrations/0002_first.up.sql":   file,
+				"migrations/0002_first.down.sql": file,
+			},
+			want: []string{"first", "later"},
+		},
+		{
+			name:    "test missing down",
+			files:   fstest.MapFS{"migrations/0001_metrics.up.sql": file},
+			wantErr: true,
+		},
+		{
+			name: "test same version",
+			files: fstest.MapFS{
+				"migrations/0001_metrics.up.sql":   file,
+				"migrations/0001_metrics.down.sql": file,
+				"migrations/0001_history.up.sql":   file,
+				"migrations/0001_history.down.sql": file,
+			},
+			wantErr: true,
+		},
+		{
+			name:    "test zero version",
+			files:   fstest.MapFS{"migrations/0000_metrics.up.sql": file, "migrations/0000_metrics.down.sql": file},
+			wantErr: true,
+		},
+		{
+			name:    "test no version",
+			files:   fstest.MapFS{"migrations/metrics.up.sql": file, "migrations/metrics.down.sql": file},
+			wantErr: true,
+		},
+		{
+			name:    "test neither up nor down",
+			files:   fstest.MapFS{"migrations/0001_metrics.sql": file},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, got %+v", migrations)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(migrations) != len(tt.want) {
+				t.Fatalf("Expected %d migrations, got %+v", len(tt.want), migrations)
+			}
+			for i, m := range migrations {
+				if m.name != tt.want[i] {
+					t.Errorf("Expected `%s`, got `%s`", tt.want[i], m.name)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckApplied(t *testing.T) {
+	migrations := []migration{{version: 1, name: "metrics"}, {version: 2, name: "history"}}
+
+	tests := []struct {
+		name    string
+		done    map[int]MigrationStatus
+		wantErr bool
+	}{
+		{name: "test nothing applied", done: map[int]MigrationStatus{}},
+		{name: "test same names", done: map[int]MigrationStatus{1: {Name: "metrics"}, 2: {Name: "history"}}},
+		{name: "test former name", done: map[int]MigrationStatus{1: {Name: "metrics_series_key"}}},
+		{name: "test edited migration", done: map[int]MigrationStatus{2: {Name: "aggregates"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkApplied(migrations, tt.done); (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDropsData(t *testing.T) {
+	tests := []struct {
+		down string
+		want bool
+	}{
+		{down: "DROP TABLE IF EXISTS alert_rules;", want: true},
+		{down: "alter table metrics drop column labels;", want: true},
+		{down: "DROP INDEX IF EXISTS metrics_series_key;"},
+	}
+	for _, tt := range tests {
+		if got := (migration{down: tt.down}).dropsData(); got != tt.want {
+			t.Errorf("Expected %v for `%s`, got %v", tt.want, tt.down, got)
+		}
+	}
+}
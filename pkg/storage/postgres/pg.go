@@ -2,28 +2,46 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 
-	"github.com/amiskov/metrics-and-alerting/cmd/server/config"
+	"github.com/amiskov/metrics-and-alerting/pkg/alerting"
 	"github.com/amiskov/metrics-and-alerting/pkg/models"
 )
 
-// NB: Counter's Delta updates inside the SQL query
-const insertMetricQuery = `INSERT INTO metrics (type, name, value, delta)
-	VALUES ($1, $2, $3, $4) ON CONFLICT (name) DO UPDATE SET
-	value = excluded.value, delta = metrics.delta + excluded.delta;`
+// NB: Counter's Delta updates inside the SQL query.
+// The resulting value is recorded to the history of the series ($7) in the same statement.
+const insertMetricQuery = `WITH upserted AS (
+		INSERT INTO metrics (type, name, value, delta, updated_at, labels)
+		VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (type, name, labels) DO UPDATE SET
+		value = excluded.value, delta = metrics.delta + excluded.delta, updated_at = excluded.updated_at
+		RETURNING type, value, delta, updated_at
+	)
+	INSERT INTO metrics_history (type, name, value, delta, created_at)
+	SELECT type, $7::text, value, delta, COALESCE(updated_at, now()) FROM upserted;`
+
+const insertAggregateQuery = `INSERT INTO metrics_aggregates
+	(type, name, resolution, start, count, min, max, avg, last, sum, rate, total)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	ON CONFLICT (type, name, resolution, start) DO UPDATE SET
+	count = excluded.count, min = excluded.min, max = excluded.max, avg = excluded.avg,
+	last = excluded.last, sum = excluded.sum, rate = excluded.rate, total = excluded.total;`
+
+const selectAggregatesQuery = `select start, count, min, max, avg, last, sum, rate, total
+	from metrics_aggregates where type = $1 and name = $2 and resolution = $3`
 
 type db struct {
 	pool *pgxpool.Pool
 	ctx  context.Context
 }
 
-func New(ctx context.Context, envCfg *config.Config) (*db, func()) {
-	conn, err := pgxpool.Connect(ctx, envCfg.PgDSN)
+func New(ctx context.Context, dsn string) (*db, func()) {
+	conn, err := pgxpool.Connect(ctx, dsn)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to connect to database: %v\n", err)
 		os.Exit(1)
@@ -36,44 +54,35 @@ func New(ctx context.Context, envCfg *config.Config) (*db, func()) {
 	return s, func() { conn.Close() }
 }
 
-// Creates the `metrics` table if not exists.
-func (d *db) Migrate() {
-	// Check if table exists
-	_, err := d.pool.Exec(d.ctx, "select id, type, name, value, delta from metrics where id = 1")
-	if err == nil {
-		return
-	}
-
-	schema, err := os.ReadFile("sql/schema.sql")
-	if err != nil {
-		log.Fatalln("can't read SQL schema file.", err)
-	}
-
-	_, exErr := d.pool.Exec(d.ctx, string(schema))
-	if exErr != nil {
-		log.Fatalln("failed creating DB schema:", exErr)
-	}
-
-	log.Println("DB schema has been created")
-}
-
-func (d *db) Get(metricType string, metricName string) (models.Metrics, error) {
+func (d *db) Get(metricType string, metricName string, labels map[string]string) (models.Metrics, error) {
 	m := models.Metrics{}
 
-	q := "select type, name, value, delta from metrics where type = $1 and name = $2"
-	row := d.pool.QueryRow(d.ctx, q, metricType, metricName)
-	err := row.Scan(&m.MType, &m.ID, &m.Value, &m.Delta)
+	q := `select type, name, value, delta, updated_at, labels from metrics
+		where type = $1 and name = $2 and labels = $3`
+	row := d.pool.QueryRow(d.ctx, q, metricType, metricName, labelsJSON(labels))
+	err := row.Scan(&m.MType, &m.ID, &m.Value, &m.Delta, &m.UpdatedAt, &m.Labels)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return m, models.ErrorMetricNotFound
+	}
 	if err != nil {
 		return m, err
 	}
+	if len(m.Labels) == 0 {
+		m.Labels = nil
+	}
 
 	return m, nil
 }
 
 func (d *db) GetAll() ([]models.Metrics, error) {
+	return d.GetAllContext(d.ctx)
+}
+
+// Same as `GetAll` with the given context, e.g. to dump metrics after the app context is done.
+func (d *db) GetAllContext(ctx context.Context) ([]models.Metrics, error) {
 	metrics := make([]models.Metrics, 0, 10)
 
-	rows, err := d.pool.Query(d.ctx, "select type, name, value, delta from metrics")
+	rows, err := d.pool.Query(ctx, "select type, name, value, delta, updated_at, labels from metrics")
 	if err != nil {
 		return metrics, err
 	}
@@ -81,22 +90,124 @@ func (d *db) GetAll() ([]models.Metrics, error) {
 
 	for rows.Next() {
 		m := new(models.Metrics)
-		err := rows.Scan(&m.MType, &m.ID, &m.Value, &m.Delta)
+		err := rows.Scan(&m.MType, &m.ID, &m.Value, &m.Delta, &m.UpdatedAt, &m.Labels)
 		if err != nil {
 			return nil, err
 		}
+		if len(m.Labels) == 0 {
+			m.Labels = nil
+		}
 		metrics = append(metrics, *m)
 	}
 
 	return metrics, nil
 }
 
+// Returns samples of the series within `[from, to]`, oldest first.
+// Metric name with labels is the series name, see `models.SeriesName`.
+func (d *db) History(metricType string, metricName string, from, to time.Time) ([]models.Sample, error) {
+	samples := []models.Sample{}
+
+	q := `select created_at, value, delta from metrics_history
+		where type = $1 and name = $2 and created_at between $3 and $4
+		order by created_at`
+	rows, err := d.pool.Query(d.ctx, q, metricType, metricName, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("pg: failed querying history: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s := models.Sample{}
+		if err := rows.Scan(&s.Timestamp, &s.Value, &s.Delta); err != nil {
+			return nil, fmt.Errorf("pg: failed scanning history: %w", err)
+		}
+		samples = append(samples, s)
+	}
+
+	return samples, rows.Err()
+}
+
+// Removes samples older than `before`.
+func (d *db) DeleteHistory(before time.Time) error {
+	if _, err := d.pool.Exec(d.ctx, "delete from metrics_history where created_at < $1", before); err != nil {
+		return fmt.Errorf("pg: failed deleting history: %w", err)
+	}
+	return nil
+}
+
+// Returns aggregates of the metric for the `resolution` starting within `[from, to]`.
+func (d *db) Aggregates(metricType string, metricName string, resolution time.Duration,
+	from, to time.Time,
+) ([]models.Aggregate, error) {
+	q := selectAggregatesQuery + " and start between $4 and $5 order by start"
+	rows, err := d.pool.Query(d.ctx, q, metricType, metricName, resolutionSeconds(resolution), from, to)
+	if err != nil {
+		return nil, fmt.Errorf("pg: failed querying aggregates: %w", err)
+	}
+	defer rows.Close()
+
+	aggs := []models.Aggregate{}
+	for rows.Next() {
+		a, err := scanAggregate(rows)
+		if err != nil {
+			return nil, err
+		}
+		aggs = append(aggs, a)
+	}
+	return aggs, rows.Err()
+}
+
+// Returns the latest aggregate of the metric for the `resolution`, `false` if there are none.
+func (d *db) LastAggregate(metricType string, metricName string, resolution time.Duration) (models.Aggregate, bool, error) {
+	q := selectAggregatesQuery + " order by start desc limit 1"
+	row := d.pool.QueryRow(d.ctx, q, metricType, metricName, resolutionSeconds(resolution))
+	a, err := scanAggregate(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return a, false, nil
+	}
+	if err != nil {
+		return a, false, fmt.Errorf("pg: failed querying the latest aggregate: %w", err)
+	}
+	return a, true, nil
+}
+
+// Saves aggregates of the metric, replaces the existing ones with the same start.
+func (d *db) SaveAggregates(metricType string, metricName string, resolution time.Duration,
+	aggs []models.Aggregate,
+) error {
+	tx, err := d.pool.Begin(d.ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(d.ctx)
+
+	for _, a := range aggs {
+		_, err := tx.Exec(d.ctx, insertAggregateQuery, metricType, metricName, resolutionSeconds(resolution),
+			a.Start, a.Count, a.Min, a.Max, a.Avg, a.Last, a.Sum, a.Rate, a.Total)
+		if err != nil {
+			return fmt.Errorf("pg: failed saving aggregate: %w", err)
+		}
+	}
+	return tx.Commit(d.ctx)
+}
+
+// Removes aggregates for the `resolution` started before `before`.
+func (d *db) DeleteAggregates(resolution time.Duration, before time.Time) error {
+	q := "delete from metrics_aggregates where resolution = $1 and start < $2"
+	if _, err := d.pool.Exec(d.ctx, q, resolutionSeconds(resolution), before); err != nil {
+		return fmt.Errorf("pg: failed deleting aggregates: %w", err)
+	}
+	return nil
+}
+
 func (d db) Ping(ctx context.Context) error {
 	return d.pool.Ping(ctx)
 }
 
 func (d *db) Update(m models.Metrics) error {
-	_, err := d.pool.Exec(d.ctx, insertMetricQuery, m.MType, m.ID, m.Value, m.Delta)
+	_, err := d.pool.Exec(d.ctx, insertMetricQuery, m.MType, m.ID, m.Value, m.Delta, m.UpdatedAt,
+		labelsJSON(m.Labels), m.SeriesName())
 	if err != nil {
 		return fmt.Errorf("failed inserting metric `%#v`. %w", m, err)
 	}
@@ -116,9 +227,100 @@ func (d *db) BulkUpdate(metrics []models.Metrics) error {
 	}
 
 	for _, m := range metrics {
-		if _, err = tx.Exec(d.ctx, preparedStatementName, m.MType, m.ID, m.Value, m.Delta); err != nil {
+		if _, err = tx.Exec(d.ctx, preparedStatementName, m.MType, m.ID, m.Value, m.Delta, m.UpdatedAt,
+			labelsJSON(m.Labels), m.SeriesName()); err != nil {
 			return fmt.Errorf("pg: failed executing transaction: %w", err)
 		}
 	}
 	return tx.Commit(d.ctx)
 }
+
+// Returns stored alert rules, implements `alerting.RuleStore`.
+func (d *db) LoadRules() ([]alerting.Rule, error) {
+	rows, err := d.pool.Query(d.ctx, "select rule from alert_rules order by name")
+	if err != nil {
+		return nil, fmt.Errorf("pg: failed querying alert rules: %w", err)
+	}
+	defer rows.Close()
+
+	rules := []alerting.Rule{}
+	for rows.Next() {
+		r := alerting.Rule{}
+		if err := rows.Scan(&r); err != nil {
+			return nil, fmt.Errorf("pg: failed scanning alert rule: %w", err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (d *db) SaveRule(r alerting.Rule) error {
+	q := `INSERT INTO alert_rules (name, rule) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET rule = excluded.rule`
+	if _, err := d.pool.Exec(d.ctx, q, r.Name, r); err != nil {
+		return fmt.Errorf("pg: failed saving alert rule: %w", err)
+	}
+	return nil
+}
+
+func (d *db) DeleteRule(name string) error {
+	if _, err := d.pool.Exec(d.ctx, "delete from alert_rules where name = $1", name); err != nil {
+		return fmt.Errorf("pg: failed deleting alert rule: %w", err)
+	}
+	return nil
+}
+
+// Returns stored alert silences, implements `alerting.RuleStore`.
+func (d *db) LoadSilences() ([]alerting.Silence, error) {
+	rows, err := d.pool.Query(d.ctx, "select silence from alert_silences order by id")
+	if err != nil {
+		return nil, fmt.Errorf("pg: failed querying alert silences: %w", err)
+	}
+	defer rows.Close()
+
+	silences := []alerting.Silence{}
+	for rows.Next() {
+		s := alerting.Silence{}
+		if err := rows.Scan(&s); err != nil {
+			return nil, fmt.Errorf("pg: failed scanning alert silence: %w", err)
+		}
+		silences = append(silences, s)
+	}
+	return silences, rows.Err()
+}
+
+func (d *db) SaveSilence(s alerting.Silence) error {
+	q := `INSERT INTO alert_silences (id, silence) VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET silence = excluded.silence`
+	if _, err := d.pool.Exec(d.ctx, q, s.ID, s); err != nil {
+		return fmt.Errorf("pg: failed saving alert silence: %w", err)
+	}
+	return nil
+}
+
+func (d *db) DeleteSilence(id string) error {
+	if _, err := d.pool.Exec(d.ctx, "delete from alert_silences where id = $1", id); err != nil {
+		return fmt.Errorf("pg: failed deleting alert silence: %w", err)
+	}
+	return nil
+}
+
+// ============ Not exported
+
+func scanAggregate(row pgx.Row) (models.Aggregate, error) {
+	a := models.Aggregate{}
+	err := row.Scan(&a.Start, &a.Count, &a.Min, &a.Max, &a.Avg, &a.Last, &a.Sum, &a.Rate, &a.Total)
+	return a, err
+}
+
+func resolutionSeconds(resolution time.Duration) int64 {
+	return int64(resolution / time.Second)
+}
+
+// Metrics without labels have the empty object stored, JSON `null` would be a different series.
+func labelsJSON(labels map[string]string) map[string]string {
+	if labels == nil {
+		return map[string]string{}
+	}
+	return labels
+}
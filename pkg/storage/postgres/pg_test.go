@@ -0,0 +1,104 @@
+package postgres_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/backup"
+	"github.com/amiskov/metrics-and-alerting/pkg/backup/filestore"
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	"github.com/amiskov/metrics-and-alerting/pkg/server/repo"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/postgres"
+	"github.com/amiskov/metrics-and-alerting/pkg/storage/storagetest"
+)
+
+// Runs against the database from `TEST_DATABASE_DSN`, its metrics are deleted.
+func TestConformance(t *testing.T) {
+	dsn, ok := os.LookupEnv("TEST_DATABASE_DSN")
+	if !ok {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, closeDB := postgres.New(ctx, dsn)
+	defer closeDB()
+	db.Migrate()
+
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+
+	storagetest.Run(t, func(t *testing.T) repo.Storage {
+		if _, err := conn.Exec(ctx, "TRUNCATE metrics, metrics_history, metrics_aggregates"); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
+
+// Dumps the database to the snapshot file and restores it into the emptied database.
+func TestBackupRoundTrip(t *testing.T) {
+	dsn, ok := os.LookupEnv("TEST_DATABASE_DSN")
+	if !ok {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, closeDB := postgres.New(ctx, dsn)
+	defer closeDB()
+	db.Migrate()
+
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	truncate := func() {
+		if _, err := conn.Exec(ctx, "TRUNCATE metrics, metrics_history, metrics_aggregates"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	truncate()
+
+	value, delta := 1.5, int64(3)
+	err = db.BulkUpdate([]models.Metrics{
+		{ID: "Alloc", MType: models.MGauge, Value: &value, Labels: map[string]string{"host": "web1"}},
+		{ID: "PollCount", MType: models.MCounter, Delta: &delta},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, _, err := filestore.New(filepath.Join(t.TempDir(), "db.json"), filestore.Options{Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := backup.New(ctx, nil, db, store, nil)
+	if err := worker.Dump(); err != nil {
+		t.Fatal(err)
+	}
+	truncate()
+	if err := worker.Restore(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	alloc, err := db.Get(models.MGauge, "Alloc", map[string]string{"host": "web1"})
+	if err != nil || *alloc.Value != value {
+		t.Errorf("Expected restored `Alloc` %v, got %+v %v", value, alloc, err)
+	}
+	pollCount, err := db.Get(models.MCounter, "PollCount", nil)
+	if err != nil || *pollCount.Delta != delta {
+		t.Errorf("Expected restored `PollCount` %d, got %+v %v", delta, pollCount, err)
+	}
+}
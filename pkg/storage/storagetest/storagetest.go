@@ -0,0 +1,232 @@
+// Package `storagetest` is the conformance suite every metrics storage must pass,
+// so the server behaves the same with any of them.
+package storagetest
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/amiskov/metrics-and-alerting/pkg/models"
+	"github.com/amiskov/metrics-and-alerting/pkg/server/repo"
+)
+
+// Returns the empty storage which keeps the history.
+type Factory func(t *testing.T) repo.Storage
+
+func Run(t *testing.T, newStorage Factory) {
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.run(t, newStorage(t))
+		})
+	}
+}
+
+// ============ Not exported
+
+var cases = []struct {
+	name string
+	run  func(t *testing.T, s repo.Storage)
+}{
+	{name: "test missing metric", run: testMissing},
+	{name: "test gauge is replaced", run: testGauge},
+	{name: "test counter accumulates", run: testCounter},
+	{name: "test gauge and counter with the same name", run: testSameName},
+	{name: "test series by labels", run: testLabels},
+	{name: "test bulk update", run: testBulkUpdate},
+	{name: "test update time", run: testUpdatedAt},
+	{name: "test history of series", run: testHistory},
+}
+
+func testMissing(t *testing.T, s repo.Storage) {
+	update(t, s, gauge("Alloc", 1, nil))
+
+	for _, q := range []struct{ mType, name string }{
+		{models.MGauge, "HeapAlloc"},
+		{models.MCounter, "Alloc"},
+	} {
+		if _, err := s.Get(q.mType, q.name, nil); !errors.Is(err, models.ErrorMetricNotFound) {
+			t.Errorf("Expected `%s` `%s` not found, got %v", q.mType, q.name, err)
+		}
+	}
+	if _, err := s.Get(models.MGauge, "Alloc", map[string]string{"host": "web1"}); !errors.Is(err, models.ErrorMetricNotFound) {
+		t.Errorf("Expected the labeled series not found, got %v", err)
+	}
+}
+
+func testGauge(t *testing.T, s repo.Storage) {
+	update(t, s, gauge("Alloc", 1, nil))
+	update(t, s, gauge("Alloc", 2.5, nil))
+
+	assertValue(t, get(t, s, models.MGauge, "Alloc", nil), 2.5)
+}
+
+func testCounter(t *testing.T, s repo.Storage) {
+	update(t, s, counter("PollCount", 2, nil))
+	update(t, s, counter("PollCount", 3, nil))
+
+	assertDelta(t, get(t, s, models.MCounter, "PollCount", nil), 5)
+}
+
+func testSameName(t *testing.T, s repo.Storage) {
+	update(t, s, gauge("Requests", 1.5, nil))
+	update(t, s, counter("Requests", 2, nil))
+	update(t, s, counter("Requests", 2, nil))
+
+	assertValue(t, get(t, s, models.MGauge, "Requests", nil), 1.5)
+	assertDelta(t, get(t, s, models.MCounter, "Requests", nil), 4)
+	assertSeries(t, s, `counter:Requests`, `gauge:Requests`)
+}
+
+func testLabels(t *testing.T, s repo.Storage) {
+	web1 := map[string]string{"host": "web1", "agent_id": "a1"}
+	web2 := map[string]string{"host": "web2", "agent_id": "a2"}
+	update(t, s, gauge("Alloc", 1, web1))
+	update(t, s, gauge("Alloc", 2, web2))
+	update(t, s, gauge("Alloc", 3, nil))
+	update(t, s, counter("PollCount", 1, web1))
+	update(t, s, counter("PollCount", 1, web1))
+
+	m := get(t, s, models.MGauge, "Alloc", web1)
+	assertValue(t, m, 1)
+	if m.Labels["host"] != "web1" || m.Labels["agent_id"] != "a1" || len(m.Labels) != 2 {
+		t.Errorf("Expected labels %v, got %v", web1, m.Labels)
+	}
+	assertValue(t, get(t, s, models.MGauge, "Alloc", web2), 2)
+	assertValue(t, get(t, s, models.MGauge, "Alloc", nil), 3)
+	assertDelta(t, get(t, s, models.MCounter, "PollCount", web1), 2)
+
+	// labels are compared regardless of the order of keys
+	reordered := map[string]string{"agent_id": "a2", "host": "web2"}
+	assertValue(t, get(t, s, models.MGauge, "Alloc", reordered), 2)
+
+	assertSeries(t, s,
+		`counter:PollCount{agent_id="a1",host="web1"}`,
+		`gauge:Alloc`,
+		`gauge:Alloc{agent_id="a1",host="web1"}`,
+		`gauge:Alloc{agent_id="a2",host="web2"}`,
+	)
+}
+
+func testBulkUpdate(t *testing.T, s repo.Storage) {
+	err := s.BulkUpdate([]models.Metrics{
+		gauge("Alloc", 1, nil),
+		counter("PollCount", 2, nil),
+		counter("PollCount", 3, nil),
+		gauge("Alloc", 4, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertValue(t, get(t, s, models.MGauge, "Alloc", nil), 4)
+	assertDelta(t, get(t, s, models.MCounter, "PollCount", nil), 5)
+}
+
+func testUpdatedAt(t *testing.T, s repo.Storage) {
+	updated := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	m := gauge("Alloc", 1, nil)
+	m.UpdatedAt = &updated
+	update(t, s, m)
+
+	got := get(t, s, models.MGauge, "Alloc", nil)
+	if got.UpdatedAt == nil || !got.UpdatedAt.Equal(updated) {
+		t.Errorf("Expected update time %s, got %v", updated, got.UpdatedAt)
+	}
+}
+
+func testHistory(t *testing.T, s repo.Storage) {
+	labels := map[string]string{"host": "web1"}
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		ts := start.Add(time.Duration(i) * time.Second)
+		m := counter("PollCount", 1, labels)
+		m.UpdatedAt = &ts
+		update(t, s, m)
+	}
+	update(t, s, counter("PollCount", 10, nil)) // another series
+
+	samples, err := s.History(models.MCounter, models.SeriesName("PollCount", labels), start, start.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("Expected 2 samples, got %+v", samples)
+	}
+	for i, want := range []int64{1, 2} {
+		if !samples[i].Timestamp.Equal(start.Add(time.Duration(i) * time.Second)) {
+			t.Errorf("Expected sample #%d at %s, got %s", i, start.Add(time.Duration(i)*time.Second), samples[i].Timestamp)
+		}
+		if samples[i].Delta == nil || *samples[i].Delta != want {
+			t.Errorf("Expected sample #%d total %d, got %v", i, want, samples[i].Delta)
+		}
+	}
+}
+
+func gauge(name string, v float64, labels map[string]string) models.Metrics {
+	return models.Metrics{ID: name, MType: models.MGauge, Value: &v, Labels: labels}
+}
+
+func counter(name string, d int64, labels map[string]string) models.Metrics {
+	return models.Metrics{ID: name, MType: models.MCounter, Delta: &d, Labels: labels}
+}
+
+func update(t *testing.T, s repo.Storage, m models.Metrics) {
+	t.Helper()
+	if err := s.Update(m); err != nil {
+		t.Fatalf("Failed updating `%s`: %v", m.SeriesName(), err)
+	}
+}
+
+func get(t *testing.T, s repo.Storage, mType, name string, labels map[string]string) models.Metrics {
+	t.Helper()
+	m, err := s.Get(mType, name, labels)
+	if err != nil {
+		t.Fatalf("Failed getting `%s` `%s`: %v", mType, models.SeriesName(name, labels), err)
+	}
+	if m.ID != name || m.MType != mType {
+		t.Fatalf("Expected `%s` `%s`, got `%s` `%s`", mType, name, m.MType, m.ID)
+	}
+	return m
+}
+
+func assertValue(t *testing.T, m models.Metrics, want float64) {
+	t.Helper()
+	if m.Value == nil || *m.Value != want {
+		t.Errorf("Expected `%s` value %v, got %v", m.SeriesName(), want, m.Value)
+	}
+}
+
+func assertDelta(t *testing.T, m models.Metrics, want int64) {
+	t.Helper()
+	if m.Delta == nil || *m.Delta != want {
+		t.Errorf("Expected `%s` delta %d, got %v", m.SeriesName(), want, m.Delta)
+	}
+}
+
+// Checks all the stored series, they are given as sorted `type:series`.
+func assertSeries(t *testing.T, s repo.Storage, want ...string) {
+	t.Helper()
+	metrics, err := s.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		got = append(got, m.MType+":"+m.SeriesName())
+	}
+	sort.Strings(got)
+
+	if len(got) != len(want) {
+		t.Fatalf("Expected series %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected series %v, got %v", want, got)
+			return
+		}
+	}
+}